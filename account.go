@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	emailTokenAudience = "chirpy-email"
+	emailTokenTTL      = 24 * time.Hour
+	verifyResendLimit  = 3
+	verifyResendWindow = time.Hour
+)
+
+// errStaleEmailLink means a verification link is for an address the user is
+// no longer waiting to confirm.
+var errStaleEmailLink = errors.New("email link is for another address")
+
+// emailClaims are carried by the one-time links that confirm a user owns
+// an address. They are signed with the access token keys but have their
+// own audience, so neither kind of token passes for the other.
+type emailClaims struct {
+	jwt.RegisteredClaims
+	Email string `json:"email"`
+}
+
+func (cfg *apiConfig) produceEmailToken(userId int, email string) (string, error) {
+	now := time.Now().UTC()
+	return cfg.keys.sign(emailClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    cfg.issuer,
+			Audience:  jwt.ClaimStrings{emailTokenAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(emailTokenTTL)),
+			Subject:   strconv.Itoa(userId),
+			ID:        newTokenId(),
+		},
+		Email: email,
+	})
+}
+
+func (cfg *apiConfig) validateEmailToken(tokenString string) (*emailClaims, error) {
+	claims := &emailClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, cfg.keys.keyfunc,
+		jwt.WithValidMethods([]string{algEdDSA, algRS256}),
+		jwt.WithIssuer(cfg.issuer),
+		jwt.WithAudience(emailTokenAudience),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(cfg.jwtLeeway),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if claims.ID == "" || claims.Email == "" {
+		return nil, errors.New("email token is missing claims")
+	}
+	return claims, nil
+}
+
+// sendEmailVerification mails the link that confirms user owns email.
+func (cfg *apiConfig) sendEmailVerification(user User, email string) error {
+	token, err := cfg.produceEmailToken(user.Id, email)
+	if err != nil {
+		return err
+	}
+	link := getBaseURL() + "/api/users/verify-email?token=" + url.QueryEscape(token)
+	return cfg.mailer.Send(mailMessage{
+		To:      email,
+		Subject: "Confirm your Chirpy email address",
+		Body: fmt.Sprintf("Follow this link within %s to confirm %s is your email address:\n\n%s\n\n"+
+			"If you did not ask for this, you can ignore this email.\n", emailTokenTTL, email, link),
+	})
+}
+
+// checkCurrentPassword re-authenticates the caller before a sensitive
+// change. Wrong guesses count towards the same lockout as failed logins.
+// It writes the response and returns false if the change must not go
+// ahead.
+func (cfg *apiConfig) checkCurrentPassword(w http.ResponseWriter, r *http.Request, user User, password string) bool {
+	ip := clientIP(r)
+	if wait := cfg.throttle.check(user.Email, ip, time.Now().UTC()); wait > 0 {
+		writeTooManyAttempts(w, wait)
+		return false
+	}
+	err := cfg.passwords.Verify(user.PasswordHash, password)
+	if err != nil {
+		if err != errPasswordMismatch {
+			fmt.Printf("Could not check password for user %d: %s\n", user.Id, err)
+		}
+		cfg.loginFailed(user.Email, ip, user.Id)
+		w.WriteHeader(403)
+		w.Write([]byte("Current password is incorrect\n"))
+		return false
+	}
+	return true
+}
+
+func writeUserInfo(w http.ResponseWriter, user User) {
+	data, err := json.Marshal(UserInfo{
+		Id:               user.Id,
+		Email:            user.Email,
+		IsChirpyRed:      user.IsChirpyRed,
+		EmailVerified:    user.EmailVerified,
+		TwoFactorEnabled: user.TOTPSecret != "",
+		PendingEmail:     user.PendingEmail,
+	})
+	if err != nil {
+		fmt.Printf("Error marshalling userInfo to JSON: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(data)
+}
+
+// getMe returns the caller's account details.
+func (cfg *apiConfig) getMe(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+
+	user, err := cfg.store.GetUser(caller.UserId)
+	if err != nil {
+		writeUnauthorized(w, "user no longer exists")
+		return
+	}
+	writeUserInfo(w, user)
+}
+
+// updateMe applies a partial profile update. Fields left out of the body are
+// not touched. A new email address needs the current password and only
+// takes effect once the link sent to it has been followed.
+func (cfg *apiConfig) updateMe(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+
+	type parameters struct {
+		Email           *string `json:"email"`
+		CurrentPassword string  `json:"current_password"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		log.Printf("Error decoding parameters: %s", err)
+		w.WriteHeader(400)
+		return
+	}
+	user, err := cfg.store.GetUser(caller.UserId)
+	if err != nil {
+		writeUnauthorized(w, "user no longer exists")
+		return
+	}
+	if params.Email == nil {
+		writeUserInfo(w, user)
+		return
+	}
+
+	email := strings.TrimSpace(*params.Email)
+	pending := ""
+	if !strings.EqualFold(email, user.Email) {
+		if !validateEmail(email) {
+			out := fmt.Sprintf("%s is not a valid email address\n", email)
+			w.WriteHeader(400)
+			w.Write([]byte(out))
+			return
+		}
+		if duplicateUserCheck(cfg.store, email) {
+			out := fmt.Sprintf("Email address %s is already in use\n", email)
+			w.WriteHeader(400)
+			w.Write([]byte(out))
+			return
+		}
+		if !cfg.checkCurrentPassword(w, r, user, params.CurrentPassword) {
+			return
+		}
+		pending = email
+	}
+	user, err = cfg.store.UpdateUserFunc(user.Id, func(user *User) error {
+		user.PendingEmail = pending
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("There was an error saving updated user: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+	if user.PendingEmail != "" {
+		if err := cfg.sendEmailVerification(user, user.PendingEmail); err != nil {
+			fmt.Printf("Could not send email verification to user %d: %s\n", user.Id, err)
+		}
+		cfg.audit.record(auditEvent{
+			Event:  "email.change_requested",
+			UserId: user.Id,
+			Email:  user.Email,
+			IP:     clientIP(r),
+			Detail: "to " + user.PendingEmail,
+		})
+	}
+	writeUserInfo(w, user)
+}
+
+// verifyEmail is where verification links land, both the one sent on
+// sign up and the one sent when changing address. Each link works once,
+// and a change link only for the address the user most recently asked to
+// change to.
+func (cfg *apiConfig) verifyEmail(w http.ResponseWriter, r *http.Request) {
+	claims, err := cfg.validateEmailToken(r.URL.Query().Get("token"))
+	if err != nil {
+		fmt.Printf("Rejected email token: %s\n", err)
+		w.WriteHeader(400)
+		w.Write([]byte("Verification link is invalid or has expired\n"))
+		return
+	}
+	// Used links are remembered in the revocation list until they expire.
+	// Using one up comes first, so only one of several racing requests
+	// gets to apply it.
+	err = cfg.store.RevokeAccessToken(claims.ID, claims.ExpiresAt.Time)
+	if err != nil && err != errAlreadyRevoked {
+		fmt.Printf("Error using email token: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+	used := err == errAlreadyRevoked
+	uid, err := strconv.Atoi(claims.Subject)
+	if used || err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte("Verification link is invalid or has expired\n"))
+		return
+	}
+	previous := ""
+	user, err := cfg.store.UpdateUserFunc(uid, func(user *User) error {
+		previous = user.Email
+		switch {
+		case user.PendingEmail != "" && strings.EqualFold(user.PendingEmail, claims.Email):
+			user.Email = user.PendingEmail
+			user.PendingEmail = ""
+		case !user.EmailVerified && strings.EqualFold(user.Email, claims.Email):
+		default:
+			return errStaleEmailLink
+		}
+		user.EmailVerified = true
+		return nil
+	})
+	if err == errNotFound || err == errStaleEmailLink {
+		w.WriteHeader(400)
+		w.Write([]byte("Verification link is invalid or has expired\n"))
+		return
+	}
+	if err == errDuplicateEmail {
+		w.WriteHeader(409)
+		w.Write([]byte(fmt.Sprintf("Email address %s is already in use\n", claims.Email)))
+		return
+	}
+	if err != nil {
+		fmt.Printf("There was an error saving updated user: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+	event := auditEvent{Event: "email.verified", UserId: user.Id, Email: user.Email, IP: clientIP(r)}
+	if previous != user.Email {
+		event.Event = "email.changed"
+		event.Detail = "from " + previous
+	}
+	cfg.audit.record(event)
+	writeUserInfo(w, user)
+}
+
+// resendVerification sends a fresh verification link for the address
+// waiting to be confirmed, if any, a few times an hour at most.
+func (cfg *apiConfig) resendVerification(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+
+	user, err := cfg.store.GetUser(caller.UserId)
+	if err != nil {
+		writeUnauthorized(w, "user no longer exists")
+		return
+	}
+	email := user.PendingEmail
+	if email == "" && !user.EmailVerified {
+		email = user.Email
+	}
+	if email == "" {
+		w.WriteHeader(409)
+		w.Write([]byte("Email address is already verified\n"))
+		return
+	}
+	if ok, wait := cfg.verifyResends.allow(strconv.Itoa(user.Id), time.Now().UTC()); !ok {
+		writeTooManyRequests(w, wait, "Too many verification emails requested, try again later")
+		return
+	}
+	if err := cfg.sendEmailVerification(user, email); err != nil {
+		fmt.Printf("Could not send email verification to user %d: %s\n", user.Id, err)
+		w.WriteHeader(502)
+		return
+	}
+	w.WriteHeader(202)
+}
+
+// changePassword sets a new password after checking the current one, and
+// ends every other session so a thief holding one is logged out. The
+// access tokens of those sessions stop working along with them, and so do
+// all personal access tokens, which a thief could have made.
+func (cfg *apiConfig) changePassword(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+
+	type parameters struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		log.Printf("Error decoding parameters: %s", err)
+		w.WriteHeader(400)
+		return
+	}
+	user, err := cfg.store.GetUser(caller.UserId)
+	if err != nil {
+		writeUnauthorized(w, "user no longer exists")
+		return
+	}
+	if !cfg.checkCurrentPassword(w, r, user, params.CurrentPassword) {
+		return
+	}
+	if violations := cfg.passwordPolicy.check(params.NewPassword, user.Email); len(violations) > 0 {
+		writePolicyViolations(w, violations)
+		return
+	}
+	hash, err := cfg.passwords.Hash(params.NewPassword)
+	if err != nil {
+		fmt.Printf("There was an error generating a password hash: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+	_, err = cfg.store.UpdateUserFunc(user.Id, func(user *User) error {
+		user.PasswordHash = hash
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("There was an error saving updated user: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	sessions, err := cfg.store.GetUserRefreshTokens(user.Id)
+	if err != nil {
+		fmt.Printf("Error reading sessions for user %d: %s\n", user.Id, err)
+	}
+	for _, session := range sessions {
+		if session.Id == caller.SessionId {
+			continue
+		}
+		err := cfg.store.DeleteRefreshToken(session.Id)
+		if err != nil && err != errNotFound {
+			fmt.Printf("Error ending session %s after password change: %s\n", session.Id, err)
+		}
+	}
+	if err := cfg.store.DeleteUserPersonalAccessTokens(user.Id); err != nil {
+		fmt.Printf("Error revoking personal access tokens for user %d after password change: %s\n", user.Id, err)
+	}
+	cfg.audit.record(auditEvent{
+		Event:  "password.changed",
+		UserId: user.Id,
+		Email:  user.Email,
+		IP:     clientIP(r),
+	})
+	w.WriteHeader(204)
+}
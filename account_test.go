@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+// signUpUnverified signs up through the API, which leaves the address
+// unverified, and returns the path of the mailed verification link along
+// with a logged-in session.
+func signUpUnverified(t *testing.T, cfg *apiConfig, email string) (string, loginResponse) {
+	t.Helper()
+	handler := cfg.routes()
+	rec := doRequest(t, handler, "POST", "/api/users", "", map[string]string{"email": email, "password": testPassword})
+	if rec.Code != 201 {
+		t.Fatalf("signing up: got %d %q", rec.Code, rec.Body.String())
+	}
+	msg, ok := cfg.mailer.(*testMailer).last()
+	if !ok {
+		t.Fatal("no verification mail was sent")
+	}
+	link, err := url.Parse(mailLinkPattern.FindString(msg.Body))
+	if err != nil {
+		t.Fatalf("parsing verification link in %q: %s", msg.Body, err)
+	}
+	return link.RequestURI(), login(t, handler, email)
+}
+
+// Posting waits for the address to be verified, and the link that
+// verifies it works only once.
+func TestUnverifiedUserCannotChirp(t *testing.T) {
+	cfg := newTestConfig(t)
+	handler := cfg.routes()
+	link, session := signUpUnverified(t, cfg, "unverified@example.com")
+	chirp := map[string]string{"body": "hello"}
+
+	if rec := doRequest(t, handler, "POST", "/api/chirps", session.Token, chirp); rec.Code != 403 {
+		t.Errorf("chirping before verifying: got %d, want 403", rec.Code)
+	}
+	if rec := doRequest(t, handler, "GET", link, "", nil); rec.Code != 200 {
+		t.Fatalf("following the verification link: got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := doRequest(t, handler, "POST", "/api/chirps", session.Token, chirp); rec.Code != 201 {
+		t.Errorf("chirping after verifying: got %d %q, want 201", rec.Code, rec.Body.String())
+	}
+	if rec := doRequest(t, handler, "GET", link, "", nil); rec.Code != 400 {
+		t.Errorf("following the verification link again: got %d, want 400", rec.Code)
+	}
+}
+
+func TestVerificationResendIsRateLimited(t *testing.T) {
+	cfg := newTestConfig(t)
+	handler := cfg.routes()
+	_, session := signUpUnverified(t, cfg, "impatient@example.com")
+
+	for i := 0; i < verifyResendLimit; i++ {
+		if rec := doRequest(t, handler, "POST", "/api/users/me/verification", session.Token, nil); rec.Code != 202 {
+			t.Fatalf("resend %d: got %d %q, want 202", i+1, rec.Code, rec.Body.String())
+		}
+	}
+	rec := doRequest(t, handler, "POST", "/api/users/me/verification", session.Token, nil)
+	if rec.Code != 429 || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("resend over the limit: got %d with Retry-After %q, want 429", rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditEvent is one line of the audit trail.
+type auditEvent struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	UserId int       `json:"user_id,omitempty"`
+	Email  string    `json:"email,omitempty"`
+	IP     string    `json:"ip,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// auditLog is an append-only file of security relevant events, one JSON
+// object per line. It is kept apart from the store so it survives restores.
+type auditLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{file: file}, nil
+}
+
+// record appends event, stamping it with the current time. Failures are
+// logged rather than returned so a full disk does not block logins.
+func (a *auditLog) record(event auditEvent) {
+	event.Time = time.Now().UTC()
+	data, err := json.Marshal(event)
+	if err != nil {
+		fmt.Printf("Error marshalling audit event: %s\n", err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.file.Write(append(data, '\n')); err != nil {
+		fmt.Printf("Error writing audit event %s: %s\n", event.Event, err)
+		return
+	}
+	if err := a.file.Sync(); err != nil {
+		fmt.Printf("Error syncing audit log: %s\n", err)
+	}
+}
+
+func (a *auditLog) Close() error {
+	return a.file.Close()
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+type contextKey int
+
+const principalKey contextKey = iota
+
+// principal is the authenticated caller of a request, put in the request
+// context by requireAuth or requireScope. Scopes is empty for a normal login
+// session, which may do anything the user can. For a personal access token
+// TokenId is the token's id and SessionId is empty.
+type principal struct {
+	UserId    int
+	TokenId   string
+	SessionId string
+	ExpiresAt time.Time
+	Scopes    []string
+}
+
+// accessClaims are the claims carried by Chirpy access tokens.
+type accessClaims struct {
+	jwt.RegisteredClaims
+	Scope     string `json:"scope,omitempty"`
+	SessionId string `json:"sid,omitempty"`
+}
+
+func principalFromContext(ctx context.Context) (principal, bool) {
+	p, ok := ctx.Value(principalKey).(principal)
+	return p, ok
+}
+
+// bearerToken pulls the token out of an "Authorization: Bearer <token>"
+// header.
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("authorization")
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// writeUnauthorized sends a 401 with a WWW-Authenticate challenge. An empty
+// description means no credentials were sent at all, which RFC 6750 says
+// should get a bare challenge.
+func writeUnauthorized(w http.ResponseWriter, description string) {
+	challenge := `Bearer realm="chirpy"`
+	if description != "" {
+		challenge += fmt.Sprintf(`, error="invalid_token", error_description=%q`, description)
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(401)
+	if description == "" {
+		description = "Request wasn't made with header 'Authorization: Bearer <my_auth_token>'"
+	}
+	w.Write([]byte(description + "\n"))
+}
+
+// requireAuth only lets through requests made with a login session's
+// access token.
+func (cfg *apiConfig) requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return cfg.requireScope("", next)
+}
+
+// requireScope authenticates the bearer token and hands the request on with
+// the caller's principal in its context. Login sessions are always let
+// through; tokens limited to scopes, such as personal access tokens, only
+// if they carry scope. An empty scope shuts out every scoped token.
+func (cfg *apiConfig) requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tokenString, ok := bearerToken(r)
+		if !ok {
+			writeUnauthorized(w, "")
+			return
+		}
+		var p principal
+		if strings.HasPrefix(tokenString, patPrefix) {
+			p, ok = cfg.authenticatePersonalAccessToken(w, tokenString)
+		} else {
+			p, ok = cfg.authenticateAccessToken(w, tokenString)
+		}
+		if !ok {
+			return
+		}
+		if len(p.Scopes) > 0 && (scope == "" || !slices.Contains(p.Scopes, scope)) {
+			writeInsufficientScope(w, scope)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), principalKey, p)))
+	}
+}
+
+// authenticateAccessToken checks a JWT access token. It writes the
+// response and returns false if the token is no good. An access token only
+// lives as long as the session it came from: once the session is revoked,
+// logged out, rotated away after reuse or ended by a password change, the
+// token stops working even though it has not expired.
+func (cfg *apiConfig) authenticateAccessToken(w http.ResponseWriter, tokenString string) (principal, bool) {
+	claims, err := cfg.validateAccessToken(tokenString)
+	if err != nil {
+		fmt.Printf("Rejected access token: %s\n", err)
+		writeUnauthorized(w, "token is invalid or expired")
+		return principal{}, false
+	}
+	revoked, err := cfg.store.IsAccessTokenRevoked(claims.ID)
+	if err != nil {
+		fmt.Printf("Error checking access token revocation: %s\n", err)
+		w.WriteHeader(500)
+		return principal{}, false
+	}
+	if revoked {
+		writeUnauthorized(w, "token has been revoked")
+		return principal{}, false
+	}
+	uid, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		fmt.Printf("Failed to convert user id string to int: %s\n", err)
+		writeUnauthorized(w, "token subject is not a user")
+		return principal{}, false
+	}
+	if claims.SessionId == "" {
+		writeUnauthorized(w, "token does not belong to a session")
+		return principal{}, false
+	}
+	session, err := cfg.store.GetSession(claims.SessionId)
+	if err == errNotFound || (err == nil && session.UserId != uid) {
+		writeUnauthorized(w, "session has ended")
+		return principal{}, false
+	}
+	if err != nil {
+		fmt.Printf("Error checking access token session: %s\n", err)
+		w.WriteHeader(500)
+		return principal{}, false
+	}
+	return principal{
+		UserId:    uid,
+		TokenId:   claims.ID,
+		SessionId: claims.SessionId,
+		ExpiresAt: claims.ExpiresAt.Time,
+		Scopes:    strings.Fields(claims.Scope),
+	}, true
+}
+
+// writeInsufficientScope sends a 403 for a token that is valid but not
+// allowed to do what was asked, as RFC 6750 describes.
+func writeInsufficientScope(w http.ResponseWriter, scope string) {
+	challenge := `Bearer realm="chirpy", error="insufficient_scope"`
+	message := "This token cannot be used here, log in instead"
+	if scope != "" {
+		challenge += fmt.Sprintf(`, scope=%q`, scope)
+		message = fmt.Sprintf("This token needs the %s scope", scope)
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(403)
+	w.Write([]byte(message + "\n"))
+}
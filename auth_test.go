@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// getMe reports the status /api/users/me answers token with.
+func getMe(t *testing.T, handler http.Handler, token string) int {
+	t.Helper()
+	return doRequest(t, handler, "GET", "/api/users/me", token, nil).Code
+}
+
+// createPAT makes a personal access token that can read the user's
+// profile, using a login session's access token.
+func createPAT(t *testing.T, handler http.Handler, token string) string {
+	t.Helper()
+	rec := doRequest(t, handler, "POST", "/api/tokens", token, map[string]any{
+		"name":   "test",
+		"scopes": []string{scopeUsersRead},
+	})
+	if rec.Code != 201 {
+		t.Fatalf("creating personal access token: got %d %q", rec.Code, rec.Body.String())
+	}
+	info := PersonalAccessTokenInfo{}
+	decodeBody(t, rec, &info)
+	return info.Token
+}
+
+func TestAccessTokenEndsWithSession(t *testing.T) {
+	cfg := newTestConfig(t)
+	handler := cfg.routes()
+	user := createTestUser(t, cfg, "sessions@example.com")
+	laptop := login(t, handler, user.Email)
+	phone := login(t, handler, user.Email)
+
+	rec := doRequest(t, handler, "GET", "/api/sessions", laptop.Token, nil)
+	sessions := []SessionInfo{}
+	decodeBody(t, rec, &sessions)
+	phoneSession := ""
+	for _, session := range sessions {
+		if !session.Current {
+			phoneSession = session.Id
+		}
+	}
+	if len(sessions) != 2 || phoneSession == "" {
+		t.Fatalf("got sessions %+v", sessions)
+	}
+
+	if rec := doRequest(t, handler, "DELETE", "/api/sessions/"+phoneSession, laptop.Token, nil); rec.Code != 204 {
+		t.Fatalf("revoking session: got %d", rec.Code)
+	}
+	if code := getMe(t, handler, phone.Token); code != 401 {
+		t.Errorf("access token of a revoked session: got %d, want 401", code)
+	}
+	if code := getMe(t, handler, laptop.Token); code != 200 {
+		t.Errorf("access token of a live session: got %d, want 200", code)
+	}
+
+	if rec := doRequest(t, handler, "POST", "/api/logout", laptop.Token, nil); rec.Code != 204 {
+		t.Fatalf("logging out: got %d", rec.Code)
+	}
+	if code := getMe(t, handler, laptop.Token); code != 401 {
+		t.Errorf("access token after logout: got %d, want 401", code)
+	}
+}
+
+func TestAccessTokenNeedsItsOwnSession(t *testing.T) {
+	cfg := newTestConfig(t)
+	handler := cfg.routes()
+	alice := createTestUser(t, cfg, "alice@example.com")
+	bob := createTestUser(t, cfg, "bob@example.com")
+	login(t, handler, alice.Email)
+
+	sessions, err := cfg.store.GetUserRefreshTokens(alice.Id)
+	if err != nil || len(sessions) != 1 {
+		t.Fatalf("got sessions %+v, %v", sessions, err)
+	}
+	tests := []struct {
+		name      string
+		uid       int
+		sessionId string
+	}{
+		{"no session", alice.Id, ""},
+		{"unknown session", alice.Id, "no-such-session"},
+		{"someone else's session", bob.Id, sessions[0].Id},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, _, err := cfg.produceJWT(time.Minute, tt.uid, tt.sessionId, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if code := getMe(t, handler, token); code != 401 {
+				t.Errorf("got %d, want 401", code)
+			}
+		})
+	}
+}
+
+// Presenting a rotated refresh token again ends the session, and with it
+// the access tokens handed out by both the thief's and the owner's refresh.
+func TestReusedRefreshTokenEndsAccessTokens(t *testing.T) {
+	cfg := newTestConfig(t)
+	handler := cfg.routes()
+	user := createTestUser(t, cfg, "reuse@example.com")
+	session := login(t, handler, user.Email)
+
+	rec := doRequest(t, handler, "POST", "/api/refresh", session.RefreshToken, nil)
+	if rec.Code != 200 {
+		t.Fatalf("refreshing: got %d %q", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("refresh response has Content-Type %q, want application/json", ct)
+	}
+	refreshed := loginResponse{}
+	decodeBody(t, rec, &refreshed)
+	if code := getMe(t, handler, refreshed.Token); code != 200 {
+		t.Fatalf("refreshed access token: got %d, want 200", code)
+	}
+
+	if rec := doRequest(t, handler, "POST", "/api/refresh", session.RefreshToken, nil); rec.Code != 401 {
+		t.Fatalf("reusing a rotated refresh token: got %d, want 401", rec.Code)
+	}
+	for name, token := range map[string]string{"original": session.Token, "refreshed": refreshed.Token} {
+		if code := getMe(t, handler, token); code != 401 {
+			t.Errorf("%s access token after reuse: got %d, want 401", name, code)
+		}
+	}
+	if !hasAuditEvent(t, cfg, "session.token_reused", user.Id) {
+		t.Errorf("token reuse was not recorded in the audit log")
+	}
+}
+
+// Refreshing or revoking without a Bearer token is answered with a 401
+// challenge, and a token sent under another scheme is not accepted.
+func TestRefreshTokenNeedsBearerScheme(t *testing.T) {
+	cfg := newTestConfig(t)
+	handler := cfg.routes()
+	user := createTestUser(t, cfg, "scheme@example.com")
+	session := login(t, handler, user.Email)
+
+	for _, path := range []string{"/api/refresh", "/api/revoke"} {
+		for name, header := range map[string]string{"no header": "", "other scheme": "Token " + session.RefreshToken} {
+			req := httptest.NewRequest("POST", path, nil)
+			if header != "" {
+				req.Header.Set("Authorization", header)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != 401 || rec.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("%s with %s: got %d with WWW-Authenticate %q, want a 401 challenge",
+					path, name, rec.Code, rec.Header().Get("WWW-Authenticate"))
+			}
+		}
+	}
+	if rec := doRequest(t, handler, "POST", "/api/refresh", session.RefreshToken, nil); rec.Code != 200 {
+		t.Errorf("refreshing with the Bearer scheme: got %d %q, want 200", rec.Code, rec.Body.String())
+	}
+}
+
+func TestLogOutEverywhere(t *testing.T) {
+	cfg := newTestConfig(t)
+	handler := cfg.routes()
+	user := createTestUser(t, cfg, "everywhere@example.com")
+	laptop := login(t, handler, user.Email)
+	phone := login(t, handler, user.Email)
+
+	if rec := doRequest(t, handler, "POST", "/api/sessions/revoke-all", laptop.Token, nil); rec.Code != 204 {
+		t.Fatalf("revoking all sessions: got %d", rec.Code)
+	}
+	for name, token := range map[string]string{"laptop": laptop.Token, "phone": phone.Token} {
+		if code := getMe(t, handler, token); code != 401 {
+			t.Errorf("%s access token after logging out everywhere: got %d, want 401", name, code)
+		}
+	}
+}
+
+func TestChangePasswordEndsOtherSessions(t *testing.T) {
+	cfg := newTestConfig(t)
+	handler := cfg.routes()
+	user := createTestUser(t, cfg, "changer@example.com")
+	laptop := login(t, handler, user.Email)
+	phone := login(t, handler, user.Email)
+	pat := createPAT(t, handler, laptop.Token)
+
+	rec := doRequest(t, handler, "POST", "/api/users/me/password", laptop.Token, map[string]string{
+		"current_password": testPassword,
+		"new_password":     "an-entirely-new-password",
+	})
+	if rec.Code != 204 {
+		t.Fatalf("changing password: got %d %q", rec.Code, rec.Body.String())
+	}
+	if code := getMe(t, handler, phone.Token); code != 401 {
+		t.Errorf("other device's access token: got %d, want 401", code)
+	}
+	if code := getMe(t, handler, pat); code != 401 {
+		t.Errorf("personal access token: got %d, want 401", code)
+	}
+	if code := getMe(t, handler, laptop.Token); code != 200 {
+		t.Errorf("access token the password was changed with: got %d, want 200", code)
+	}
+}
+
+// A personal access token only gets through to routes needing a scope it
+// carries, and never to routes that take login sessions alone.
+func TestPersonalAccessTokenScopes(t *testing.T) {
+	cfg := newTestConfig(t)
+	handler := cfg.routes()
+	user := createTestUser(t, cfg, "scoped@example.com")
+	session := login(t, handler, user.Email)
+	pat := createPAT(t, handler, session.Token)
+
+	rec := doRequest(t, handler, "POST", "/api/chirps", session.Token, map[string]string{"body": "keep me"})
+	if rec.Code != 201 {
+		t.Fatalf("posting a chirp: got %d %q", rec.Code, rec.Body.String())
+	}
+	chirp := Chirp{}
+	decodeBody(t, rec, &chirp)
+	path := fmt.Sprintf("/api/chirps/%d", chirp.Id)
+
+	rec = doRequest(t, handler, "DELETE", path, pat, nil)
+	challenge := rec.Header().Get("WWW-Authenticate")
+	if rec.Code != 403 || !strings.Contains(challenge, `error="insufficient_scope"`) || !strings.Contains(challenge, `scope="chirps:delete"`) {
+		t.Errorf("deleting without chirps:delete: got %d with %q, want 403 insufficient_scope", rec.Code, challenge)
+	}
+	if rec := doRequest(t, handler, "GET", path, "", nil); rec.Code != 200 {
+		t.Errorf("chirp after a refused delete: got %d, want 200", rec.Code)
+	}
+
+	for _, route := range []struct{ method, path string }{
+		{"GET", "/api/sessions"},
+		{"POST", "/api/tokens"},
+		{"PATCH", "/api/users/me"},
+	} {
+		rec := doRequest(t, handler, route.method, route.path, pat, map[string]string{})
+		challenge := rec.Header().Get("WWW-Authenticate")
+		if rec.Code != 403 || !strings.Contains(challenge, `error="insufficient_scope"`) || strings.Contains(challenge, "scope=") {
+			t.Errorf("%s %s with a scoped token: got %d with %q, want 403 insufficient_scope", route.method, route.path, rec.Code, challenge)
+		}
+	}
+	if code := getMe(t, handler, pat); code != 200 {
+		t.Errorf("reading the profile with users:read: got %d, want 200", code)
+	}
+}
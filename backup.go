@@ -0,0 +1,248 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	backupFormatVersion = 1
+	backupManifestName  = "manifest.json"
+	backupChirpsName    = "chirps.json"
+	backupUsersName     = "users.json"
+	backupTokensName    = "refresh_tokens.json"
+	backupPATsName      = "access_tokens.json"
+	backupClientsName   = "oauth_clients.json"
+	maxBackupSize       = 512 << 20
+)
+
+type backupFile struct {
+	Name   string `json:"name"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type backupManifest struct {
+	Version   int          `json:"version"`
+	CreatedAt time.Time    `json:"created_at"`
+	Chirps    int          `json:"chirps"`
+	Users     int          `json:"users"`
+	Tokens    int          `json:"refresh_tokens"`
+	PATs      int          `json:"access_tokens"`
+	Clients   int          `json:"oauth_clients"`
+	Files     []backupFile `json:"files"`
+}
+
+// writeBackup writes snap to w as a gzipped tar holding one JSON file per
+// collection and a manifest with the checksum of each.
+func writeBackup(w io.Writer, snap storeSnapshot) error {
+	contents := []struct {
+		name string
+		v    any
+	}{
+		{backupChirpsName, snap.Chirps},
+		{backupUsersName, snap.Users},
+		{backupTokensName, snap.Tokens},
+		{backupPATsName, snap.AccessTokens},
+		{backupClientsName, snap.OAuthClients},
+	}
+	manifest := backupManifest{
+		Version:   backupFormatVersion,
+		CreatedAt: time.Now().UTC(),
+		Chirps:    len(snap.Chirps.Chirps),
+		Users:     len(snap.Users.Users),
+		Tokens:    len(snap.Tokens.Tokens),
+		PATs:      len(snap.AccessTokens.Tokens),
+		Clients:   len(snap.OAuthClients.Clients),
+	}
+	files := map[string][]byte{}
+	for _, c := range contents {
+		data, err := json.Marshal(c.v)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		files[c.name] = data
+		manifest.Files = append(manifest.Files, backupFile{
+			Name:   c.name,
+			Size:   len(data),
+			SHA256: hex.EncodeToString(sum[:]),
+		})
+	}
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	writeEntry := func(name string, data []byte) error {
+		hdr := &tar.Header{
+			Name:    name,
+			Mode:    0600,
+			Size:    int64(len(data)),
+			ModTime: manifest.CreatedAt,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+	if err := writeEntry(backupManifestName, manifestData); err != nil {
+		return err
+	}
+	for _, f := range manifest.Files {
+		if err := writeEntry(f.Name, files[f.Name]); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// readBackup parses an archive made by writeBackup. Every file listed in
+// the manifest must be present with a matching size and checksum before
+// anything is decoded.
+func readBackup(r io.Reader) (storeSnapshot, backupManifest, error) {
+	snap := storeSnapshot{}
+	manifest := backupManifest{}
+
+	gz, err := gzip.NewReader(io.LimitReader(r, maxBackupSize))
+	if err != nil {
+		return snap, manifest, fmt.Errorf("backup is not a gzip archive: %w", err)
+	}
+	defer gz.Close()
+
+	files := map[string][]byte{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return snap, manifest, fmt.Errorf("reading backup archive: %w", err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return snap, manifest, fmt.Errorf("reading %s from backup: %w", hdr.Name, err)
+		}
+		files[hdr.Name] = data
+	}
+
+	manifestData, ok := files[backupManifestName]
+	if !ok {
+		return snap, manifest, errors.New("backup has no manifest")
+	}
+	if err := json.Unmarshal(manifestData, &manifest); err != nil {
+		return snap, manifest, fmt.Errorf("backup manifest is corrupt: %w", err)
+	}
+	if manifest.Version != backupFormatVersion {
+		return snap, manifest, fmt.Errorf("unsupported backup version %d", manifest.Version)
+	}
+	listed := map[string]bool{}
+	for _, f := range manifest.Files {
+		data, ok := files[f.Name]
+		if !ok {
+			return snap, manifest, fmt.Errorf("backup is missing %s", f.Name)
+		}
+		sum := sha256.Sum256(data)
+		if len(data) != f.Size || hex.EncodeToString(sum[:]) != f.SHA256 {
+			return snap, manifest, fmt.Errorf("checksum mismatch for %s", f.Name)
+		}
+		listed[f.Name] = true
+	}
+
+	// Backups from before personal access tokens or OAuth clients have no
+	// file for them.
+	targets := []struct {
+		name     string
+		v        any
+		optional bool
+	}{
+		{backupChirpsName, &snap.Chirps, false},
+		{backupUsersName, &snap.Users, false},
+		{backupTokensName, &snap.Tokens, false},
+		{backupPATsName, &snap.AccessTokens, true},
+		{backupClientsName, &snap.OAuthClients, true},
+	}
+	for _, t := range targets {
+		if !listed[t.name] && t.optional {
+			continue
+		}
+		if !listed[t.name] {
+			return snap, manifest, fmt.Errorf("backup manifest does not list %s", t.name)
+		}
+		if err := json.Unmarshal(files[t.name], t.v); err != nil {
+			return snap, manifest, fmt.Errorf("%s in backup is corrupt: %w", t.name, err)
+		}
+	}
+	if snap.Chirps.Chirps == nil {
+		snap.Chirps.Chirps = make(map[int]Chirp)
+	}
+	if snap.Users.Users == nil {
+		snap.Users.Users = make(map[int]User)
+	}
+	if snap.AccessTokens.Tokens == nil {
+		snap.AccessTokens.Tokens = make(map[string]PersonalAccessToken)
+	}
+	if snap.OAuthClients.Clients == nil {
+		snap.OAuthClients.Clients = make(map[string]OAuthClient)
+	}
+	snap.Tokens = hashRefreshTokens(normalizeRefreshTokens(snap.Tokens))
+	if len(snap.Chirps.Chirps) != manifest.Chirps || len(snap.Users.Users) != manifest.Users ||
+		len(snap.Tokens.Tokens) != manifest.Tokens || len(snap.AccessTokens.Tokens) != manifest.PATs ||
+		len(snap.OAuthClients.Clients) != manifest.Clients {
+		return snap, manifest, errors.New("backup record counts do not match its manifest")
+	}
+	return snap, manifest, nil
+}
+
+func (cfg *apiConfig) backupHandler(w http.ResponseWriter, r *http.Request) {
+	snap, err := cfg.store.Snapshot()
+	if err != nil {
+		fmt.Printf("Could not snapshot store for backup: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+	name := fmt.Sprintf("chirpy-backup-%s.tar.gz", time.Now().UTC().Format("20060102T150405Z"))
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	w.WriteHeader(200)
+	if err := writeBackup(w, snap); err != nil {
+		fmt.Printf("Failed while streaming backup: %s\n", err)
+	}
+}
+
+func (cfg *apiConfig) restoreHandler(w http.ResponseWriter, r *http.Request) {
+	snap, manifest, err := readBackup(http.MaxBytesReader(w, r.Body, maxBackupSize))
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(fmt.Sprintf("Backup rejected: %s\n", err)))
+		return
+	}
+	if err := cfg.store.Restore(snap); err != nil {
+		fmt.Printf("Could not restore backup: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(data)
+}
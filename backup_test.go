@@ -0,0 +1,170 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newBackupSource returns a store holding one record of each kind a backup
+// carries.
+func newBackupSource(t *testing.T) Store {
+	t.Helper()
+	store := newMemoryStore()
+	now := time.Now().UTC().Truncate(time.Second)
+	user, err := store.CreateUser(User{Email: "backup@example.com", PasswordHash: []byte("hash")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.CreateChirp(Chirp{Body: "kept safe", AuthorId: user.Id}); err != nil {
+		t.Fatal(err)
+	}
+	session := RefreshToken{
+		Id:            newSessionId(),
+		UserId:        user.Id,
+		Token:         hashRefreshToken(newRefreshToken()),
+		ExirationDate: now.Add(time.Hour),
+		CreatedAt:     now,
+		LastUsedAt:    now,
+	}
+	if err := store.SaveRefreshToken(session); err != nil {
+		t.Fatal(err)
+	}
+	pat := PersonalAccessToken{
+		Id:        newSessionId(),
+		UserId:    user.Id,
+		Name:      "bot",
+		Token:     hashRefreshToken(newRefreshToken()),
+		Scopes:    []string{scopeUsersRead},
+		CreatedAt: now,
+		ExpiresAt: now.Add(24 * time.Hour),
+	}
+	if err := store.SavePersonalAccessToken(pat); err != nil {
+		t.Fatal(err)
+	}
+	client := OAuthClient{
+		Id:           newSessionId(),
+		OwnerId:      user.Id,
+		Name:         "Example",
+		RedirectURIs: []string{"https://app.example.com/callback"},
+		CreatedAt:    now,
+	}
+	if err := store.SaveOAuthClient(client); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// snapshotJSON returns store's records for comparing. The next ids are left
+// out since sqlite keeps its own sequences and does not report them.
+func snapshotJSON(t *testing.T, store Store) string {
+	t.Helper()
+	snap, err := store.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap.Chirps.NextId = 0
+	snap.Users.NextId = 0
+	data, err := json.Marshal(snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestBackupRestoreRoundTrip(t *testing.T) {
+	source := newBackupSource(t)
+	snap, err := source.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := bytes.Buffer{}
+	if err := writeBackup(&archive, snap); err != nil {
+		t.Fatalf("writing backup: %s", err)
+	}
+	want := snapshotJSON(t, source)
+
+	stores := map[string]Store{
+		"memory": newMemoryStore(),
+		"sqlite": newTestSQLiteStore(t),
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			restored, manifest, err := readBackup(bytes.NewReader(archive.Bytes()))
+			if err != nil {
+				t.Fatalf("reading backup: %s", err)
+			}
+			if manifest.Users != 1 || manifest.Chirps != 1 || manifest.Tokens != 1 || manifest.PATs != 1 || manifest.Clients != 1 {
+				t.Errorf("manifest counts: got %+v, want one of each", manifest)
+			}
+			if err := store.Restore(restored); err != nil {
+				t.Fatalf("restoring: %s", err)
+			}
+			if got := snapshotJSON(t, store); got != want {
+				t.Errorf("snapshot after restore:\n got %s\nwant %s", got, want)
+			}
+		})
+	}
+}
+
+// A file whose contents no longer match the manifest's checksum is refused
+// before anything is restored.
+func TestBackupChecksumMismatchIsRejected(t *testing.T) {
+	snap, err := newBackupSource(t).Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := bytes.Buffer{}
+	if err := writeBackup(&archive, snap); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rewrite the archive with one byte of the users file changed.
+	gz, err := gzip.NewReader(&archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := bytes.Buffer{}
+	gzw := gzip.NewWriter(&tampered)
+	tw := tar.NewWriter(gzw)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name == backupUsersName {
+			data = bytes.Replace(data, []byte("backup@"), []byte("hacked@"), 1)
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = readBackup(&tampered)
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch for "+backupUsersName) {
+		t.Errorf("got %v, want a checksum mismatch for %s", err, backupUsersName)
+	}
+}
@@ -1,13 +1,10 @@
 package main
 
 import (
-	"bufio"
 	"encoding/json"
 	"fmt"
-	"github.com/golang-jwt/jwt/v5"
 	"log"
 	"net/http"
-	"os"
 	"sort"
 	"strconv"
 	"strings"
@@ -19,48 +16,27 @@ type Chirp struct {
 	AuthorId int    `json:"author_id"`
 }
 
+// ChirpData holds every chirp by id. NextId is the id the next chirp gets,
+// kept so that the id of a deleted chirp is never handed out again.
 type ChirpData struct {
 	Chirps map[int]Chirp `json:"chirps"`
+	NextId int           `json:"next_id,omitempty"`
 }
 
-func readChirps(file string) ChirpData {
-	db, err := os.Open(file)
-	if err != nil {
-		fmt.Printf("There was an error opening DB for reading: %s\n", err)
-	}
-	defer db.Close()
-
-	scanner := bufio.NewScanner(db)
+func readChirps(file string) (ChirpData, error) {
 	chirps := ChirpData{}
-
-	for scanner.Scan() {
-		data := scanner.Text()
-		err := json.Unmarshal([]byte(data), &chirps)
-		if err != nil {
-			fmt.Printf("Error unmarshalling JSON from DB: %s\n", err)
-		}
-	}
-	return chirps
-}
-
-func saveChirps(file string, chirps ChirpData) {
-	if err := os.Truncate(file, 0); err != nil {
-		fmt.Printf("Failed to truncate: %v", err)
+	if err := readJSONFile(file, &chirps); err != nil {
+		return chirps, err
 	}
-	db, err := os.OpenFile(file, os.O_WRONLY, 0666)
-	if err != nil {
-		fmt.Printf("There was an error opening DB for reading: %s\n", err)
+	if chirps.Chirps == nil {
+		chirps.Chirps = make(map[int]Chirp)
 	}
-	defer db.Close()
+	chirps.setNextId()
+	return chirps, nil
+}
 
-	data, marshallError := json.Marshal(&chirps)
-	if marshallError != nil {
-		fmt.Printf("Error marshalling chirpdata to JSON: %s\n", marshallError)
-	}
-	_, err = db.Write(data)
-	if err != nil {
-		fmt.Printf("Problem writing chirps to db: %s\n", err)
-	}
+func saveChirps(file string, chirps ChirpData) error {
+	return writeJSONFile(file, &chirps)
 }
 
 func cleanProfanity(str string) string {
@@ -78,60 +54,30 @@ func cleanProfanity(str string) string {
 	return str
 }
 
-func newChirp(w http.ResponseWriter, r *http.Request) {
-	header := r.Header.Get("authorization")
-	if header == "" {
-		out := "Request wasn't made with header 'Authorization: Bearer <my_auth_token>'"
-		w.Write([]byte(out))
-		w.WriteHeader(400)
-		return
-	}
-	bearerToken := strings.Replace(header, "Bearer ", "", 1)
-	secret := os.Getenv("JWT_SECRET")
-	claims := &jwt.RegisteredClaims{}
-	parsedToken, err := jwt.ParseWithClaims(bearerToken, claims, func(t *jwt.Token) (interface{}, error) {
-		return []byte(secret), nil
-	})
-	if err != nil {
-		fmt.Printf("Error parsing claims from received token: %s\n", err)
-		w.WriteHeader(401)
-		return
-	}
-	issuer, err := parsedToken.Claims.GetIssuer()
-	if err != nil {
-		fmt.Printf("There was an error reading issuer from parsed token claims: %s\n", err)
-	}
-	if issuer != "chirpy" {
-		fmt.Println("Parsed a JWT that we did not issue")
-		w.WriteHeader(401)
-		return
-	}
-	uid, err := parsedToken.Claims.GetSubject()
-	uidInt, err := strconv.Atoi(uid)
-	if err != nil {
-		fmt.Printf("Failed to convert user id string to int: %s\n", err)
-	}
+func (cfg *apiConfig) newChirp(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
 
 	type parameters struct {
 		Body string `json:"body"`
 	}
 	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
-	err = decoder.Decode(&params)
+	err := decoder.Decode(&params)
 	if err != nil {
 		log.Printf("Error decoding parameters: %s", err)
 		w.WriteHeader(500)
 		return
 	}
 	if len(params.Body) <= 140 {
-		chirps := readChirps(dbFile)
-		chirp := Chirp{
-			Id:       (getHighestChirpId(chirps) + 1),
+		chirp, err := cfg.store.CreateChirp(Chirp{
 			Body:     cleanProfanity(params.Body),
-			AuthorId: uidInt,
+			AuthorId: caller.UserId,
+		})
+		if err != nil {
+			log.Printf("Error saving chirp: %s", err)
+			w.WriteHeader(500)
+			return
 		}
-		chirps.Chirps[chirp.Id] = chirp
-		saveChirps(dbFile, chirps)
 		data, err := json.Marshal(chirp)
 		if err != nil {
 			log.Printf("Error marshalling JSON: %s", err)
@@ -162,10 +108,15 @@ func newChirp(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func getChirps(w http.ResponseWriter, r *http.Request) {
+func (cfg *apiConfig) getChirps(w http.ResponseWriter, r *http.Request) {
 	targetAuthor := r.URL.Query().Get("author_id")
 	sortingOrder := r.URL.Query().Get("sort")
-	chirps := readChirps(dbFile)
+	chirps, err := cfg.store.GetChirps()
+	if err != nil {
+		log.Printf("Error reading chirps: %s", err)
+		w.WriteHeader(500)
+		return
+	}
 	outSlice := []Chirp{}
 	targetAutorInt, err := strconv.Atoi(targetAuthor)
 	authorIdPassed := true
@@ -174,13 +125,11 @@ func getChirps(w http.ResponseWriter, r *http.Request) {
 		fmt.Printf("There was an error converting author_id query param value to an int, or one was not supplied: %s\n", err)
 	}
 	if !authorIdPassed {
-		for _, val := range chirps.Chirps {
-			outSlice = append(outSlice, val)
-		}
+		outSlice = append(outSlice, chirps...)
 	}
 
 	if authorIdPassed {
-		for _, val := range chirps.Chirps {
+		for _, val := range chirps {
 			if val.AuthorId == targetAutorInt {
 				outSlice = append(outSlice, val)
 			}
@@ -208,8 +157,7 @@ func getChirps(w http.ResponseWriter, r *http.Request) {
 	w.Write(data)
 }
 
-func getChirpId(w http.ResponseWriter, r *http.Request) {
-	chirps := readChirps(dbFile)
+func (cfg *apiConfig) getChirpId(w http.ResponseWriter, r *http.Request) {
 	idString := r.PathValue("chirpId")
 	id, convErr := strconv.Atoi(idString)
 	if convErr != nil {
@@ -217,11 +165,16 @@ func getChirpId(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(500)
 		return
 	}
-	chirp, ok := chirps.Chirps[id]
-	if !ok {
+	chirp, err := cfg.store.GetChirp(id)
+	if err == errNotFound {
 		w.WriteHeader(404)
 		return
 	}
+	if err != nil {
+		log.Printf("Error reading chirp: %s", err)
+		w.WriteHeader(500)
+		return
+	}
 
 	data, err := json.Marshal(&chirp)
 	if err != nil {
@@ -234,6 +187,14 @@ func getChirpId(w http.ResponseWriter, r *http.Request) {
 	w.Write(data)
 }
 
+// setNextId moves NextId past every chirp in c, for data saved before the
+// counter was kept.
+func (c *ChirpData) setNextId() {
+	if next := getHighestChirpId(*c) + 1; next > c.NextId {
+		c.NextId = next
+	}
+}
+
 func getHighestChirpId(c ChirpData) int {
 	highest := 0
 	for key, _ := range c.Chirps {
@@ -244,39 +205,8 @@ func getHighestChirpId(c ChirpData) int {
 	return highest
 }
 
-func deleteChirp(w http.ResponseWriter, r *http.Request) {
-	header := r.Header.Get("authorization")
-	if header == "" {
-		out := "Request wasn't made with header 'Authorization: Bearer <my_auth_token>'"
-		w.Write([]byte(out))
-		w.WriteHeader(400)
-		return
-	}
-	bearerToken := strings.Replace(header, "Bearer ", "", 1)
-	secret := os.Getenv("JWT_SECRET")
-	claims := &jwt.RegisteredClaims{}
-	parsedToken, err := jwt.ParseWithClaims(bearerToken, claims, func(t *jwt.Token) (interface{}, error) {
-		return []byte(secret), nil
-	})
-	if err != nil {
-		fmt.Printf("Error parsing claims from received token: %s\n", err)
-		w.WriteHeader(401)
-		return
-	}
-	issuer, err := parsedToken.Claims.GetIssuer()
-	if err != nil {
-		fmt.Printf("There was an error reading issuer from parsed token claims: %s\n", err)
-	}
-	if issuer != "chirpy" {
-		fmt.Println("Parsed a JWT that we did not issue")
-		w.WriteHeader(401)
-		return
-	}
-	uid, err := parsedToken.Claims.GetSubject()
-	uidInt, err := strconv.Atoi(uid)
-	if err != nil {
-		fmt.Printf("Failed to convert user id string to int: %s\n", err)
-	}
+func (cfg *apiConfig) deleteChirp(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
 	idString := r.PathValue("chirpId")
 	id, convErr := strconv.Atoi(idString)
 	if convErr != nil {
@@ -284,20 +214,27 @@ func deleteChirp(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(500)
 		return
 	}
-	chirps := readChirps(dbFile)
-
-	chirp, ok := chirps.Chirps[id]
-	if !ok {
+	chirp, err := cfg.store.GetChirp(id)
+	if err == errNotFound {
 		w.WriteHeader(404)
 		return
 	}
+	if err != nil {
+		log.Printf("Error reading chirp: %s", err)
+		w.WriteHeader(500)
+		return
+	}
 
-	if chirp.AuthorId != uidInt {
+	if chirp.AuthorId != caller.UserId {
 		w.WriteHeader(403)
 		return
 	}
-	delete(chirps.Chirps, chirp.Id)
-	saveChirps(dbFile, chirps)
+	err = cfg.store.DeleteChirp(chirp.Id)
+	if err != nil {
+		log.Printf("Error deleting chirp: %s", err)
+		w.WriteHeader(500)
+		return
+	}
 	w.WriteHeader(204)
 	return
 }
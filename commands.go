@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+const usage = `usage: chirpy [command]
+
+With no command, chirpy starts the HTTP server.
+
+Commands:
+  import-json              copy the JSON store (snapshots and write-ahead log) into the sqlite database,
+                           leaving the JSON files untouched
+  migrate up               apply all pending schema migrations
+  migrate down <version>   revert schema migrations down to <version>
+  backup <file>            write a backup archive of the configured store to <file>
+  restore <file>           verify a backup archive and swap it into the configured store
+
+backup and restore open the store directly, so stop the server first when
+STORE_BACKEND=json, or use POST /admin/backup and POST /admin/restore.
+`
+
+func runCommand(args []string) error {
+	switch args[0] {
+	case "import-json":
+		// The JSON files are only read, so they stay as they were in case
+		// the move has to be undone.
+		src, err := readJSONStore(dbFile, userDbFile, refreshTokenDbFile, accessTokenDbFile, oauthClientDbFile, revocationDbFile, passwordResetDbFile, walFile)
+		if err != nil {
+			return err
+		}
+		store, err := newSQLiteStore(sqliteDbFile)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+		return importJSON(store, src)
+	case "migrate":
+		return runMigrate(args[1:])
+	case "backup":
+		return runBackup(args[1:])
+	case "restore":
+		return runRestore(args[1:])
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+		return nil
+	}
+	fmt.Print(usage)
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+func runMigrate(args []string) error {
+	if len(args) < 1 {
+		return errors.New("migrate needs a direction: up or down")
+	}
+	db, err := openSQLite(sqliteDbFile)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	switch args[0] {
+	case "up":
+		return migrateUp(db)
+	case "down":
+		if len(args) < 2 {
+			return errors.New("migrate down needs a target version")
+		}
+		target, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("bad target version %q: %w", args[1], err)
+		}
+		return migrateDown(db, target)
+	}
+	return fmt.Errorf("unknown migrate direction %q", args[0])
+}
+
+func runBackup(args []string) error {
+	if len(args) < 1 {
+		return errors.New("backup needs an output file")
+	}
+	store, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	snap, err := store.Snapshot()
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomicFunc(args[0], 0600, func(w io.Writer) error {
+		return writeBackup(w, snap)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Wrote backup of %d users, %d chirps and %d refresh tokens to %s\n",
+		len(snap.Users.Users), len(snap.Chirps.Chirps), len(snap.Tokens.Tokens), args[0])
+	return nil
+}
+
+func runRestore(args []string) error {
+	if len(args) < 1 {
+		return errors.New("restore needs a backup file")
+	}
+	file, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	snap, manifest, err := readBackup(file)
+	if err != nil {
+		return err
+	}
+	store, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if err := store.Restore(snap); err != nil {
+		return err
+	}
+	fmt.Printf("Restored backup from %s: %d users, %d chirps and %d refresh tokens\n",
+		manifest.CreatedAt.Format(time.RFC3339), manifest.Users, manifest.Chirps, manifest.Tokens)
+	return nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// These tests fire requests at the handlers from many goroutines at once.
+// Run them with go test -race.
+
+func TestConcurrentChirpCreateAndDelete(t *testing.T) {
+	cfg := newTestConfig(t)
+	handler := cfg.routes()
+	createTestUser(t, cfg, "author@example.com")
+	token := login(t, handler, "author@example.com").Token
+
+	const n = 20
+	create := func(ids chan<- int, i int) {
+		rec := doRequest(t, handler, "POST", "/api/chirps", token, map[string]string{"body": fmt.Sprintf("chirp %d", i)})
+		if rec.Code != 201 {
+			t.Errorf("creating chirp %d: got %d %q", i, rec.Code, rec.Body.String())
+			return
+		}
+		chirp := Chirp{}
+		decodeBody(t, rec, &chirp)
+		ids <- chirp.Id
+	}
+
+	first := make(chan int, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			create(first, i)
+		}(i)
+	}
+	wg.Wait()
+	close(first)
+	seen := map[int]bool{}
+	for id := range first {
+		if seen[id] {
+			t.Fatalf("chirp id %d handed out twice", id)
+		}
+		seen[id] = true
+	}
+	if len(seen) != n {
+		t.Fatalf("created %d chirps, want %d", len(seen), n)
+	}
+
+	// Every chirp is deleted twice at once while more are created. Exactly
+	// one of each pair of deletes may succeed.
+	second := make(chan int, n)
+	deleted := make(chan int, 2*n)
+	for id := range seen {
+		for j := 0; j < 2; j++ {
+			wg.Add(1)
+			go func(id int) {
+				defer wg.Done()
+				rec := doRequest(t, handler, "DELETE", fmt.Sprintf("/api/chirps/%d", id), token, nil)
+				switch rec.Code {
+				case 204:
+					deleted <- id
+				case 404:
+				default:
+					t.Errorf("deleting chirp %d: got %d %q", id, rec.Code, rec.Body.String())
+				}
+			}(id)
+		}
+	}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			create(second, n+i)
+		}(i)
+	}
+	wg.Wait()
+	close(second)
+	close(deleted)
+
+	deletes := map[int]int{}
+	for id := range deleted {
+		deletes[id]++
+	}
+	for id := range seen {
+		if deletes[id] != 1 {
+			t.Errorf("chirp %d deleted %d times, want 1", id, deletes[id])
+		}
+	}
+	created := map[int]bool{}
+	for id := range second {
+		if seen[id] {
+			t.Errorf("id %d of a deleted chirp was handed out again", id)
+		}
+		created[id] = true
+	}
+
+	rec := doRequest(t, handler, "GET", "/api/chirps", "", nil)
+	chirps := []Chirp{}
+	decodeBody(t, rec, &chirps)
+	if len(chirps) != n {
+		t.Fatalf("got %d chirps after deleting, want %d", len(chirps), n)
+	}
+	for _, chirp := range chirps {
+		if !created[chirp.Id] {
+			t.Errorf("chirp %d is left over", chirp.Id)
+		}
+	}
+}
+
+// upgrade sends the Polka webhook that gives a user Chirpy Red.
+func upgrade(t *testing.T, handler http.Handler, userId int) int {
+	t.Helper()
+	body := fmt.Sprintf(`{"event":"user.upgraded","data":{"user_id":%d}}`, userId)
+	req := httptest.NewRequest("POST", "/api/polka/webhooks", strings.NewReader(body))
+	req.Header.Set("Authorization", "ApiKey test-polka-key")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+// TestConcurrentUserUpdates changes different fields of the same user at
+// the same time. None of the changes may be lost.
+func TestConcurrentUserUpdates(t *testing.T) {
+	t.Setenv("POLKA_KEY", "test-polka-key")
+	cfg := newTestConfig(t)
+	handler := cfg.routes()
+
+	for round := 0; round < 10; round++ {
+		profile := createTestUser(t, cfg, fmt.Sprintf("profile%d@example.com", round))
+		account := createTestUser(t, cfg, fmt.Sprintf("account%d@example.com", round))
+		profileToken := login(t, handler, profile.Email).Token
+		accountToken := login(t, handler, account.Email).Token
+		newEmail := fmt.Sprintf("moved%d@example.com", round)
+		newPassword := fmt.Sprintf("a-brand-new-password-%d", round)
+
+		var wg sync.WaitGroup
+		run := func(name string, want int, send func() (int, string)) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if code, body := send(); code != want {
+					t.Errorf("round %d, %s: got %d %q, want %d", round, name, code, body, want)
+				}
+			}()
+		}
+		run("upgrade profile", 204, func() (int, string) {
+			return upgrade(t, handler, profile.Id), ""
+		})
+		run("change email", 200, func() (int, string) {
+			rec := doRequest(t, handler, "PATCH", "/api/users/me", profileToken, map[string]string{
+				"email":            newEmail,
+				"current_password": testPassword,
+			})
+			return rec.Code, rec.Body.String()
+		})
+		run("enroll 2fa", 200, func() (int, string) {
+			rec := doRequest(t, handler, "POST", "/api/users/me/2fa", profileToken, map[string]string{
+				"current_password": testPassword,
+			})
+			return rec.Code, rec.Body.String()
+		})
+		run("upgrade account", 204, func() (int, string) {
+			return upgrade(t, handler, account.Id), ""
+		})
+		run("change password", 204, func() (int, string) {
+			rec := doRequest(t, handler, "POST", "/api/users/me/password", accountToken, map[string]string{
+				"current_password": testPassword,
+				"new_password":     newPassword,
+			})
+			return rec.Code, rec.Body.String()
+		})
+		wg.Wait()
+
+		got, err := cfg.store.GetUser(profile.Id)
+		if err != nil {
+			t.Fatalf("reading user: %s", err)
+		}
+		if !got.IsChirpyRed {
+			t.Errorf("round %d: upgrade was lost", round)
+		}
+		if got.PendingEmail != newEmail {
+			t.Errorf("round %d: pending email is %q, want %q", round, got.PendingEmail, newEmail)
+		}
+		if got.TOTPPendingSecret == "" {
+			t.Errorf("round %d: two-factor enrollment was lost", round)
+		}
+
+		got, err = cfg.store.GetUser(account.Id)
+		if err != nil {
+			t.Fatalf("reading user: %s", err)
+		}
+		if !got.IsChirpyRed {
+			t.Errorf("round %d: upgrade was lost", round)
+		}
+		if err := cfg.passwords.Verify(got.PasswordHash, newPassword); err != nil {
+			t.Errorf("round %d: password change was lost: %s", round, err)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testPassword = "correct-horse-battery-staple"
+
+// testMailer keeps the mail it is asked to send.
+type testMailer struct {
+	mu   sync.Mutex
+	sent []mailMessage
+}
+
+func (m *testMailer) Send(msg mailMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+func (m *testMailer) last() (mailMessage, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.sent) == 0 {
+		return mailMessage{}, false
+	}
+	return m.sent[len(m.sent)-1], true
+}
+
+// newTestConfig sets up an apiConfig the way main does, with an in-memory
+// store, a fresh keyring and audit log in a temporary directory, and mail
+// kept by a testMailer.
+func newTestConfig(t *testing.T) *apiConfig {
+	t.Helper()
+	dir := t.TempDir()
+
+	keys, err := loadKeyring(filepath.Join(dir, keyringFile), algEdDSA, 1)
+	if err != nil {
+		t.Fatalf("loading keyring: %s", err)
+	}
+	audit, err := openAuditLog(filepath.Join(dir, auditLogFile))
+	if err != nil {
+		t.Fatalf("opening audit log: %s", err)
+	}
+	t.Cleanup(func() { audit.Close() })
+	passwords, err := newPasswordHasher(hasherBcrypt, bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("setting up password hashing: %s", err)
+	}
+
+	cfg := &apiConfig{
+		keys:               keys,
+		issuer:             "http://chirpy.test",
+		jwtLeeway:          30 * time.Second,
+		accessTokenTTL:     time.Hour,
+		refreshedAccessTTL: time.Hour,
+		refreshTokenTTL:    24 * time.Hour,
+		adminKey:           "test-admin-key",
+		store:              newMemoryStore(),
+		throttle:           newLoginThrottle(),
+		passwords:          passwords,
+		mailer:             &testMailer{},
+		verifyResends:      newRateLimiter(verifyResendLimit, verifyResendWindow),
+		resetRequests:      newRateLimiter(resetRequestEmailLimit, resetRequestWindow),
+		resetRequestIPs:    newRateLimiter(resetRequestIPLimit, resetRequestWindow),
+		audit:              audit,
+	}
+	cfg.passwordPolicy.minLength = 12
+	return cfg
+}
+
+// createTestUser saves a user with a verified email and testPassword.
+func createTestUser(t *testing.T, cfg *apiConfig, email string) User {
+	t.Helper()
+	hash, err := cfg.passwords.Hash(testPassword)
+	if err != nil {
+		t.Fatalf("hashing password: %s", err)
+	}
+	user, err := cfg.store.CreateUser(User{Email: email, PasswordHash: hash, EmailVerified: true})
+	if err != nil {
+		t.Fatalf("creating user: %s", err)
+	}
+	return user
+}
+
+// doRequest sends a request straight to handler. body is sent as JSON
+// unless it is nil, and token as a Bearer token unless it is empty.
+func doRequest(t *testing.T, handler http.Handler, method, path, token string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatalf("encoding request body: %s", err)
+		}
+	}
+	req := httptest.NewRequest(method, path, &buf)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// decodeBody unmarshals a JSON response into v.
+func decodeBody(t *testing.T, rec *httptest.ResponseRecorder, v any) {
+	t.Helper()
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("decoding response %q: %s", rec.Body.String(), err)
+	}
+}
+
+type loginResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// login logs in with testPassword and returns the new session's tokens.
+func login(t *testing.T, handler http.Handler, email string) loginResponse {
+	t.Helper()
+	rec := doRequest(t, handler, "POST", "/api/login", "", map[string]string{
+		"email":    email,
+		"password": testPassword,
+	})
+	if rec.Code != 200 {
+		t.Fatalf("login as %s: got %d %q", email, rec.Code, rec.Body.String())
+	}
+	out := loginResponse{}
+	decodeBody(t, rec, &out)
+	return out
+}
+
+// auditEvents reads back what has been written to the audit log.
+func auditEvents(t *testing.T, cfg *apiConfig) []auditEvent {
+	t.Helper()
+	file, err := os.Open(cfg.audit.file.Name())
+	if err != nil {
+		t.Fatalf("opening audit log: %s", err)
+	}
+	defer file.Close()
+	events := []auditEvent{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		event := auditEvent{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("decoding audit event %q: %s", scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// hasAuditEvent reports whether an event with the given name was recorded
+// for userId.
+func hasAuditEvent(t *testing.T, cfg *apiConfig, name string, userId int) bool {
+	t.Helper()
+	for _, event := range auditEvents(t, cfg) {
+		if event.Event == name && event.UserId == userId {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// importJSON copies the contents of the JSON store, including anything still
+// sitting in its write-ahead log, into the SQLite store. It refuses to run
+// against a database that already has users.
+func importJSON(s *sqliteStore, src Store) error {
+	existing := 0
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&existing); err != nil {
+		return err
+	}
+	if existing > 0 {
+		return errors.New("sqlite database already has users, refusing to import")
+	}
+
+	snap, err := src.Snapshot()
+	if err != nil {
+		return err
+	}
+	if err := s.Restore(snap); err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d users, %d chirps and %d refresh tokens\n",
+		len(snap.Users.Users), len(snap.Chirps.Chirps), len(snap.Tokens.Tokens))
+	return nil
+}
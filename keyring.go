@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	algEdDSA = "EdDSA"
+	algRS256 = "RS256"
+)
+
+var errUnknownKey = errors.New("token was signed by an unknown key")
+
+// signingKey is one entry in the keyring. Private holds the PKCS#8 DER
+// encoding of the key so it survives restarts.
+type signingKey struct {
+	Id        string    `json:"kid"`
+	Alg       string    `json:"alg"`
+	Private   []byte    `json:"private"`
+	CreatedAt time.Time `json:"created_at"`
+
+	signer crypto.Signer
+}
+
+type keyringData struct {
+	Active string       `json:"active"`
+	Keys   []signingKey `json:"keys"`
+}
+
+// keyring holds the key new access tokens are signed with plus a few
+// retired keys that are only used to verify tokens signed before the last
+// rotation. It is persisted to file so a restart does not log anyone out.
+type keyring struct {
+	mu     sync.RWMutex
+	file   string
+	alg    string
+	keep   int
+	active string
+	keys   []signingKey
+}
+
+// loadKeyring reads the keyring from file, creating it with a fresh key of
+// the given alg if it does not exist. keep is how many retired keys stay
+// around for verification after a rotation.
+func loadKeyring(file, alg string, keep int) (*keyring, error) {
+	if alg != algEdDSA && alg != algRS256 {
+		return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+	ring := &keyring{file: file, alg: alg, keep: keep}
+
+	data := keyringData{}
+	err := readJSONFile(file, &data)
+	if errors.Is(err, os.ErrNotExist) {
+		return ring, ring.rotate()
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range data.Keys {
+		parsed, err := x509.ParsePKCS8PrivateKey(key.Private)
+		if err != nil {
+			return nil, fmt.Errorf("key %s in %s is corrupt: %w", key.Id, file, err)
+		}
+		signer, ok := parsed.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("key %s in %s cannot sign", key.Id, file)
+		}
+		key.signer = signer
+		ring.keys = append(ring.keys, key)
+	}
+	ring.active = data.Active
+	if _, err := ring.key(ring.active); err != nil {
+		return ring, ring.rotate()
+	}
+	return ring, nil
+}
+
+func generateSigningKey(alg string) (signingKey, error) {
+	var signer crypto.Signer
+	var err error
+	switch alg {
+	case algEdDSA:
+		_, signer, err = ed25519.GenerateKey(rand.Reader)
+	case algRS256:
+		signer, err = rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		err = fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+	if err != nil {
+		return signingKey{}, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(signer)
+	if err != nil {
+		return signingKey{}, err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return signingKey{}, err
+	}
+	return signingKey{
+		Id:        hex.EncodeToString(id),
+		Alg:       alg,
+		Private:   der,
+		CreatedAt: time.Now().UTC(),
+		signer:    signer,
+	}, nil
+}
+
+// rotate makes a new active key, keeps the newest retired keys for
+// verification and saves the result.
+func (k *keyring) rotate() error {
+	key, err := generateSigningKey(k.alg)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	keys := append([]signingKey{key}, k.keys...)
+	if len(keys) > k.keep+1 {
+		keys = keys[:k.keep+1]
+	}
+	data, err := json.Marshal(keyringData{Active: key.Id, Keys: keys})
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(k.file, data, 0600); err != nil {
+		return err
+	}
+	k.keys = keys
+	k.active = key.Id
+	fmt.Printf("Rotated signing keys, new active key is %s\n", key.Id)
+	return nil
+}
+
+// rotateEvery rotates the active key once it is older than interval, or
+// straight away if JWT_SIGNING_ALG has changed, checking in the background
+// for the life of the process.
+func (k *keyring) rotateEvery(interval time.Duration) {
+	check := func() {
+		active, err := k.activeKey()
+		if err == nil && active.Alg == k.alg && time.Since(active.CreatedAt) < interval {
+			return
+		}
+		if err := k.rotate(); err != nil {
+			fmt.Printf("Failed to rotate signing keys: %s\n", err)
+		}
+	}
+	check()
+	ticker := time.NewTicker(min(interval, time.Hour))
+	go func() {
+		for range ticker.C {
+			check()
+		}
+	}()
+}
+
+func (k *keyring) key(kid string) (signingKey, error) {
+	for _, key := range k.keys {
+		if key.Id == kid {
+			return key, nil
+		}
+	}
+	return signingKey{}, errUnknownKey
+}
+
+func (k *keyring) activeKey() (signingKey, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.key(k.active)
+}
+
+func signingMethod(alg string) jwt.SigningMethod {
+	if alg == algRS256 {
+		return jwt.SigningMethodRS256
+	}
+	return jwt.SigningMethodEdDSA
+}
+
+// sign signs claims with the active key and stamps its kid in the header.
+func (k *keyring) sign(claims jwt.Claims) (string, error) {
+	key, err := k.activeKey()
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(signingMethod(key.Alg), claims)
+	token.Header["kid"] = key.Id
+	return token.SignedString(key.signer)
+}
+
+// keyfunc finds the public key for a token by its kid, refusing tokens
+// whose alg does not match the key they claim to be signed with.
+func (k *keyring) keyfunc(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	k.mu.RLock()
+	key, err := k.key(kid)
+	k.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	if t.Method.Alg() != key.Alg {
+		return nil, fmt.Errorf("token alg %s does not match key %s", t.Method.Alg(), key.Id)
+	}
+	return key.signer.Public(), nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+// jwks returns the public half of every key in the ring.
+func (k *keyring) jwks() jwkSet {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	set := jwkSet{Keys: []jwk{}}
+	b64 := base64.RawURLEncoding
+	for _, key := range k.keys {
+		out := jwk{Kid: key.Id, Alg: key.Alg, Use: "sig"}
+		switch pub := key.signer.Public().(type) {
+		case ed25519.PublicKey:
+			out.Kty = "OKP"
+			out.Crv = "Ed25519"
+			out.X = b64.EncodeToString(pub)
+		case *rsa.PublicKey:
+			out.Kty = "RSA"
+			out.N = b64.EncodeToString(pub.N.Bytes())
+			out.E = b64.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		default:
+			continue
+		}
+		set.Keys = append(set.Keys, out)
+	}
+	return set
+}
+
+func (cfg *apiConfig) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := json.Marshal(cfg.keys.jwks())
+	if err != nil {
+		fmt.Printf("Error marshalling JWKS: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.WriteHeader(200)
+	w.Write(data)
+}
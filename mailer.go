@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	mailerSMTP   = "smtp"
+	mailerOutbox = "outbox"
+)
+
+// mailMessage is a plain text email to a single recipient.
+type mailMessage struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers mail to users.
+type Mailer interface {
+	Send(msg mailMessage) error
+}
+
+// newMailer returns the mailer picked by MAILER.
+func newMailer(kind string) (Mailer, error) {
+	switch kind {
+	case mailerSMTP:
+		addr := os.Getenv("SMTP_ADDR")
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("SMTP_ADDR %q must be host:port: %w", addr, err)
+		}
+		mailer := &smtpMailer{addr: addr, from: getMailFrom()}
+		if user := os.Getenv("SMTP_USERNAME"); user != "" {
+			mailer.auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+		}
+		return mailer, nil
+	case mailerOutbox:
+		return &outboxMailer{dir: getMailOutboxDir(), from: getMailFrom()}, nil
+	default:
+		return nil, fmt.Errorf("unsupported mailer %q", kind)
+	}
+}
+
+// formatMail renders msg as an RFC 5322 message. Header values come from
+// user input, so line breaks in them are refused rather than letting a
+// crafted address add headers of its own.
+func formatMail(from string, msg mailMessage) ([]byte, error) {
+	for _, v := range []string{from, msg.To, msg.Subject} {
+		if strings.ContainsAny(v, "\r\n") {
+			return nil, errors.New("mail header contains a line break")
+		}
+	}
+	buf := bytes.Buffer{}
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().UTC().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	buf.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return buf.Bytes(), nil
+}
+
+// smtpMailer sends through an SMTP relay, upgrading to TLS when the relay
+// offers STARTTLS.
+type smtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func (m *smtpMailer) Send(msg mailMessage) error {
+	data, err := formatMail(m.from, msg)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{msg.To}, data)
+}
+
+// outboxMailer stands in for a real mail server during development and
+// tests. Each message is written to its own .eml file in dir and noted in
+// the server log instead of being sent.
+type outboxMailer struct {
+	dir  string
+	from string
+}
+
+func (m *outboxMailer) Send(msg mailMessage) error {
+	data, err := formatMail(m.from, msg)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.dir, 0700); err != nil {
+		return err
+	}
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000Z"), hex.EncodeToString(id))
+	path := filepath.Join(m.dir, name)
+	if err := writeFileAtomic(path, data, 0600); err != nil {
+		return err
+	}
+	fmt.Printf("Mail to %s (%q) written to %s\n", msg.To, msg.Subject, path)
+	return nil
+}
@@ -5,15 +5,24 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"os"
 	"strconv"
 
 	"github.com/joho/godotenv"
 )
 
 const (
-	dbFile             string = "database.json"
-	userDbFile         string = "users.json"
-	refreshTokenDbFile string = "refreshTokens.json"
+	dbFile              string = "database.json"
+	userDbFile          string = "users.json"
+	refreshTokenDbFile  string = "refreshTokens.json"
+	accessTokenDbFile   string = "accessTokens.json"
+	oauthClientDbFile   string = "oauthClients.json"
+	revocationDbFile    string = "revocations.json"
+	passwordResetDbFile string = "passwordResets.json"
+	walFile             string = "chirpy.wal"
+	sqliteDbFile        string = "chirpy.db"
+	keyringFile         string = "keys.json"
+	auditLogFile        string = "audit.log"
 )
 
 func main() {
@@ -22,20 +31,97 @@ func main() {
 		log.Fatal("Error loading .env file")
 	}
 
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	config := new(apiConfig)
 
-	mux := http.NewServeMux()
 	server := new(http.Server)
-	server.Handler = mux
 	port := getPort()
 	server.Addr = "localhost:" + port
 
-	bootStrapChirpDb()
-	bootStrapUserDb()
-	bootStrapRefreshTokenDb()
+	keys, err := loadKeyring(keyringFile, getSigningAlg(), getVerifyKeyCount())
+	if err != nil {
+		log.Fatalf("Could not load signing keys: %s", err)
+	}
+	keys.rotateEvery(getKeyRotationInterval())
+	config.keys = keys
+	config.issuer = getBaseURL()
+	config.jwtLeeway = getJWTLeeway()
+	config.accessTokenTTL = getAccessTokenTTL()
+	config.refreshedAccessTTL = getRefreshedAccessTokenTTL()
+	config.refreshTokenTTL = getRefreshTokenTTL()
+	config.adminKey = os.Getenv("ADMIN_KEY")
+	store, err := openStore()
+	if err != nil {
+		log.Fatalf("Could not open %s store: %s", getStoreBackend(), err)
+	}
+	defer store.Close()
+	if js, ok := store.(*jsonStore); ok {
+		js.compactEvery(getSnapshotInterval())
+	}
+	config.store = store
+	config.pruneRevocationsEvery(revocationPruneInterval)
+	config.pruneRefreshTokensEvery(refreshTokenPruneInterval)
+	config.prunePasswordResetsEvery(passwordResetPruneInterval)
+	audit, err := openAuditLog(auditLogFile)
+	if err != nil {
+		log.Fatalf("Could not open audit log: %s", err)
+	}
+	defer audit.Close()
+	config.audit = audit
+	config.throttle = newLoginThrottle()
+	passwords, err := newPasswordHasher(getPasswordHasher(), getBcryptCost())
+	if err != nil {
+		log.Fatalf("Could not set up password hashing: %s", err)
+	}
+	config.passwords = passwords
+	config.passwordPolicy.minLength = getPasswordMinLength()
+	mailer, err := newMailer(getMailer())
+	if err != nil {
+		log.Fatalf("Could not set up mail: %s", err)
+	}
+	config.mailer = mailer
+	config.verifyResends = newRateLimiter(verifyResendLimit, verifyResendWindow)
+	config.resetRequests = newRateLimiter(resetRequestEmailLimit, resetRequestWindow)
+	config.resetRequestIPs = newRateLimiter(resetRequestIPLimit, resetRequestWindow)
+	if issuer := getOIDCIssuer(); issuer != "" {
+		provider, err := newOIDCProvider(issuer, getOIDCClientId(), getOIDCClientSecret(), getOIDCRedirectURL(), getOIDCScopes())
+		if err != nil {
+			log.Fatalf("Could not set up OIDC login: %s", err)
+		}
+		provider.autoProvision = getOIDCAutoProvision()
+		provider.appURL = getOIDCAppURL()
+		config.oidc = provider
+	}
+	if file := getBreachedPasswordsFile(); file != "" {
+		breached, err := loadBreachedPasswords(file)
+		if err != nil {
+			log.Fatalf("Could not load breached password list: %s", err)
+		}
+		fmt.Printf("Loaded %d breached password hashes from %s\n", breached.count, file)
+		config.passwordPolicy.breached = breached
+	}
+
+	server.Handler = config.routes()
+	fmt.Printf("Starting server on %s\n", server.Addr)
+	err = server.ListenAndServe()
+	if err != nil {
+		fmt.Printf("There was an error starting the server: %s", err.Error())
+	}
+}
 
-	mux.Handle("/app/*", config.middlewareMetricsIncr(http.StripPrefix("/app", http.FileServer(http.Dir(".")))))
+// routes registers every endpoint on a new mux.
+func (cfg *apiConfig) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/app/", cfg.middlewareMetricsIncr(http.StripPrefix("/app", staticFileServer(getStaticDir(), getStaticAllowlist()))))
 	mux.HandleFunc("GET /api/healthz", healthEndpoint)
+	mux.HandleFunc("GET /.well-known/jwks.json", cfg.jwksHandler)
+	mux.HandleFunc("GET /.well-known/oauth-authorization-server", cfg.oauthMetadata)
 	mux.HandleFunc("GET /admin/metrics", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		w.WriteHeader(http.StatusOK)
@@ -49,33 +135,58 @@ func main() {
 					</main>
 				</body>
 			</html>
-			`, config.fileserverHits)
+			`, cfg.fileserverHits.Load())
 		io.WriteString(w, page)
 
 	})
 	mux.HandleFunc("/api/reset", func(w http.ResponseWriter, r *http.Request) {
-		config.middlewareMetricsReset()
+		cfg.middlewareMetricsReset()
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(fmt.Sprintf("Hits: %s", strconv.Itoa(config.fileserverHits))))
+		w.Write([]byte(fmt.Sprintf("Hits: %s", strconv.Itoa(int(cfg.fileserverHits.Load())))))
 	})
-	mux.HandleFunc("POST /api/chirps", newChirp)
-	mux.HandleFunc("GET /api/chirps", getChirps)
-	mux.HandleFunc("GET /api/chirps/{chirpId}", getChirpId)
-	mux.HandleFunc("DELETE /api/chirps/{chirpId}", deleteChirp)
-
-	mux.HandleFunc("POST /api/users", newUser)
-	mux.HandleFunc("PUT /api/users", updateUser)
-	mux.HandleFunc("POST /api/login", authenticateUser)
+	mux.HandleFunc("POST /admin/backup", cfg.middlewareAdminOnly(cfg.backupHandler))
+	mux.HandleFunc("POST /admin/restore", cfg.middlewareAdminOnly(cfg.restoreHandler))
+	mux.HandleFunc("POST /admin/users/{userId}/unlock", cfg.middlewareAdminOnly(cfg.unlockUser))
+	mux.HandleFunc("POST /admin/users/{userId}/2fa/reset", cfg.middlewareAdminOnly(cfg.resetTwoFactor))
+	mux.HandleFunc("POST /api/chirps", cfg.requireScope(scopeChirpsWrite, cfg.requireVerifiedEmail(cfg.newChirp)))
+	mux.HandleFunc("GET /api/chirps", cfg.getChirps)
+	mux.HandleFunc("GET /api/chirps/{chirpId}", cfg.getChirpId)
+	mux.HandleFunc("DELETE /api/chirps/{chirpId}", cfg.requireScope(scopeChirpsDelete, cfg.deleteChirp))
 
-	mux.HandleFunc("POST /api/refresh", refreshUserAuth)
-	mux.HandleFunc("POST /api/revoke", revokeUserAuth)
+	mux.HandleFunc("POST /api/users", cfg.newUser)
+	mux.HandleFunc("GET /api/users/me", cfg.requireScope(scopeUsersRead, cfg.getMe))
+	mux.HandleFunc("PATCH /api/users/me", cfg.requireAuth(cfg.updateMe))
+	mux.HandleFunc("POST /api/users/me/password", cfg.requireAuth(cfg.changePassword))
+	mux.HandleFunc("GET /api/users/verify-email", cfg.verifyEmail)
+	mux.HandleFunc("POST /api/users/me/verification", cfg.requireAuth(cfg.resendVerification))
+	mux.HandleFunc("POST /api/users/me/2fa", cfg.requireAuth(cfg.enrollTwoFactor))
+	mux.HandleFunc("POST /api/users/me/2fa/confirm", cfg.requireAuth(cfg.confirmTwoFactor))
+	mux.HandleFunc("DELETE /api/users/me/2fa", cfg.requireAuth(cfg.disableTwoFactor))
+	mux.HandleFunc("POST /api/password-reset/request", cfg.requestPasswordReset)
+	mux.HandleFunc("POST /api/password-reset/confirm", cfg.confirmPasswordReset)
+	mux.HandleFunc("POST /api/login", cfg.authenticateUser)
+	mux.HandleFunc("POST /api/login/2fa", cfg.completeTwoFactorLogin)
+	mux.HandleFunc("GET /api/login/oidc", cfg.startOIDCLogin)
+	mux.HandleFunc("GET /api/login/oidc/callback", cfg.finishOIDCLogin)
+	mux.HandleFunc("POST /api/login/oidc/exchange", cfg.exchangeOIDCCode)
 
-	mux.HandleFunc("POST /api/polka/webhooks", userUpgrade)
+	mux.HandleFunc("POST /api/refresh", cfg.refreshUserAuth)
+	mux.HandleFunc("POST /api/revoke", cfg.revokeUserAuth)
+	mux.HandleFunc("POST /api/logout", cfg.requireAuth(cfg.logout))
+	mux.HandleFunc("GET /api/sessions", cfg.requireAuth(cfg.listSessions))
+	mux.HandleFunc("DELETE /api/sessions/{id}", cfg.requireAuth(cfg.revokeSession))
+	mux.HandleFunc("POST /api/sessions/revoke-all", cfg.requireAuth(cfg.revokeAllSessions))
+	mux.HandleFunc("POST /api/tokens", cfg.requireAuth(cfg.createPersonalAccessToken))
+	mux.HandleFunc("GET /api/tokens", cfg.requireAuth(cfg.listPersonalAccessTokens))
+	mux.HandleFunc("DELETE /api/tokens/{id}", cfg.requireAuth(cfg.revokePersonalAccessToken))
+	mux.HandleFunc("POST /api/oauth/clients", cfg.requireAuth(cfg.registerOAuthClient))
+	mux.HandleFunc("GET /api/oauth/clients", cfg.requireAuth(cfg.listOAuthClients))
+	mux.HandleFunc("DELETE /api/oauth/clients/{id}", cfg.requireAuth(cfg.deleteOAuthClient))
+	mux.HandleFunc("GET /oauth/authorize", cfg.authorizeEntry)
+	mux.HandleFunc("POST /oauth/authorize", cfg.requireAuth(cfg.authorizeDecision))
+	mux.HandleFunc("POST /oauth/token", cfg.oauthToken)
 
-	fmt.Printf("Starting server on %s\n", server.Addr)
-	err = server.ListenAndServe()
-	if err != nil {
-		fmt.Printf("There was an error starting the server: %s", err.Error())
-	}
+	mux.HandleFunc("POST /api/polka/webhooks", cfg.userUpgrade)
+	return mux
 }
@@ -1,21 +1,74 @@
 package main
 
 import (
+	"crypto/subtle"
 	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 type apiConfig struct {
-	fileserverHits int
-	jwtSecret      string
+	fileserverHits     atomic.Int64
+	keys               *keyring
+	issuer             string
+	jwtLeeway          time.Duration
+	accessTokenTTL     time.Duration
+	refreshedAccessTTL time.Duration
+	refreshTokenTTL    time.Duration
+	adminKey           string
+	store              Store
+	throttle           *loginThrottle
+	passwords          PasswordHasher
+	passwordPolicy     passwordPolicy
+	mailer             Mailer
+	verifyResends      *rateLimiter
+	resetRequests      *rateLimiter
+	resetRequestIPs    *rateLimiter
+	oidc               *oidcProvider
+	audit              *auditLog
 }
 
 func (cfg *apiConfig) middlewareMetricsIncr(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cfg.fileserverHits++
+		cfg.fileserverHits.Add(1)
 		next.ServeHTTP(w, r)
 	})
 }
 
 func (cfg *apiConfig) middlewareMetricsReset() {
-	cfg.fileserverHits = 0
+	cfg.fileserverHits.Store(0)
+}
+
+// middlewareAdminOnly only lets through requests carrying
+// "Authorization: ApiKey <ADMIN_KEY>". With no ADMIN_KEY configured every
+// request is refused.
+func (cfg *apiConfig) middlewareAdminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		apiKey, ok := strings.CutPrefix(r.Header.Get("authorization"), "ApiKey ")
+		if cfg.adminKey == "" || !ok || subtle.ConstantTimeCompare([]byte(apiKey), []byte(cfg.adminKey)) != 1 {
+			w.WriteHeader(401)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requireVerifiedEmail keeps accounts that have not confirmed their email
+// address away from next. It must run inside requireAuth.
+func (cfg *apiConfig) requireVerifiedEmail(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, _ := principalFromContext(r.Context())
+		user, err := cfg.store.GetUser(caller.UserId)
+		if err != nil {
+			writeUnauthorized(w, "user no longer exists")
+			return
+		}
+		if !user.EmailVerified {
+			w.WriteHeader(403)
+			w.Write([]byte("Verify your email address to do this\n"))
+			return
+		}
+		next(w, r)
+	}
 }
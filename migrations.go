@@ -0,0 +1,340 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// migration is one schema change. upFunc, if set, runs after up in the
+// same transaction for changes that cannot be written in SQL.
+type migration struct {
+	version int
+	name    string
+	up      string
+	upFunc  func(tx *sql.Tx) error
+	down    string
+}
+
+// migrations must stay in ascending version order. Never edit one that has
+// shipped; add a new version instead.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "create_users",
+		up: `CREATE TABLE users (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			email TEXT NOT NULL UNIQUE COLLATE NOCASE,
+			password_hash BLOB NOT NULL,
+			is_chirpy_red INTEGER NOT NULL DEFAULT 0
+		)`,
+		down: `DROP TABLE users`,
+	},
+	{
+		version: 2,
+		name:    "create_chirps",
+		up: `CREATE TABLE chirps (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			body TEXT NOT NULL,
+			author_id INTEGER NOT NULL REFERENCES users(id)
+		);
+		CREATE INDEX chirps_author_id ON chirps(author_id)`,
+		down: `DROP TABLE chirps`,
+	},
+	{
+		version: 3,
+		name:    "create_refresh_tokens",
+		up: `CREATE TABLE refresh_tokens (
+			token TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id),
+			expires_at INTEGER NOT NULL
+		);
+		CREATE INDEX refresh_tokens_user_id ON refresh_tokens(user_id)`,
+		down: `DROP TABLE refresh_tokens`,
+	},
+	{
+		version: 4,
+		name:    "refresh_token_sessions",
+		up: `ALTER TABLE refresh_tokens ADD COLUMN id TEXT NOT NULL DEFAULT '';
+		UPDATE refresh_tokens SET id = CAST(user_id AS TEXT);
+		CREATE UNIQUE INDEX refresh_tokens_id ON refresh_tokens(id);
+		ALTER TABLE refresh_tokens ADD COLUMN device TEXT NOT NULL DEFAULT '';
+		ALTER TABLE refresh_tokens ADD COLUMN user_agent TEXT NOT NULL DEFAULT '';
+		ALTER TABLE refresh_tokens ADD COLUMN ip TEXT NOT NULL DEFAULT '';
+		ALTER TABLE refresh_tokens ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE refresh_tokens ADD COLUMN last_used_at INTEGER NOT NULL DEFAULT 0`,
+		down: `DROP INDEX refresh_tokens_id;
+		ALTER TABLE refresh_tokens DROP COLUMN last_used_at;
+		ALTER TABLE refresh_tokens DROP COLUMN created_at;
+		ALTER TABLE refresh_tokens DROP COLUMN ip;
+		ALTER TABLE refresh_tokens DROP COLUMN user_agent;
+		ALTER TABLE refresh_tokens DROP COLUMN device;
+		ALTER TABLE refresh_tokens DROP COLUMN id`,
+	},
+	{
+		version: 5,
+		name:    "create_retired_refresh_tokens",
+		up: `CREATE TABLE retired_refresh_tokens (
+			token TEXT PRIMARY KEY,
+			session_id TEXT NOT NULL
+		);
+		CREATE INDEX retired_refresh_tokens_session_id ON retired_refresh_tokens(session_id)`,
+		down: `DROP TABLE retired_refresh_tokens`,
+	},
+	{
+		// Hashes cannot be turned back into tokens, so reverting this one
+		// logs everybody out.
+		version: 6,
+		name:    "hash_refresh_tokens",
+		upFunc:  hashStoredRefreshTokens,
+		down: `DELETE FROM retired_refresh_tokens;
+		DELETE FROM refresh_tokens`,
+	},
+	{
+		version: 7,
+		name:    "create_revoked_access_tokens",
+		up: `CREATE TABLE revoked_access_tokens (
+			jti TEXT PRIMARY KEY,
+			expires_at INTEGER NOT NULL
+		);
+		CREATE INDEX revoked_access_tokens_expires_at ON revoked_access_tokens(expires_at)`,
+		down: `DROP TABLE revoked_access_tokens`,
+	},
+	{
+		version: 8,
+		name:    "add_users_pending_email",
+		up:      `ALTER TABLE users ADD COLUMN pending_email TEXT NOT NULL DEFAULT ''`,
+		down:    `ALTER TABLE users DROP COLUMN pending_email`,
+	},
+	{
+		version: 9,
+		name:    "add_users_email_verified",
+		up:      `ALTER TABLE users ADD COLUMN email_verified INTEGER NOT NULL DEFAULT 0`,
+		down:    `ALTER TABLE users DROP COLUMN email_verified`,
+	},
+	{
+		version: 10,
+		name:    "create_password_resets",
+		up: `CREATE TABLE password_resets (
+			token TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id),
+			created_at INTEGER NOT NULL,
+			expires_at INTEGER NOT NULL
+		);
+		CREATE INDEX password_resets_user_id ON password_resets(user_id);
+		CREATE INDEX password_resets_expires_at ON password_resets(expires_at)`,
+		down: `DROP TABLE password_resets`,
+	},
+	{
+		version: 11,
+		name:    "add_users_totp",
+		up: `ALTER TABLE users ADD COLUMN totp_secret TEXT NOT NULL DEFAULT '';
+		ALTER TABLE users ADD COLUMN totp_pending_secret TEXT NOT NULL DEFAULT '';
+		ALTER TABLE users ADD COLUMN totp_last_step INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE users ADD COLUMN recovery_codes TEXT NOT NULL DEFAULT ''`,
+		down: `ALTER TABLE users DROP COLUMN recovery_codes;
+		ALTER TABLE users DROP COLUMN totp_last_step;
+		ALTER TABLE users DROP COLUMN totp_pending_secret;
+		ALTER TABLE users DROP COLUMN totp_secret`,
+	},
+	{
+		version: 12,
+		name:    "create_personal_access_tokens",
+		up: `CREATE TABLE personal_access_tokens (
+			id TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id),
+			name TEXT NOT NULL,
+			token TEXT NOT NULL UNIQUE,
+			scopes TEXT NOT NULL,
+			created_at INTEGER NOT NULL,
+			expires_at INTEGER NOT NULL
+		);
+		CREATE INDEX personal_access_tokens_user_id ON personal_access_tokens(user_id)`,
+		down: `DROP TABLE personal_access_tokens`,
+	},
+	{
+		version: 13,
+		name:    "create_oauth_clients",
+		up: `CREATE TABLE oauth_clients (
+			id TEXT PRIMARY KEY,
+			owner_id INTEGER NOT NULL REFERENCES users(id),
+			name TEXT NOT NULL,
+			redirect_uris TEXT NOT NULL,
+			secret TEXT NOT NULL DEFAULT '',
+			created_at INTEGER NOT NULL
+		);
+		CREATE INDEX oauth_clients_owner_id ON oauth_clients(owner_id)`,
+		down: `DROP TABLE oauth_clients`,
+	},
+	{
+		version: 14,
+		name:    "add_refresh_tokens_client",
+		up: `ALTER TABLE refresh_tokens ADD COLUMN client_id TEXT NOT NULL DEFAULT '';
+		ALTER TABLE refresh_tokens ADD COLUMN scopes TEXT NOT NULL DEFAULT '';
+		CREATE INDEX refresh_tokens_client_id ON refresh_tokens(client_id)`,
+		down: `DROP INDEX refresh_tokens_client_id;
+		ALTER TABLE refresh_tokens DROP COLUMN scopes;
+		ALTER TABLE refresh_tokens DROP COLUMN client_id`,
+	},
+	{
+		version: 15,
+		name:    "add_users_oidc",
+		up: `ALTER TABLE users ADD COLUMN oidc_issuer TEXT NOT NULL DEFAULT '';
+		ALTER TABLE users ADD COLUMN oidc_subject TEXT NOT NULL DEFAULT '';
+		CREATE UNIQUE INDEX users_oidc_subject ON users(oidc_issuer, oidc_subject) WHERE oidc_subject != ''`,
+		down: `DROP INDEX users_oidc_subject;
+		ALTER TABLE users DROP COLUMN oidc_subject;
+		ALTER TABLE users DROP COLUMN oidc_issuer`,
+	},
+	{
+		// Refresh tokens are looked up by a selector, the first few
+		// characters of their hash, and the full hash is then compared in
+		// constant time, so how long a lookup takes says nothing about
+		// how much of a guessed hash matched.
+		version: 16,
+		name:    "add_refresh_token_selectors",
+		up: `ALTER TABLE refresh_tokens ADD COLUMN selector TEXT NOT NULL DEFAULT '';
+		UPDATE refresh_tokens SET selector = substr(token, 1, 16);
+		CREATE INDEX refresh_tokens_selector ON refresh_tokens(selector);
+		ALTER TABLE retired_refresh_tokens ADD COLUMN selector TEXT NOT NULL DEFAULT '';
+		UPDATE retired_refresh_tokens SET selector = substr(token, 1, 16);
+		CREATE INDEX retired_refresh_tokens_selector ON retired_refresh_tokens(selector)`,
+		down: `DROP INDEX retired_refresh_tokens_selector;
+		ALTER TABLE retired_refresh_tokens DROP COLUMN selector;
+		DROP INDEX refresh_tokens_selector;
+		ALTER TABLE refresh_tokens DROP COLUMN selector`,
+	},
+	{
+		// Accounts that predate verification are treated as verified, so
+		// upgrading does not lock their owners out of posting. Migration 9
+		// left them unverified, and a database that has run it cannot tell
+		// them apart from later signups, so every existing account is
+		// verified. There is nothing to undo.
+		version: 17,
+		name:    "verify_existing_users",
+		up:      `UPDATE users SET email_verified = 1`,
+		down:    ``,
+	},
+}
+
+// hashStoredRefreshTokens replaces every raw refresh token secret with its
+// hash.
+func hashStoredRefreshTokens(tx *sql.Tx) error {
+	for _, table := range []string{"refresh_tokens", "retired_refresh_tokens"} {
+		rows, err := tx.Query(`SELECT token FROM ` + table)
+		if err != nil {
+			return err
+		}
+		tokens := []string{}
+		for rows.Next() {
+			token := ""
+			if err := rows.Scan(&token); err != nil {
+				rows.Close()
+				return err
+			}
+			tokens = append(tokens, token)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, token := range tokens {
+			_, err := tx.Exec(`UPDATE `+table+` SET token = ? WHERE token = ?`, hashRefreshToken(token), token)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func ensureMigrationTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at INTEGER NOT NULL
+	)`)
+	return err
+}
+
+func currentSchemaVersion(db *sql.DB) (int, error) {
+	if err := ensureMigrationTable(db); err != nil {
+		return 0, err
+	}
+	version := 0
+	err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	return version, err
+}
+
+// migrateUp applies every migration newer than the current schema version,
+// each in its own transaction.
+func migrateUp(db *sql.DB) error {
+	current, err := currentSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if m.up != "" {
+			if _, err := tx.Exec(m.up); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migration %d (%s) failed: %w", m.version, m.name, err)
+			}
+		}
+		if m.upFunc != nil {
+			if err := m.upFunc(tx); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migration %d (%s) failed: %w", m.version, m.name, err)
+			}
+		}
+		_, err = tx.Exec(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`,
+			m.version, m.name, time.Now().UTC().Unix())
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		fmt.Printf("Applied migration %d (%s)\n", m.version, m.name)
+	}
+	return nil
+}
+
+// migrateDown reverts migrations, newest first, until the schema is at the
+// target version.
+func migrateDown(db *sql.DB, target int) error {
+	current, err := currentSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.version > current || m.version <= target {
+			continue
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(m.down); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("reverting migration %d (%s) failed: %w", m.version, m.name, err)
+		}
+		if _, err := tx.Exec(`DELETE FROM schema_migrations WHERE version = ?`, m.version); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		fmt.Printf("Reverted migration %d (%s)\n", m.version, m.name)
+	}
+	return nil
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// An OAuth 2.0 authorization server (RFC 6749) supporting the authorization
+// code grant with PKCE (RFC 7636) and refresh tokens. Access tokens are the
+// same JWTs produceJWT hands out at login, with the granted scopes in their
+// scope claim, so requireScope limits them like personal access tokens.
+// Refresh tokens are ordinary sessions that carry the client's id.
+const (
+	oauthCodeAudience = "chirpy-oauth-code"
+	oauthCodeTTL      = 5 * time.Minute
+	pkceMinLength     = 43
+	pkceMaxLength     = 128
+)
+
+// oauthCodeClaims are carried by an authorization code, a short-lived
+// token signed like access tokens. They remember everything the token
+// endpoint has to check the code's redemption against.
+type oauthCodeClaims struct {
+	jwt.RegisteredClaims
+	ClientId      string `json:"client_id"`
+	RedirectURI   string `json:"redirect_uri"`
+	Scope         string `json:"scope"`
+	CodeChallenge string `json:"code_challenge"`
+}
+
+func (cfg *apiConfig) produceOAuthCode(userId int, req authorizationRequest, scopes []string) (string, error) {
+	now := time.Now().UTC()
+	return cfg.keys.sign(oauthCodeClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    cfg.issuer,
+			Audience:  jwt.ClaimStrings{oauthCodeAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(oauthCodeTTL)),
+			Subject:   strconv.Itoa(userId),
+			ID:        newTokenId(),
+		},
+		ClientId:      req.Client.Id,
+		RedirectURI:   req.RedirectURI,
+		Scope:         strings.Join(scopes, " "),
+		CodeChallenge: req.CodeChallenge,
+	})
+}
+
+func (cfg *apiConfig) validateOAuthCode(tokenString string) (*oauthCodeClaims, error) {
+	claims := &oauthCodeClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, cfg.keys.keyfunc,
+		jwt.WithValidMethods([]string{algEdDSA, algRS256}),
+		jwt.WithIssuer(cfg.issuer),
+		jwt.WithAudience(oauthCodeAudience),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(cfg.jwtLeeway),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if claims.ID == "" || claims.ClientId == "" || claims.CodeChallenge == "" {
+		return nil, errors.New("authorization code is missing claims")
+	}
+	return claims, nil
+}
+
+// oauthCodeSessionId is the id of the session a code is exchanged for. It
+// is derived from the code so that a code turning up a second time, which
+// means it has leaked, can end the session it started, as RFC 6749 section
+// 4.1.2 asks.
+func oauthCodeSessionId(jti string) string {
+	sum := sha256.Sum256([]byte("oauth-code:" + jti))
+	return fmt.Sprintf("%x", sum[:8])
+}
+
+// validPKCEValue checks a code verifier or S256 challenge is made of the
+// unreserved characters RFC 7636 allows and is the right length.
+func validPKCEValue(value string) bool {
+	if len(value) < pkceMinLength || len(value) > pkceMaxLength {
+		return false
+	}
+	for _, c := range value {
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		case c == '-', c == '.', c == '_', c == '~':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// pkceChallengeMatches reports whether verifier hashes to challenge with
+// the S256 method, the only one supported.
+func pkceChallengeMatches(verifier, challenge string) bool {
+	if !validPKCEValue(verifier) {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
+
+// parseScopes splits a space separated scope parameter, refusing an empty
+// one and any scope that is not in allowed.
+func parseScopes(scope string, allowed []string) ([]string, bool) {
+	scopes := strings.Fields(scope)
+	if len(scopes) == 0 {
+		return nil, false
+	}
+	for _, s := range scopes {
+		if !slices.Contains(allowed, s) {
+			return nil, false
+		}
+	}
+	slices.Sort(scopes)
+	return slices.Compact(scopes), true
+}
+
+// writeOAuthError sends an error from the token endpoint in the JSON form
+// RFC 6749 section 5.2 describes.
+func writeOAuthError(w http.ResponseWriter, status int, code, description string) {
+	data, _ := json.Marshal(struct {
+		Error       string `json:"error"`
+		Description string `json:"error_description,omitempty"`
+	}{code, description})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// authorizationRequest is a validated request to /oauth/authorize.
+type authorizationRequest struct {
+	Client        OAuthClient
+	RedirectURI   string
+	Scopes        []string
+	State         string
+	CodeChallenge string
+}
+
+// redirectWith is the client's redirect URI with params added to whatever
+// query it was registered with, plus the request's state if there was one.
+func (req authorizationRequest) redirectWith(params url.Values) string {
+	u, _ := url.Parse(req.RedirectURI)
+	query := u.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	if req.State != "" {
+		query.Set("state", req.State)
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// parseAuthorizationRequest validates the parameters of an authorization
+// request. As RFC 6749 section 4.1.2.1 requires, a bad client or redirect
+// URI is reported to the user and never redirected to; once those check
+// out, other errors carry a redirect_to that hands them back to the client.
+// It writes the response and returns false if the request is no good.
+func (cfg *apiConfig) parseAuthorizationRequest(w http.ResponseWriter, values url.Values) (authorizationRequest, bool) {
+	req := authorizationRequest{
+		RedirectURI:   values.Get("redirect_uri"),
+		State:         values.Get("state"),
+		CodeChallenge: values.Get("code_challenge"),
+	}
+	client, err := cfg.store.GetOAuthClient(values.Get("client_id"))
+	if err != nil && err != errNotFound {
+		fmt.Printf("Error reading OAuth client: %s\n", err)
+		w.WriteHeader(500)
+		return req, false
+	}
+	if err == errNotFound {
+		writeOAuthError(w, 400, "invalid_request", "unknown client_id")
+		return req, false
+	}
+	if !slices.Contains(client.RedirectURIs, req.RedirectURI) {
+		writeOAuthError(w, 400, "invalid_request", "redirect_uri is not registered for this client")
+		return req, false
+	}
+	req.Client = client
+
+	fail := func(code, description string) (authorizationRequest, bool) {
+		data, _ := json.Marshal(struct {
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+			RedirectTo  string `json:"redirect_to"`
+		}{code, description, req.redirectWith(url.Values{"error": {code}, "error_description": {description}})})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(400)
+		w.Write(data)
+		return req, false
+	}
+	if values.Get("response_type") != "code" {
+		return fail("unsupported_response_type", "response_type must be code")
+	}
+	scopes, ok := parseScopes(values.Get("scope"), tokenScopes)
+	if !ok {
+		return fail("invalid_scope", "scope must be one or more of: "+strings.Join(tokenScopes, " "))
+	}
+	req.Scopes = scopes
+	if values.Get("code_challenge_method") != "S256" || !validPKCEValue(req.CodeChallenge) {
+		return fail("invalid_request", "a code_challenge with code_challenge_method S256 is required")
+	}
+	return req, true
+}
+
+// authorizeEntry is where clients send the user's browser. A browser has
+// no access token to send, so it is redirected to the consent page, which
+// logs the user in and comes back for the prompt with a token of its own.
+func (cfg *apiConfig) authorizeEntry(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") == "" {
+		http.Redirect(w, r, "/app/authorize.html?"+r.URL.RawQuery, http.StatusFound)
+		return
+	}
+	cfg.requireAuth(cfg.authorizePrompt)(w, r)
+}
+
+// authorizePrompt describes an authorization request so the user can be
+// asked whether to allow it.
+func (cfg *apiConfig) authorizePrompt(w http.ResponseWriter, r *http.Request) {
+	req, ok := cfg.parseAuthorizationRequest(w, r.URL.Query())
+	if !ok {
+		return
+	}
+	data, err := json.Marshal(struct {
+		ClientId    string   `json:"client_id"`
+		ClientName  string   `json:"client_name"`
+		RedirectURI string   `json:"redirect_uri"`
+		Scopes      []string `json:"scopes"`
+		State       string   `json:"state,omitempty"`
+	}{req.Client.Id, req.Client.Name, req.RedirectURI, req.Scopes, req.State})
+	if err != nil {
+		fmt.Printf("Error marshalling authorization prompt to JSON: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(data)
+}
+
+// authorizeDecision records the user's answer to an authorization request,
+// sent as the same parameters as the prompt plus decision, approve or deny,
+// and optionally granted_scope to allow only some of the scopes asked for.
+// The response holds the redirect_to URI to send the user back to the
+// client with, carrying either a code or an access_denied error.
+func (cfg *apiConfig) authorizeDecision(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, 400, "invalid_request", "request body could not be parsed")
+		return
+	}
+	req, ok := cfg.parseAuthorizationRequest(w, r.Form)
+	if !ok {
+		return
+	}
+
+	redirectTo := ""
+	switch r.Form.Get("decision") {
+	case "deny":
+		redirectTo = req.redirectWith(url.Values{"error": {"access_denied"}})
+	case "approve":
+		scopes := req.Scopes
+		if granted := r.Form.Get("granted_scope"); granted != "" {
+			scopes, ok = parseScopes(granted, req.Scopes)
+			if !ok {
+				writeOAuthError(w, 400, "invalid_scope", "granted_scope must be some of the scopes asked for")
+				return
+			}
+		}
+		code, err := cfg.produceOAuthCode(caller.UserId, req, scopes)
+		if err != nil {
+			fmt.Printf("Something is wrong with creating an authorization code: %s\n", err)
+			w.WriteHeader(500)
+			return
+		}
+		cfg.audit.record(auditEvent{
+			Event:  "oauth.authorized",
+			UserId: caller.UserId,
+			IP:     clientIP(r),
+			Detail: fmt.Sprintf("%s (%s) with scopes %s", req.Client.Id, req.Client.Name, strings.Join(scopes, " ")),
+		})
+		redirectTo = req.redirectWith(url.Values{"code": {code}})
+	default:
+		writeOAuthError(w, 400, "invalid_request", "decision must be approve or deny")
+		return
+	}
+
+	data, err := json.Marshal(struct {
+		RedirectTo string `json:"redirect_to"`
+	}{redirectTo})
+	if err != nil {
+		fmt.Printf("Error marshalling authorization decision to JSON: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(data)
+}
+
+// authenticateOAuthClient identifies the client calling the token endpoint,
+// by HTTP Basic credentials or client_id and client_secret in the body. A
+// public client sends only its client_id. It writes the response and
+// returns false if the client cannot be authenticated.
+func (cfg *apiConfig) authenticateOAuthClient(w http.ResponseWriter, r *http.Request) (OAuthClient, bool) {
+	id, secret, basic := r.BasicAuth()
+	if basic {
+		// RFC 6749 section 2.3.1 has both form encoded before they are
+		// put in the header.
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+	fail := func() (OAuthClient, bool) {
+		if basic {
+			w.Header().Set("WWW-Authenticate", `Basic realm="chirpy"`)
+		}
+		writeOAuthError(w, 401, "invalid_client", "client authentication failed")
+		return OAuthClient{}, false
+	}
+	client, err := cfg.store.GetOAuthClient(id)
+	if err == errNotFound {
+		return fail()
+	}
+	if err != nil {
+		fmt.Printf("Error reading OAuth client: %s\n", err)
+		w.WriteHeader(500)
+		return OAuthClient{}, false
+	}
+	if client.Secret == "" {
+		if secret != "" {
+			return fail()
+		}
+		return client, true
+	}
+	if secret == "" || !refreshTokenHashEqual(client.Secret, hashRefreshToken(secret)) {
+		return fail()
+	}
+	return client, true
+}
+
+// oauthToken is the token endpoint. It exchanges an authorization code, or
+// a refresh token from an earlier exchange, for an access token and a new
+// refresh token.
+func (cfg *apiConfig) oauthToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, 400, "invalid_request", "request body could not be parsed")
+		return
+	}
+	client, ok := cfg.authenticateOAuthClient(w, r)
+	if !ok {
+		return
+	}
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		cfg.exchangeOAuthCode(w, r, client)
+	case "refresh_token":
+		cfg.refreshOAuthToken(w, r, client)
+	default:
+		writeOAuthError(w, 400, "unsupported_grant_type", "grant_type must be authorization_code or refresh_token")
+	}
+}
+
+// exchangeOAuthCode redeems an authorization code for a new session. The
+// code only works once, for the client it was issued to, with the same
+// redirect_uri, and with the verifier its PKCE challenge was made from.
+func (cfg *apiConfig) exchangeOAuthCode(w http.ResponseWriter, r *http.Request, client OAuthClient) {
+	claims, err := cfg.validateOAuthCode(r.PostForm.Get("code"))
+	if err != nil || claims.ClientId != client.Id || claims.RedirectURI != r.PostForm.Get("redirect_uri") {
+		writeOAuthError(w, 400, "invalid_grant", "authorization code is invalid or has expired")
+		return
+	}
+	if !pkceChallengeMatches(r.PostForm.Get("code_verifier"), claims.CodeChallenge) {
+		writeOAuthError(w, 400, "invalid_grant", "code_verifier does not match the code_challenge")
+		return
+	}
+	// Using the code up is a single insert, so of two requests racing
+	// with it only one gets past here.
+	sessionId := oauthCodeSessionId(claims.ID)
+	err = cfg.store.RevokeAccessToken(claims.ID, claims.ExpiresAt.Time)
+	if err == errAlreadyRevoked {
+		if err := cfg.store.DeleteRefreshToken(sessionId); err == nil {
+			fmt.Printf("Authorization code for client %s was used twice, ended session %s\n", client.Id, sessionId)
+		}
+		writeOAuthError(w, 400, "invalid_grant", "authorization code is invalid or has expired")
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error using authorization code: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+	uid, err := strconv.Atoi(claims.Subject)
+	if err == nil {
+		_, err = cfg.store.GetUser(uid)
+	}
+	if err != nil {
+		writeOAuthError(w, 400, "invalid_grant", "authorization code is invalid or has expired")
+		return
+	}
+
+	scopes := strings.Fields(claims.Scope)
+	refreshToken := newRefreshToken()
+	now := time.Now().UTC()
+	session := RefreshToken{
+		Id:            sessionId,
+		UserId:        uid,
+		Token:         hashRefreshToken(refreshToken),
+		ExirationDate: now.Add(cfg.refreshTokenTTL),
+		Device:        client.Name,
+		UserAgent:     r.UserAgent(),
+		IP:            clientIP(r),
+		CreatedAt:     now,
+		LastUsedAt:    now,
+		ClientId:      client.Id,
+		Scopes:        scopes,
+	}
+	if err := cfg.store.SaveRefreshToken(session); err != nil {
+		fmt.Printf("There was an error saving refresh token: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+	cfg.writeOAuthTokens(w, session, refreshToken, scopes)
+}
+
+// refreshOAuthToken rotates a client's refresh token like /api/refresh
+// does for logins. The client may ask for fewer scopes than were granted
+// for the new access token; the session keeps all of them.
+func (cfg *apiConfig) refreshOAuthToken(w http.ResponseWriter, r *http.Request, client OAuthClient) {
+	presented := hashRefreshToken(r.PostForm.Get("refresh_token"))
+	session, err := cfg.store.GetRefreshToken(presented)
+	if err == errTokenReused {
+		cfg.revokeReusedSession(r, session)
+	}
+	if err != nil || session.ClientId != client.Id || !session.ExirationDate.After(time.Now().UTC()) {
+		writeOAuthError(w, 400, "invalid_grant", "refresh token is invalid or has expired")
+		return
+	}
+	scopes := session.Scopes
+	if scope := r.PostForm.Get("scope"); scope != "" {
+		narrowed, ok := parseScopes(scope, session.Scopes)
+		if !ok {
+			writeOAuthError(w, 400, "invalid_scope", "scope must be some of the scopes granted")
+			return
+		}
+		scopes = narrowed
+	}
+
+	refreshToken := newRefreshToken()
+	rotated, err := cfg.store.RotateRefreshToken(session.Id, presented, hashRefreshToken(refreshToken), time.Now().UTC())
+	if err == errTokenReused {
+		cfg.revokeReusedSession(r, rotated)
+	}
+	if err == errTokenReused || err == errNotFound {
+		writeOAuthError(w, 400, "invalid_grant", "refresh token is invalid or has expired")
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error rotating refresh token: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+	cfg.writeOAuthTokens(w, rotated, refreshToken, scopes)
+}
+
+// writeOAuthTokens sends a successful token response for session, with an
+// access token limited to scopes.
+func (cfg *apiConfig) writeOAuthTokens(w http.ResponseWriter, session RefreshToken, refreshToken string, scopes []string) {
+	scope := strings.Join(scopes, " ")
+	accessToken, expiresAt, err := cfg.produceJWT(cfg.refreshedAccessTTL, session.UserId, session.Id, scope)
+	if err != nil {
+		fmt.Printf("Something is wrong with creating JWT for token request: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+	data, err := json.Marshal(struct {
+		AccessToken  string `json:"access_token"`
+		TokenType    string `json:"token_type"`
+		ExpiresIn    int    `json:"expires_in"`
+		RefreshToken string `json:"refresh_token"`
+		Scope        string `json:"scope"`
+	}{accessToken, "Bearer", int(time.Until(expiresAt).Seconds()), refreshToken, scope})
+	if err != nil {
+		fmt.Printf("Error marshalling token response to JSON: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(200)
+	w.Write(data)
+}
+
+// oauthMetadata describes the authorization server as RFC 8414 lays out,
+// so clients can configure themselves. Its issuer is the iss every token
+// the server signs carries.
+func (cfg *apiConfig) oauthMetadata(w http.ResponseWriter, r *http.Request) {
+	base := getBaseURL()
+	data, err := json.Marshal(struct {
+		Issuer                            string   `json:"issuer"`
+		AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+		TokenEndpoint                     string   `json:"token_endpoint"`
+		JWKSURI                           string   `json:"jwks_uri"`
+		ScopesSupported                   []string `json:"scopes_supported"`
+		ResponseTypesSupported            []string `json:"response_types_supported"`
+		GrantTypesSupported               []string `json:"grant_types_supported"`
+		TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+		CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	}{
+		Issuer:                            cfg.issuer,
+		AuthorizationEndpoint:             base + "/oauth/authorize",
+		TokenEndpoint:                     base + "/oauth/token",
+		JWKSURI:                           base + "/.well-known/jwks.json",
+		ScopesSupported:                   tokenScopes,
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code", "refresh_token"},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+	})
+	if err != nil {
+		fmt.Printf("Error marshalling OAuth metadata to JSON: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(data)
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testRedirectURI = "https://app.example.com/callback"
+
+// oauthTest drives the authorization server over HTTP as a client and a
+// user who has already logged in would.
+type oauthTest struct {
+	t        *testing.T
+	cfg      *apiConfig
+	server   *httptest.Server
+	http     *http.Client
+	clientId string
+	user     loginResponse
+}
+
+// newOAuthTest starts a server with a logged in user and a public client
+// registered with testRedirectURI.
+func newOAuthTest(t *testing.T) *oauthTest {
+	t.Helper()
+	cfg := newTestConfig(t)
+	server := httptest.NewServer(cfg.routes())
+	t.Cleanup(server.Close)
+	handler := cfg.routes()
+	user := createTestUser(t, cfg, "oauth@example.com")
+	session := login(t, handler, user.Email)
+
+	rec := doRequest(t, handler, "POST", "/api/oauth/clients", session.Token, map[string]any{
+		"name":          "Test app",
+		"redirect_uris": []string{testRedirectURI},
+	})
+	if rec.Code != 201 {
+		t.Fatalf("registering client: got %d %q", rec.Code, rec.Body.String())
+	}
+	client := OAuthClientInfo{}
+	decodeBody(t, rec, &client)
+	return &oauthTest{
+		t:      t,
+		cfg:    cfg,
+		server: server,
+		http: &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}},
+		clientId: client.Id,
+		user:     session,
+	}
+}
+
+// pkcePair returns a code verifier and its S256 challenge.
+func pkcePair() (string, string) {
+	verifier := newRefreshToken()
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// authorize has the user approve a request for scope, granting only
+// granted if it is set, and returns the code sent back to the client.
+func (o *oauthTest) authorize(scope, granted, challenge string) string {
+	o.t.Helper()
+	form := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {o.clientId},
+		"redirect_uri":          {testRedirectURI},
+		"scope":                 {scope},
+		"state":                 {"xyz"},
+		"code_challenge":        {challenge},
+		"code_challenge_method": {"S256"},
+		"decision":              {"approve"},
+	}
+	if granted != "" {
+		form.Set("granted_scope", granted)
+	}
+	req, err := http.NewRequest("POST", o.server.URL+"/oauth/authorize", strings.NewReader(form.Encode()))
+	if err != nil {
+		o.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+o.user.Token)
+	status, body := o.do(req)
+	if status != 200 {
+		o.t.Fatalf("authorizing: got %d %v", status, body)
+	}
+	redirect, err := url.Parse(body["redirect_to"])
+	if err != nil || redirect.Query().Get("state") != "xyz" || redirect.Query().Get("code") == "" {
+		o.t.Fatalf("authorizing: redirected to %q", body["redirect_to"])
+	}
+	return redirect.Query().Get("code")
+}
+
+// token posts form to the token endpoint as the client.
+func (o *oauthTest) token(form url.Values) (int, map[string]string) {
+	o.t.Helper()
+	form.Set("client_id", o.clientId)
+	req, err := http.NewRequest("POST", o.server.URL+"/oauth/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		o.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return o.do(req)
+}
+
+// exchange redeems code with verifier at testRedirectURI.
+func (o *oauthTest) exchange(code, verifier string) (int, map[string]string) {
+	o.t.Helper()
+	return o.token(url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {testRedirectURI},
+		"code_verifier": {verifier},
+	})
+}
+
+func (o *oauthTest) do(req *http.Request) (int, map[string]string) {
+	o.t.Helper()
+	res, err := o.http.Do(req)
+	if err != nil {
+		o.t.Fatalf("%s %s: %s", req.Method, req.URL.Path, err)
+	}
+	defer res.Body.Close()
+	body := map[string]any{}
+	json.NewDecoder(res.Body).Decode(&body)
+	out := map[string]string{}
+	for key, value := range body {
+		if s, ok := value.(string); ok {
+			out[key] = s
+		}
+	}
+	return res.StatusCode, out
+}
+
+func TestOAuthCodeFlow(t *testing.T) {
+	o := newOAuthTest(t)
+	verifier, challenge := pkcePair()
+	code := o.authorize(scopeUsersRead, "", challenge)
+
+	status, tokens := o.exchange(code, verifier)
+	if status != 200 || tokens["access_token"] == "" || tokens["refresh_token"] == "" {
+		t.Fatalf("exchanging code: got %d %v", status, tokens)
+	}
+	if tokens["scope"] != scopeUsersRead {
+		t.Errorf("got scope %q, want %q", tokens["scope"], scopeUsersRead)
+	}
+	handler := o.cfg.routes()
+	if code := getMe(t, handler, tokens["access_token"]); code != 200 {
+		t.Errorf("reading profile with the access token: got %d, want 200", code)
+	}
+	rec := doRequest(t, handler, "POST", "/api/chirps", tokens["access_token"], map[string]string{"body": "hi"})
+	if rec.Code != 403 {
+		t.Errorf("chirping without chirps:write: got %d, want 403", rec.Code)
+	}
+
+	// A code turning up again has leaked, so the session it started ends.
+	if status, body := o.exchange(code, verifier); status != 400 || body["error"] != "invalid_grant" {
+		t.Errorf("reusing code: got %d %v, want invalid_grant", status, body)
+	}
+	if code := getMe(t, handler, tokens["access_token"]); code != 401 {
+		t.Errorf("access token after its code was reused: got %d, want 401", code)
+	}
+}
+
+func TestOAuthCodeExchangeChecks(t *testing.T) {
+	o := newOAuthTest(t)
+	tests := []struct {
+		name string
+		form func(code, verifier string) url.Values
+	}{
+		{"wrong verifier", func(code, _ string) url.Values {
+			other, _ := pkcePair()
+			return url.Values{"code": {code}, "redirect_uri": {testRedirectURI}, "code_verifier": {other}}
+		}},
+		{"no verifier", func(code, _ string) url.Values {
+			return url.Values{"code": {code}, "redirect_uri": {testRedirectURI}}
+		}},
+		{"redirect_uri mismatch", func(code, verifier string) url.Values {
+			return url.Values{"code": {code}, "redirect_uri": {"https://app.example.com/other"}, "code_verifier": {verifier}}
+		}},
+		{"garbage code", func(_, verifier string) url.Values {
+			return url.Values{"code": {"not-a-code"}, "redirect_uri": {testRedirectURI}, "code_verifier": {verifier}}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verifier, challenge := pkcePair()
+			code := o.authorize(scopeUsersRead, "", challenge)
+			form := tt.form(code, verifier)
+			form.Set("grant_type", "authorization_code")
+			if status, body := o.token(form); status != 400 || body["error"] != "invalid_grant" {
+				t.Errorf("got %d %v, want invalid_grant", status, body)
+			}
+		})
+	}
+}
+
+// Of several requests racing to redeem one code, only one gets tokens.
+func TestOAuthCodeWorksOnce(t *testing.T) {
+	o := newOAuthTest(t)
+	verifier, challenge := pkcePair()
+	code := o.authorize(scopeUsersRead, "", challenge)
+
+	const n = 5
+	var wg sync.WaitGroup
+	statuses := make(chan int, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			status, _ := o.exchange(code, verifier)
+			statuses <- status
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+	granted := 0
+	for status := range statuses {
+		if status == 200 {
+			granted++
+		}
+	}
+	if granted != 1 {
+		t.Errorf("one code was redeemed %d times, want 1", granted)
+	}
+}
+
+func TestOAuthRefresh(t *testing.T) {
+	o := newOAuthTest(t)
+	verifier, challenge := pkcePair()
+	code := o.authorize(scopeChirpsWrite+" "+scopeUsersRead+" "+scopeChirpsDelete, scopeChirpsWrite+" "+scopeUsersRead, challenge)
+	status, first := o.exchange(code, verifier)
+	if status != 200 {
+		t.Fatalf("exchanging code: got %d %v", status, first)
+	}
+	if first["scope"] != scopeChirpsWrite+" "+scopeUsersRead {
+		t.Errorf("got scope %q, want only the granted scopes", first["scope"])
+	}
+
+	refresh := func(token, scope string) (int, map[string]string) {
+		form := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {token}}
+		if scope != "" {
+			form.Set("scope", scope)
+		}
+		return o.token(form)
+	}
+	status, narrowed := refresh(first["refresh_token"], scopeUsersRead)
+	if status != 200 || narrowed["scope"] != scopeUsersRead {
+		t.Fatalf("refreshing with a narrower scope: got %d %v", status, narrowed)
+	}
+	if narrowed["refresh_token"] == first["refresh_token"] {
+		t.Errorf("refresh token was not rotated")
+	}
+	// The session keeps every granted scope, but not ones that were
+	// asked for and left out.
+	if status, body := refresh(narrowed["refresh_token"], scopeChirpsDelete); status != 400 || body["error"] != "invalid_scope" {
+		t.Errorf("refreshing with an ungranted scope: got %d %v, want invalid_scope", status, body)
+	}
+	status, widened := refresh(narrowed["refresh_token"], "")
+	if status != 200 || widened["scope"] != scopeChirpsWrite+" "+scopeUsersRead {
+		t.Fatalf("refreshing with no scope: got %d %v, want every granted scope", status, widened)
+	}
+
+	if status, body := refresh(first["refresh_token"], ""); status != 400 || body["error"] != "invalid_grant" {
+		t.Errorf("reusing a rotated refresh token: got %d %v, want invalid_grant", status, body)
+	}
+	if status, _ := refresh(widened["refresh_token"], ""); status != 400 {
+		t.Errorf("refresh token of a session ended for reuse: got %d, want 400", status)
+	}
+}
+
+// Browsers arrive without a token and are sent to the consent page, which
+// cannot be framed.
+func TestOAuthAuthorizeSendsBrowsersToConsentPage(t *testing.T) {
+	o := newOAuthTest(t)
+	_, challenge := pkcePair()
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {o.clientId},
+		"redirect_uri":          {testRedirectURI},
+		"scope":                 {scopeUsersRead},
+		"code_challenge":        {challenge},
+		"code_challenge_method": {"S256"},
+	}.Encode()
+
+	res, err := o.http.Get(o.server.URL + "/oauth/authorize?" + query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	location := res.Header.Get("Location")
+	if res.StatusCode != 302 || location != "/app/authorize.html?"+query {
+		t.Fatalf("got %d to %q, want a redirect to the consent page", res.StatusCode, location)
+	}
+	res, err = o.http.Get(o.server.URL + location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 || res.Header.Get("X-Frame-Options") != "DENY" {
+		t.Errorf("consent page: got %d with X-Frame-Options %q", res.StatusCode, res.Header.Get("X-Frame-Options"))
+	}
+}
+
+// Tokens carry the issuer the metadata advertises.
+func TestOAuthMetadataIssuer(t *testing.T) {
+	o := newOAuthTest(t)
+	res, err := o.http.Get(o.server.URL + "/.well-known/oauth-authorization-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	metadata := struct {
+		Issuer string `json:"issuer"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&metadata); err != nil {
+		t.Fatal(err)
+	}
+	claims, err := o.cfg.validateAccessToken(o.user.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Issuer == "" || claims.Issuer != metadata.Issuer {
+		t.Errorf("token issuer %q, metadata issuer %q", claims.Issuer, metadata.Issuer)
+	}
+}
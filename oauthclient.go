@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	oauthClientMaxNameLength = 100
+	maxOAuthRedirectURIs     = 10
+	maxOAuthClients          = 20
+)
+
+// OAuthClient is a third-party application a user has registered so that
+// other users can grant it access to their accounts. A confidential client
+// has a Secret, the hash of which is stored like every other secret and
+// which is only shown when the client is registered. A public client, such
+// as a mobile or single page app, cannot keep a secret and leaves it empty;
+// PKCE is what protects its codes.
+type OAuthClient struct {
+	Id           string
+	OwnerId      int
+	Name         string
+	RedirectURIs []string
+	Secret       string
+	CreatedAt    time.Time
+}
+
+// OAuthClients maps each client's id to the client.
+type OAuthClients struct {
+	Clients map[string]OAuthClient
+}
+
+// OAuthClientInfo is what the owner is shown of one of their clients.
+// Secret is only filled in on the response that registers it.
+type OAuthClientInfo struct {
+	Id           string    `json:"client_id"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Confidential bool      `json:"confidential"`
+	CreatedAt    time.Time `json:"created_at"`
+	Secret       string    `json:"client_secret,omitempty"`
+}
+
+// readOAuthClients loads the clients, treating a missing file as none
+// since data directories from before OAuth have none.
+func readOAuthClients(file string) (OAuthClients, error) {
+	clients := OAuthClients{}
+	err := readJSONFile(file, &clients)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return clients, err
+	}
+	if clients.Clients == nil {
+		clients.Clients = make(map[string]OAuthClient)
+	}
+	return clients, nil
+}
+
+func saveOAuthClients(file string, clients OAuthClients) error {
+	return writeJSONFile(file, &clients)
+}
+
+func oauthClientInfo(client OAuthClient) OAuthClientInfo {
+	return OAuthClientInfo{
+		Id:           client.Id,
+		Name:         client.Name,
+		RedirectURIs: client.RedirectURIs,
+		Confidential: client.Secret != "",
+		CreatedAt:    client.CreatedAt,
+	}
+}
+
+// validRedirectURI reports whether raw can be registered as a redirect URI.
+// Codes are sent to it, so it must be https, except on the loopback
+// addresses native apps listen on, and must be absolute with no fragment.
+func validRedirectURI(raw string) bool {
+	if strings.ContainsAny(raw, " \t\r\n") {
+		return false
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || u.Fragment != "" || u.User != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "https":
+		return true
+	case "http":
+		host := u.Hostname()
+		if host == "localhost" {
+			return true
+		}
+		ip := net.ParseIP(host)
+		return ip != nil && ip.IsLoopback()
+	}
+	return false
+}
+
+// registerOAuthClient registers a new client owned by the caller.
+func (cfg *apiConfig) registerOAuthClient(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+
+	type parameters struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Confidential bool     `json:"confidential"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		log.Printf("Error decoding parameters: %s", err)
+		w.WriteHeader(400)
+		return
+	}
+	name := strings.TrimSpace(params.Name)
+	if name == "" || len(name) > oauthClientMaxNameLength {
+		w.WriteHeader(400)
+		w.Write([]byte(fmt.Sprintf("Client name must be between 1 and %d characters\n", oauthClientMaxNameLength)))
+		return
+	}
+	if len(params.RedirectURIs) == 0 || len(params.RedirectURIs) > maxOAuthRedirectURIs {
+		w.WriteHeader(400)
+		w.Write([]byte(fmt.Sprintf("Client needs between 1 and %d redirect URIs\n", maxOAuthRedirectURIs)))
+		return
+	}
+	for _, uri := range params.RedirectURIs {
+		if !validRedirectURI(uri) {
+			w.WriteHeader(400)
+			w.Write([]byte(fmt.Sprintf("Redirect URI %q must be an absolute https URI, or http on localhost, without a fragment\n", uri)))
+			return
+		}
+	}
+
+	existing, err := cfg.store.GetUserOAuthClients(caller.UserId)
+	if err != nil {
+		fmt.Printf("Error reading OAuth clients for user %d: %s\n", caller.UserId, err)
+		w.WriteHeader(500)
+		return
+	}
+	if len(existing) >= maxOAuthClients {
+		w.WriteHeader(409)
+		w.Write([]byte(fmt.Sprintf("You already have %d OAuth clients, delete one first\n", len(existing))))
+		return
+	}
+
+	secret := ""
+	client := OAuthClient{
+		Id:           newTokenId(),
+		OwnerId:      caller.UserId,
+		Name:         name,
+		RedirectURIs: slices.Compact(slices.Clone(params.RedirectURIs)),
+		CreatedAt:    time.Now().UTC().Truncate(time.Second),
+	}
+	if params.Confidential {
+		secret = newRefreshToken()
+		client.Secret = hashRefreshToken(secret)
+	}
+	if err := cfg.store.SaveOAuthClient(client); err != nil {
+		fmt.Printf("There was an error saving OAuth client: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+	cfg.audit.record(auditEvent{
+		Event:  "oauth.client_registered",
+		UserId: caller.UserId,
+		IP:     clientIP(r),
+		Detail: fmt.Sprintf("%s (%s)", client.Id, client.Name),
+	})
+
+	info := oauthClientInfo(client)
+	info.Secret = secret
+	data, err := json.Marshal(info)
+	if err != nil {
+		fmt.Printf("Error marshalling OAuth client to JSON: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(201)
+	w.Write(data)
+}
+
+// listOAuthClients returns the clients the caller owns, newest first,
+// without their secrets.
+func (cfg *apiConfig) listOAuthClients(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+
+	clients, err := cfg.store.GetUserOAuthClients(caller.UserId)
+	if err != nil {
+		fmt.Printf("Error reading OAuth clients for user %d: %s\n", caller.UserId, err)
+		w.WriteHeader(500)
+		return
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].CreatedAt.After(clients[j].CreatedAt)
+	})
+	out := make([]OAuthClientInfo, 0, len(clients))
+	for _, client := range clients {
+		out = append(out, oauthClientInfo(client))
+	}
+	data, err := json.Marshal(out)
+	if err != nil {
+		fmt.Printf("Error marshalling OAuth clients to JSON: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(data)
+}
+
+// deleteOAuthClient deletes one of the caller's clients and ends every
+// session any user has granted it. Clients belonging to anyone else look
+// the same as ones that do not exist.
+func (cfg *apiConfig) deleteOAuthClient(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+	id := r.PathValue("id")
+
+	client, err := cfg.store.GetOAuthClient(id)
+	if err == errNotFound || (err == nil && client.OwnerId != caller.UserId) {
+		w.WriteHeader(404)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error reading OAuth client %s: %s\n", id, err)
+		w.WriteHeader(500)
+		return
+	}
+	err = cfg.store.DeleteOAuthClient(id)
+	if err == errNotFound {
+		w.WriteHeader(404)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error deleting OAuth client %s: %s\n", id, err)
+		w.WriteHeader(500)
+		return
+	}
+	// The token endpoint refuses sessions of a client that is gone, so this
+	// failing only leaves dead sessions behind.
+	if err := cfg.store.DeleteClientRefreshTokens(id); err != nil {
+		fmt.Printf("Error ending sessions of OAuth client %s: %s\n", id, err)
+	}
+	cfg.audit.record(auditEvent{
+		Event:  "oauth.client_deleted",
+		UserId: caller.UserId,
+		IP:     clientIP(r),
+		Detail: fmt.Sprintf("%s (%s)", id, client.Name),
+	})
+	w.WriteHeader(204)
+}
@@ -0,0 +1,700 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Federated login through an OpenID Connect provider, using the
+// authorization code flow with PKCE. The provider's endpoints and signing
+// keys are found through discovery, and a user signs in to the account
+// linked to their identity, or to the one using their verified email.
+const (
+	algES256                = "ES256"
+	oidcLoginAudience       = "chirpy-oidc-login"
+	oidcLoginTTL            = 10 * time.Minute
+	oidcLoginCookie         = "chirpy_oidc"
+	oidcLoginPath           = "/api/login/oidc"
+	oidcHandoffAudience     = "chirpy-oidc-handoff"
+	oidcHandoffTTL          = time.Minute
+	oidcDiscoveryTTL        = time.Hour
+	oidcKeysRefetchInterval = time.Minute
+	oidcMaxResponseSize     = 1 << 20
+)
+
+// errIdentityLinked means an account was linked to another identity while
+// a login was trying to link it.
+var errIdentityLinked = errors.New("account is linked to another identity")
+
+// oidcDiscovery is the part of a provider's discovery document Chirpy uses.
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcKey struct {
+	alg    string
+	public crypto.PublicKey
+}
+
+// oidcProvider is the configured identity provider. Its discovery document
+// and keys are fetched when first needed rather than at startup, so the
+// server still starts while the provider is down.
+type oidcProvider struct {
+	issuer        string
+	clientId      string
+	clientSecret  string
+	redirectURL   string
+	scopes        []string
+	autoProvision bool
+	appURL        string
+	client        *http.Client
+
+	mu            sync.Mutex
+	discovery     oidcDiscovery
+	discoveredAt  time.Time
+	keys          map[string]oidcKey
+	keysFetchedAt time.Time
+}
+
+func newOIDCProvider(issuer, clientId, clientSecret, redirectURL string, scopes []string) (*oidcProvider, error) {
+	u, err := url.Parse(issuer)
+	if err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+		return nil, fmt.Errorf("OIDC_ISSUER %q is not an http(s) URL", issuer)
+	}
+	if clientId == "" {
+		return nil, errors.New("OIDC_CLIENT_ID must be set along with OIDC_ISSUER")
+	}
+	return &oidcProvider{
+		issuer:       issuer,
+		clientId:     clientId,
+		clientSecret: clientSecret,
+		redirectURL:  redirectURL,
+		scopes:       scopes,
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (p *oidcProvider) getJSON(link string, v any) error {
+	resp, err := p.client.Get(link)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("%s returned %s", link, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, oidcMaxResponseSize)).Decode(v)
+}
+
+// discover returns the provider's endpoints, fetching its discovery
+// document the first time and again once it is oidcDiscoveryTTL old. If
+// fetching it again fails, the last good copy is kept.
+func (p *oidcProvider) discover() (oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery.Issuer != "" && time.Since(p.discoveredAt) < oidcDiscoveryTTL {
+		return p.discovery, nil
+	}
+	doc := oidcDiscovery{}
+	err := p.getJSON(p.issuer+"/.well-known/openid-configuration", &doc)
+	if err == nil && doc.Issuer != p.issuer {
+		err = fmt.Errorf("discovery document is for issuer %q", doc.Issuer)
+	}
+	if err == nil && (doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "") {
+		err = errors.New("discovery document is missing endpoints")
+	}
+	if err != nil {
+		if p.discovery.Issuer != "" {
+			fmt.Printf("Could not refresh OIDC discovery document, keeping the last one: %s\n", err)
+			return p.discovery, nil
+		}
+		return oidcDiscovery{}, err
+	}
+	p.discovery = doc
+	p.discoveredAt = time.Now()
+	return doc, nil
+}
+
+// fetchKeys replaces the provider's signing keys with those in its JWKS.
+// The caller must hold mu and have discovered the provider.
+func (p *oidcProvider) fetchKeys() error {
+	p.keysFetchedAt = time.Now()
+	set := jwkSet{}
+	if err := p.getJSON(p.discovery.JWKSURI, &set); err != nil {
+		return err
+	}
+	keys := make(map[string]oidcKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := parseJWK(k)
+		if err != nil {
+			fmt.Printf("Skipping OIDC provider key %q: %s\n", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	p.keys = keys
+	return nil
+}
+
+// parseJWK turns one of the provider's keys into a public key, along with
+// the only alg tokens signed by it are accepted with.
+func parseJWK(k jwk) (oidcKey, error) {
+	b64 := base64.RawURLEncoding
+	alg := ""
+	var public crypto.PublicKey
+	switch {
+	case k.Kty == "RSA":
+		n, errN := b64.DecodeString(k.N)
+		e, errE := b64.DecodeString(k.E)
+		if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+			return oidcKey{}, errors.New("malformed RSA key")
+		}
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if key.N.BitLen() < 2048 {
+			return oidcKey{}, errors.New("RSA key is shorter than 2048 bits")
+		}
+		alg, public = algRS256, key
+	case k.Kty == "EC" && k.Crv == "P-256":
+		x, errX := b64.DecodeString(k.X)
+		y, errY := b64.DecodeString(k.Y)
+		if errX != nil || errY != nil || len(x) != 32 || len(y) != 32 {
+			return oidcKey{}, errors.New("malformed P-256 key")
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return oidcKey{}, errors.New("P-256 key is not on the curve")
+		}
+		alg, public = algES256, key
+	case k.Kty == "OKP" && k.Crv == "Ed25519":
+		x, err := b64.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return oidcKey{}, errors.New("malformed Ed25519 key")
+		}
+		alg, public = algEdDSA, ed25519.PublicKey(x)
+	default:
+		return oidcKey{}, fmt.Errorf("unsupported key type %s %s", k.Kty, k.Crv)
+	}
+	if k.Alg != "" && k.Alg != alg {
+		return oidcKey{}, fmt.Errorf("unsupported alg %s", k.Alg)
+	}
+	return oidcKey{alg: alg, public: public}, nil
+}
+
+// keyfunc finds the provider key an ID token was signed with by its kid.
+// Providers rotate keys without notice, so an unknown kid makes it fetch
+// the keys again, though no more than once per oidcKeysRefetchInterval.
+func (p *oidcProvider) keyfunc(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key, ok := p.keys[kid]
+	if !ok && time.Since(p.keysFetchedAt) >= oidcKeysRefetchInterval {
+		if err := p.fetchKeys(); err != nil {
+			return nil, fmt.Errorf("fetching provider keys: %w", err)
+		}
+		key, ok = p.keys[kid]
+	}
+	if !ok {
+		return nil, errUnknownKey
+	}
+	if t.Method.Alg() != key.alg {
+		return nil, fmt.Errorf("token alg %s does not match provider key %q", t.Method.Alg(), kid)
+	}
+	return key.public, nil
+}
+
+// exchange redeems an authorization code at the provider's token endpoint
+// and returns the ID token it hands back.
+func (p *oidcProvider) exchange(tokenEndpoint, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.redirectURL},
+		"code_verifier": {verifier},
+	}
+	if p.clientSecret == "" {
+		form.Set("client_id", p.clientId)
+	}
+	req, err := http.NewRequest("POST", tokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.clientId), url.QueryEscape(p.clientSecret))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	out := struct {
+		IDToken     string `json:"id_token"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, oidcMaxResponseSize)).Decode(&out); err != nil {
+		return "", fmt.Errorf("token endpoint returned %s: %w", resp.Status, err)
+	}
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("token endpoint returned %s: %s %s", resp.Status, out.Error, out.Description)
+	}
+	if out.IDToken == "" {
+		return "", errors.New("token endpoint returned no id_token")
+	}
+	return out.IDToken, nil
+}
+
+// oidcBool is a boolean claim that some providers send as a string.
+type oidcBool bool
+
+func (b *oidcBool) UnmarshalJSON(data []byte) error {
+	*b = strings.Trim(string(data), `"`) == "true"
+	return nil
+}
+
+// idTokenClaims are the claims Chirpy reads from a provider's ID token.
+type idTokenClaims struct {
+	jwt.RegisteredClaims
+	Nonce           string   `json:"nonce"`
+	AuthorizedParty string   `json:"azp"`
+	Email           string   `json:"email"`
+	EmailVerified   oidcBool `json:"email_verified"`
+}
+
+// verifyIDToken checks an ID token as OpenID Connect Core section 3.1.3.7
+// lays out: signed by one of the provider's keys, issued by it, for Chirpy,
+// current, and carrying the nonce the sign-in was started with.
+func (p *oidcProvider) verifyIDToken(tokenString, nonce string, leeway time.Duration) (*idTokenClaims, error) {
+	claims := &idTokenClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, p.keyfunc,
+		jwt.WithValidMethods([]string{algRS256, algES256, algEdDSA}),
+		jwt.WithIssuer(p.issuer),
+		jwt.WithAudience(p.clientId),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(leeway),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("ID token has no sub claim")
+	}
+	if (len(claims.Audience) > 1 || claims.AuthorizedParty != "") && claims.AuthorizedParty != p.clientId {
+		return nil, fmt.Errorf("ID token was issued to %q", claims.AuthorizedParty)
+	}
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return nil, errors.New("ID token nonce does not match")
+	}
+	return claims, nil
+}
+
+// oidcLoginClaims are carried by the cookie that remembers a sign-in
+// between sending the user to the provider and their coming back. Being
+// in a cookie ties the sign-in to the browser that started it, and keeps
+// the PKCE verifier out of any URL.
+type oidcLoginClaims struct {
+	jwt.RegisteredClaims
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Expiry   int    `json:"expires_in_seconds,omitempty"`
+	Device   string `json:"device,omitempty"`
+}
+
+func (cfg *apiConfig) validateOIDCLogin(tokenString string) (*oidcLoginClaims, error) {
+	claims := &oidcLoginClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, cfg.keys.keyfunc,
+		jwt.WithValidMethods([]string{algEdDSA, algRS256}),
+		jwt.WithIssuer(cfg.issuer),
+		jwt.WithAudience(oidcLoginAudience),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(cfg.jwtLeeway),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if claims.ID == "" || claims.State == "" || claims.Nonce == "" || claims.Verifier == "" {
+		return nil, errors.New("sign-in cookie is missing claims")
+	}
+	return claims, nil
+}
+
+func setOIDCLoginCookie(w http.ResponseWriter, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcLoginCookie,
+		Value:    value,
+		Path:     oidcLoginPath,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(getBaseURL(), "https://"),
+		// Lax, as the provider sends the user back with a top-level GET
+		// from another site.
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// startOIDCLogin sends the user to the identity provider to sign in. The
+// optional device and expires_in_seconds query parameters are kept for
+// the session the sign-in ends with, as with /api/login.
+func (cfg *apiConfig) startOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if cfg.oidc == nil {
+		w.WriteHeader(404)
+		w.Write([]byte("Federated login is not configured\n"))
+		return
+	}
+	discovery, err := cfg.oidc.discover()
+	if err != nil {
+		fmt.Printf("Could not discover OIDC provider: %s\n", err)
+		w.WriteHeader(502)
+		w.Write([]byte("Could not reach the identity provider\n"))
+		return
+	}
+
+	expiry, _ := strconv.Atoi(r.URL.Query().Get("expires_in_seconds"))
+	now := time.Now().UTC()
+	claims := oidcLoginClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    cfg.issuer,
+			Audience:  jwt.ClaimStrings{oidcLoginAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(oidcLoginTTL)),
+			ID:        newTokenId(),
+		},
+		State:    newTokenId(),
+		Nonce:    newTokenId(),
+		Verifier: newRefreshToken(),
+		Expiry:   expiry,
+		Device:   r.URL.Query().Get("device"),
+	}
+	cookie, err := cfg.keys.sign(claims)
+	if err != nil {
+		fmt.Printf("Something is wrong with creating the OIDC sign-in cookie: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+	setOIDCLoginCookie(w, cookie, int(oidcLoginTTL/time.Second))
+
+	challenge := sha256.Sum256([]byte(claims.Verifier))
+	target, err := url.Parse(discovery.AuthorizationEndpoint)
+	if err != nil {
+		fmt.Printf("OIDC authorization endpoint is not a URL: %s\n", err)
+		w.WriteHeader(502)
+		return
+	}
+	query := target.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", cfg.oidc.clientId)
+	query.Set("redirect_uri", cfg.oidc.redirectURL)
+	query.Set("scope", strings.Join(cfg.oidc.scopes, " "))
+	query.Set("state", claims.State)
+	query.Set("nonce", claims.Nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+	target.RawQuery = query.Encode()
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+// finishOIDCLogin is where the identity provider sends the user back to.
+// It redeems the code for an ID token and, if the token checks out, logs
+// the user in to the account for their identity just as /api/login would,
+// two-factor challenge included. With an app URL configured the browser is
+// sent there with a one-time code instead, so the tokens are never shown
+// on a page it navigated to.
+func (cfg *apiConfig) finishOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if cfg.oidc == nil {
+		w.WriteHeader(404)
+		w.Write([]byte("Federated login is not configured\n"))
+		return
+	}
+	query := r.URL.Query()
+	cookie, cookieErr := r.Cookie(oidcLoginCookie)
+	setOIDCLoginCookie(w, "", -1)
+
+	var claims *oidcLoginClaims
+	err := cookieErr
+	if err == nil {
+		claims, err = cfg.validateOIDCLogin(cookie.Value)
+	}
+	if err == nil && subtle.ConstantTimeCompare([]byte(claims.State), []byte(query.Get("state"))) != 1 {
+		err = errors.New("state does not match")
+	}
+	// Using the sign-in up is a single insert, so a callback replayed
+	// alongside the real one cannot also get through.
+	if err == nil {
+		err = cfg.store.RevokeAccessToken(claims.ID, claims.ExpiresAt.Time)
+		if err != nil && err != errAlreadyRevoked {
+			fmt.Printf("Error using OIDC sign-in: %s\n", err)
+			w.WriteHeader(500)
+			return
+		}
+	}
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte("Sign-in has expired or was started elsewhere, please start again\n"))
+		return
+	}
+	if reason := query.Get("error"); reason != "" {
+		w.WriteHeader(401)
+		w.Write([]byte(fmt.Sprintf("The identity provider did not sign you in: %s %s\n", reason, query.Get("error_description"))))
+		return
+	}
+
+	discovery, err := cfg.oidc.discover()
+	if err != nil {
+		fmt.Printf("Could not discover OIDC provider: %s\n", err)
+		w.WriteHeader(502)
+		w.Write([]byte("Could not reach the identity provider\n"))
+		return
+	}
+	idToken, err := cfg.oidc.exchange(discovery.TokenEndpoint, query.Get("code"), claims.Verifier)
+	if err != nil {
+		fmt.Printf("Could not redeem OIDC authorization code: %s\n", err)
+		w.WriteHeader(502)
+		w.Write([]byte("Could not complete sign-in with the identity provider\n"))
+		return
+	}
+	identity, err := cfg.oidc.verifyIDToken(idToken, claims.Nonce, cfg.jwtLeeway)
+	if err != nil {
+		fmt.Printf("Rejected OIDC ID token: %s\n", err)
+		w.WriteHeader(401)
+		w.Write([]byte("The identity provider's answer could not be verified\n"))
+		return
+	}
+	user, ok := cfg.federatedUser(w, r, identity)
+	if !ok {
+		return
+	}
+	if cfg.oidc.appURL != "" {
+		cfg.handOffOIDCLogin(w, r, user, claims.Expiry, claims.Device)
+		return
+	}
+	if user.TOTPSecret != "" {
+		cfg.writeTwoFactorChallenge(w, user, claims.Expiry, claims.Device)
+		return
+	}
+	cfg.startSession(w, r, user, claims.Expiry, claims.Device)
+}
+
+// oidcHandoffClaims make up the one-time code a finished sign-in hands to
+// the app, carrying what the session is to be started with.
+type oidcHandoffClaims struct {
+	jwt.RegisteredClaims
+	Expiry int    `json:"expires_in_seconds,omitempty"`
+	Device string `json:"device,omitempty"`
+}
+
+func (cfg *apiConfig) validateOIDCHandoff(tokenString string) (*oidcHandoffClaims, error) {
+	claims := &oidcHandoffClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, cfg.keys.keyfunc,
+		jwt.WithValidMethods([]string{algEdDSA, algRS256}),
+		jwt.WithIssuer(cfg.issuer),
+		jwt.WithAudience(oidcHandoffAudience),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(cfg.jwtLeeway),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if claims.ID == "" {
+		return nil, errors.New("sign-in code is missing claims")
+	}
+	return claims, nil
+}
+
+// handOffOIDCLogin sends the browser to the app with a short-lived code
+// for user, which the app trades for a session at /api/login/oidc/exchange.
+func (cfg *apiConfig) handOffOIDCLogin(w http.ResponseWriter, r *http.Request, user User, expiry int, device string) {
+	target, err := url.Parse(cfg.oidc.appURL)
+	if err != nil {
+		fmt.Printf("OIDC app URL is not a URL: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+	now := time.Now().UTC()
+	code, err := cfg.keys.sign(oidcHandoffClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    cfg.issuer,
+			Audience:  jwt.ClaimStrings{oidcHandoffAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(oidcHandoffTTL)),
+			Subject:   strconv.Itoa(user.Id),
+			ID:        newTokenId(),
+		},
+		Expiry: expiry,
+		Device: device,
+	})
+	if err != nil {
+		fmt.Printf("Something is wrong with creating an OIDC sign-in code: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+	query := target.Query()
+	query.Set("code", code)
+	target.RawQuery = query.Encode()
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+// exchangeOIDCCode trades the code a sign-in handed to the app for a
+// session, or a two-factor challenge. Each code works once.
+func (cfg *apiConfig) exchangeOIDCCode(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Code string `json:"code"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	if err := decoder.Decode(&params); err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	claims, err := cfg.validateOIDCHandoff(params.Code)
+	if err == nil {
+		err = cfg.store.RevokeAccessToken(claims.ID, claims.ExpiresAt.Time)
+		if err != nil && err != errAlreadyRevoked {
+			fmt.Printf("Error using OIDC sign-in code: %s\n", err)
+			w.WriteHeader(500)
+			return
+		}
+	}
+	var user User
+	if err == nil {
+		var uid int
+		uid, err = strconv.Atoi(claims.Subject)
+		if err == nil {
+			user, err = cfg.store.GetUser(uid)
+		}
+	}
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte("Sign-in code is invalid or has expired, please sign in again\n"))
+		return
+	}
+	if user.TOTPSecret != "" {
+		cfg.writeTwoFactorChallenge(w, user, claims.Expiry, claims.Device)
+		return
+	}
+	cfg.startSession(w, r, user, claims.Expiry, claims.Device)
+}
+
+// federatedUser finds the account a verified identity signs in to. An
+// identity that has been linked to an account always gets that account.
+// Otherwise the account using the same email address is linked to it, but
+// only if the provider vouches for the address and the account has
+// verified it too, since whoever registered an unverified account may not
+// own the address. With auto provisioning on, an address with no account
+// gets a new one, whose password is random so only a reset can set one.
+// It writes the response and returns false if there is no account to use.
+func (cfg *apiConfig) federatedUser(w http.ResponseWriter, r *http.Request, identity *idTokenClaims) (User, bool) {
+	issuer := cfg.oidc.issuer
+	user, err := cfg.store.GetUserByOIDCSubject(issuer, identity.Subject)
+	if err == nil {
+		return user, true
+	}
+	if err != errNotFound {
+		fmt.Printf("Error looking up federated user: %s\n", err)
+		w.WriteHeader(500)
+		return User{}, false
+	}
+	if identity.Email == "" || !bool(identity.EmailVerified) {
+		w.WriteHeader(403)
+		w.Write([]byte("Your identity provider has not verified your email address\n"))
+		return User{}, false
+	}
+
+	user, err = cfg.store.GetUserByEmail(identity.Email)
+	switch {
+	case err == nil && user.OIDCSubject != "":
+		w.WriteHeader(409)
+		w.Write([]byte("The account using this address is linked to a different identity\n"))
+		return User{}, false
+	case err == nil && !user.EmailVerified:
+		w.WriteHeader(409)
+		w.Write([]byte("The account using this address has not verified it yet, verify it or reset its password first\n"))
+		return User{}, false
+	case err == nil:
+		user, err = cfg.store.UpdateUserFunc(user.Id, func(user *User) error {
+			if user.OIDCSubject != "" {
+				return errIdentityLinked
+			}
+			user.OIDCIssuer = issuer
+			user.OIDCSubject = identity.Subject
+			return nil
+		})
+		if err == errIdentityLinked {
+			w.WriteHeader(409)
+			w.Write([]byte("The account using this address is linked to a different identity\n"))
+			return User{}, false
+		}
+		if err != nil {
+			fmt.Printf("There was an error linking user %d to their identity: %s\n", user.Id, err)
+			w.WriteHeader(500)
+			return User{}, false
+		}
+		cfg.audit.record(auditEvent{Event: "oidc.account_linked", UserId: user.Id, Email: user.Email, IP: clientIP(r), Detail: issuer})
+		return user, true
+	case err == errNotFound && cfg.oidc.autoProvision:
+		hash, err := cfg.passwords.Hash(newRefreshToken())
+		if err != nil {
+			fmt.Printf("There was an error generating a password hash: %s\n", err)
+			w.WriteHeader(500)
+			return User{}, false
+		}
+		user, err = cfg.store.CreateUser(User{
+			Email:         identity.Email,
+			PasswordHash:  hash,
+			EmailVerified: true,
+			OIDCIssuer:    issuer,
+			OIDCSubject:   identity.Subject,
+		})
+		if err == errDuplicateEmail {
+			w.WriteHeader(409)
+			w.Write([]byte("An account was created for this address at the same time, please sign in again\n"))
+			return User{}, false
+		}
+		if err != nil {
+			fmt.Printf("There was an error saving new federated user: %s\n", err)
+			w.WriteHeader(500)
+			return User{}, false
+		}
+		cfg.audit.record(auditEvent{Event: "oidc.account_provisioned", UserId: user.Id, Email: user.Email, IP: clientIP(r), Detail: issuer})
+		return user, true
+	case err == errNotFound:
+		w.WriteHeader(403)
+		w.Write([]byte("No Chirpy account uses your email address\n"))
+		return User{}, false
+	}
+	fmt.Printf("Error looking up user for federated login: %s\n", err)
+	w.WriteHeader(500)
+	return User{}, false
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testOIDCClientId = "chirpy-test-client"
+
+// fakeIdP is an OpenID Connect provider serving discovery, its keys and a
+// token endpoint. The token endpoint checks the PKCE verifier against the
+// last authorization request and answers with an ID token made from
+// claims.
+type fakeIdP struct {
+	server *httptest.Server
+	keys   *keyring
+
+	mu          sync.Mutex
+	challenge   string
+	claims      idTokenClaims
+	keyFetches  int
+	codesIssued int
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	t.Helper()
+	keys, err := loadKeyring(filepath.Join(t.TempDir(), keyringFile), algEdDSA, 1)
+	if err != nil {
+		t.Fatalf("loading provider keyring: %s", err)
+	}
+	f := &fakeIdP{keys: keys}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                f.server.URL,
+			AuthorizationEndpoint: f.server.URL + "/authorize",
+			TokenEndpoint:         f.server.URL + "/token",
+			JWKSURI:               f.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.keyFetches++
+		f.mu.Unlock()
+		json.NewEncoder(w).Encode(f.keys.jwks())
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if r.PostFormValue("code") != "provider-code" || base64.RawURLEncoding.EncodeToString(sum[:]) != f.challenge {
+			w.WriteHeader(400)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		idToken, err := f.keys.sign(f.claims)
+		if err != nil {
+			w.WriteHeader(500)
+			return
+		}
+		f.codesIssued++
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idToken})
+	})
+	f.server = httptest.NewServer(mux)
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+// newOIDCTestConfig sets up an apiConfig that logs in through f.
+func newOIDCTestConfig(t *testing.T, f *fakeIdP) *apiConfig {
+	t.Helper()
+	cfg := newTestConfig(t)
+	provider, err := newOIDCProvider(f.server.URL, testOIDCClientId, "", "http://chirpy.test/api/login/oidc/callback", []string{"openid", "email"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.oidc = provider
+	return cfg
+}
+
+// oidcSignIn is a sign-in started at /api/login/oidc, as the browser
+// holds it while at the provider.
+type oidcSignIn struct {
+	cookie *http.Cookie
+	state  string
+	nonce  string
+}
+
+func startOIDCSignIn(t *testing.T, handler http.Handler, f *fakeIdP) oidcSignIn {
+	t.Helper()
+	rec := doRequest(t, handler, "GET", "/api/login/oidc", "", nil)
+	if rec.Code != 302 {
+		t.Fatalf("starting sign-in: got %d %q", rec.Code, rec.Body.String())
+	}
+	target, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil || !strings.HasPrefix(target.String(), f.server.URL+"/authorize") {
+		t.Fatalf("starting sign-in: redirected to %q", rec.Header().Get("Location"))
+	}
+	query := target.Query()
+	if query.Get("client_id") != testOIDCClientId || query.Get("code_challenge_method") != "S256" {
+		t.Fatalf("starting sign-in: authorization request %v", query)
+	}
+	f.mu.Lock()
+	f.challenge = query.Get("code_challenge")
+	f.mu.Unlock()
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != oidcLoginCookie {
+		t.Fatalf("starting sign-in: got cookies %v", cookies)
+	}
+	return oidcSignIn{cookie: cookies[0], state: query.Get("state"), nonce: query.Get("nonce")}
+}
+
+// finish comes back from the provider to the callback with state.
+func (s oidcSignIn) finish(t *testing.T, handler http.Handler, state string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/api/login/oidc/callback?"+url.Values{
+		"code":  {"provider-code"},
+		"state": {state},
+	}.Encode(), nil)
+	if s.cookie != nil {
+		req.AddCookie(s.cookie)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// identity is the ID token a sign-in gets back unless a test changes it.
+func (f *fakeIdP) identity(s oidcSignIn, subject, email string) idTokenClaims {
+	now := time.Now().UTC()
+	return idTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    f.server.URL,
+			Subject:   subject,
+			Audience:  jwt.ClaimStrings{testOIDCClientId},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(5 * time.Minute)),
+		},
+		Nonce:         s.nonce,
+		Email:         email,
+		EmailVerified: true,
+	}
+}
+
+// signIn goes through a whole sign-in with the provider answering with
+// claims made by identity and then changed by edit, if set.
+func signIn(t *testing.T, handler http.Handler, f *fakeIdP, subject, email string, edit func(*idTokenClaims)) *httptest.ResponseRecorder {
+	t.Helper()
+	s := startOIDCSignIn(t, handler, f)
+	claims := f.identity(s, subject, email)
+	if edit != nil {
+		edit(&claims)
+	}
+	f.mu.Lock()
+	f.claims = claims
+	f.mu.Unlock()
+	return s.finish(t, handler, s.state)
+}
+
+func TestOIDCLoginLinksVerifiedAccount(t *testing.T) {
+	f := newFakeIdP(t)
+	cfg := newOIDCTestConfig(t, f)
+	handler := cfg.routes()
+	user := createTestUser(t, cfg, "linked@example.com")
+
+	rec := signIn(t, handler, f, "subject-1", "Linked@example.com", nil)
+	if rec.Code != 200 {
+		t.Fatalf("first sign-in: got %d %q", rec.Code, rec.Body.String())
+	}
+	if cc := rec.Header().Get("Cache-Control"); cc != "no-store" {
+		t.Errorf("sign-in response has Cache-Control %q, want no-store", cc)
+	}
+	session := loginResponse{}
+	decodeBody(t, rec, &session)
+	if code := getMe(t, handler, session.Token); code != 200 {
+		t.Errorf("access token from sign-in: got %d, want 200", code)
+	}
+	if !hasAuditEvent(t, cfg, "oidc.account_linked", user.Id) {
+		t.Errorf("linking was not recorded in the audit log")
+	}
+
+	// Once linked, the identity signs in to the account whatever address
+	// the provider reports.
+	if rec := signIn(t, handler, f, "subject-1", "renamed@example.com", nil); rec.Code != 200 {
+		t.Errorf("sign-in after the provider's address changed: got %d %q", rec.Code, rec.Body.String())
+	}
+	// And the account cannot be taken over by another identity.
+	if rec := signIn(t, handler, f, "subject-2", user.Email, nil); rec.Code != 409 {
+		t.Errorf("another identity with the account's address: got %d, want 409", rec.Code)
+	}
+}
+
+func TestOIDCLoginDoesNotLinkUnverifiedAddresses(t *testing.T) {
+	f := newFakeIdP(t)
+	cfg := newOIDCTestConfig(t, f)
+	handler := cfg.routes()
+	hash, _ := cfg.passwords.Hash(testPassword)
+	if _, err := cfg.store.CreateUser(User{Email: "squatter@example.com", PasswordHash: hash}); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := signIn(t, handler, f, "subject-1", "squatter@example.com", nil); rec.Code != 409 {
+		t.Errorf("account with an unverified address: got %d, want 409", rec.Code)
+	}
+	unverified := func(c *idTokenClaims) { c.EmailVerified = false }
+	if rec := signIn(t, handler, f, "subject-1", "someone@example.com", unverified); rec.Code != 403 {
+		t.Errorf("address the provider has not verified: got %d, want 403", rec.Code)
+	}
+}
+
+func TestOIDCLoginAutoProvisions(t *testing.T) {
+	f := newFakeIdP(t)
+	cfg := newOIDCTestConfig(t, f)
+	handler := cfg.routes()
+
+	if rec := signIn(t, handler, f, "subject-1", "newcomer@example.com", nil); rec.Code != 403 {
+		t.Fatalf("unknown address without auto provisioning: got %d, want 403", rec.Code)
+	}
+	cfg.oidc.autoProvision = true
+	if rec := signIn(t, handler, f, "subject-1", "newcomer@example.com", nil); rec.Code != 200 {
+		t.Fatalf("unknown address with auto provisioning: got %d %q", rec.Code, rec.Body.String())
+	}
+	user, err := cfg.store.GetUserByOIDCSubject(f.server.URL, "subject-1")
+	if err != nil || user.Email != "newcomer@example.com" || !user.EmailVerified {
+		t.Fatalf("provisioned user: got %+v, %v", user, err)
+	}
+	if !hasAuditEvent(t, cfg, "oidc.account_provisioned", user.Id) {
+		t.Errorf("provisioning was not recorded in the audit log")
+	}
+}
+
+func TestOIDCLoginRejectsBadIDTokens(t *testing.T) {
+	f := newFakeIdP(t)
+	cfg := newOIDCTestConfig(t, f)
+	handler := cfg.routes()
+	createTestUser(t, cfg, "victim@example.com")
+
+	tests := []struct {
+		name string
+		edit func(*idTokenClaims)
+	}{
+		{"wrong nonce", func(c *idTokenClaims) { c.Nonce = "replayed-nonce" }},
+		{"no nonce", func(c *idTokenClaims) { c.Nonce = "" }},
+		{"wrong audience", func(c *idTokenClaims) { c.Audience = jwt.ClaimStrings{"another-client"} }},
+		{"several audiences without azp", func(c *idTokenClaims) {
+			c.Audience = jwt.ClaimStrings{testOIDCClientId, "another-client"}
+		}},
+		{"azp for another client", func(c *idTokenClaims) { c.AuthorizedParty = "another-client" }},
+		{"wrong issuer", func(c *idTokenClaims) { c.Issuer = "https://evil.example.com" }},
+		{"expired", func(c *idTokenClaims) { c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Hour)) }},
+		{"no subject", func(c *idTokenClaims) { c.Subject = "" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := signIn(t, handler, f, "subject-1", "victim@example.com", tt.edit); rec.Code != 401 {
+				t.Errorf("got %d %q, want 401", rec.Code, rec.Body.String())
+			}
+		})
+	}
+
+	several := func(c *idTokenClaims) {
+		c.Audience = jwt.ClaimStrings{testOIDCClientId, "another-client"}
+		c.AuthorizedParty = testOIDCClientId
+	}
+	if rec := signIn(t, handler, f, "subject-1", "victim@example.com", several); rec.Code != 200 {
+		t.Errorf("several audiences with azp for Chirpy: got %d %q, want 200", rec.Code, rec.Body.String())
+	}
+}
+
+// A token signed with a key the provider has rotated in makes Chirpy fetch
+// the keys again, but not more than once per oidcKeysRefetchInterval.
+func TestOIDCLoginRefetchesKeysForUnknownKid(t *testing.T) {
+	f := newFakeIdP(t)
+	cfg := newOIDCTestConfig(t, f)
+	handler := cfg.routes()
+	createTestUser(t, cfg, "rotated@example.com")
+
+	if rec := signIn(t, handler, f, "subject-1", "rotated@example.com", nil); rec.Code != 200 {
+		t.Fatalf("sign-in: got %d %q", rec.Code, rec.Body.String())
+	}
+	if err := f.keys.rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if rec := signIn(t, handler, f, "subject-1", "rotated@example.com", nil); rec.Code != 401 {
+		t.Errorf("new key right after a fetch: got %d, want 401", rec.Code)
+	}
+
+	cfg.oidc.mu.Lock()
+	cfg.oidc.keysFetchedAt = time.Now().Add(-oidcKeysRefetchInterval)
+	cfg.oidc.mu.Unlock()
+	if rec := signIn(t, handler, f, "subject-1", "rotated@example.com", nil); rec.Code != 200 {
+		t.Errorf("new key once the interval has passed: got %d %q, want 200", rec.Code, rec.Body.String())
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.keyFetches != 2 {
+		t.Errorf("keys fetched %d times, want 2", f.keyFetches)
+	}
+}
+
+func TestOIDCLoginAsksForSecondFactor(t *testing.T) {
+	f := newFakeIdP(t)
+	cfg := newOIDCTestConfig(t, f)
+	handler := cfg.routes()
+	user := createTestUser(t, cfg, "careful@example.com")
+	codes := enableTwoFactor(t, cfg, user)
+
+	rec := signIn(t, handler, f, "subject-1", user.Email, nil)
+	out := struct {
+		Token          string `json:"token"`
+		ChallengeToken string `json:"challenge_token"`
+	}{}
+	decodeBody(t, rec, &out)
+	if rec.Code != 200 || out.Token != "" || out.ChallengeToken == "" {
+		t.Fatalf("sign-in: got %d %q, want a two-factor challenge", rec.Code, rec.Body.String())
+	}
+	rec = doRequest(t, handler, "POST", "/api/login/2fa", "", map[string]string{
+		"challenge_token": out.ChallengeToken,
+		"code":            codes[0],
+	})
+	if rec.Code != 200 {
+		t.Errorf("answering the challenge: got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+// The callback only works for the browser that started the sign-in, with
+// the state it was given, and once.
+func TestOIDCLoginChecksState(t *testing.T) {
+	f := newFakeIdP(t)
+	cfg := newOIDCTestConfig(t, f)
+	handler := cfg.routes()
+	user := createTestUser(t, cfg, "state@example.com")
+
+	start := func() oidcSignIn {
+		s := startOIDCSignIn(t, handler, f)
+		f.mu.Lock()
+		f.claims = f.identity(s, "subject-1", user.Email)
+		f.mu.Unlock()
+		return s
+	}
+	s := start()
+	if rec := s.finish(t, handler, "another-state"); rec.Code != 400 {
+		t.Errorf("wrong state: got %d, want 400", rec.Code)
+	}
+	s = start()
+	noCookie := oidcSignIn{state: s.state}
+	if rec := noCookie.finish(t, handler, s.state); rec.Code != 400 {
+		t.Errorf("no cookie: got %d, want 400", rec.Code)
+	}
+	if rec := s.finish(t, handler, s.state); rec.Code != 200 {
+		t.Fatalf("right state: got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := s.finish(t, handler, s.state); rec.Code != 400 {
+		t.Errorf("replayed callback: got %d, want 400", rec.Code)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.codesIssued != 1 {
+		t.Errorf("provider redeemed %d codes, want only the one sign-in's", f.codesIssued)
+	}
+}
+
+// With an app URL set, the callback sends the browser there with a code
+// instead of the tokens, and the app trades the code for a session once.
+func TestOIDCLoginHandsOffToApp(t *testing.T) {
+	f := newFakeIdP(t)
+	cfg := newOIDCTestConfig(t, f)
+	cfg.oidc.appURL = "https://app.example.com/signed-in?from=chirpy"
+	handler := cfg.routes()
+	createTestUser(t, cfg, "handoff@example.com")
+
+	rec := signIn(t, handler, f, "subject-1", "handoff@example.com", nil)
+	if rec.Code != 302 || strings.Contains(rec.Body.String(), "refresh_token") {
+		t.Fatalf("sign-in: got %d %q, want a redirect to the app", rec.Code, rec.Body.String())
+	}
+	target, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil || target.Host != "app.example.com" || target.Query().Get("from") != "chirpy" {
+		t.Fatalf("sign-in: redirected to %q", rec.Header().Get("Location"))
+	}
+	code := target.Query().Get("code")
+
+	rec = doRequest(t, handler, "POST", "/api/login/oidc/exchange", "", map[string]string{"code": code})
+	if rec.Code != 200 || rec.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("exchanging the code: got %d %q", rec.Code, rec.Body.String())
+	}
+	session := loginResponse{}
+	decodeBody(t, rec, &session)
+	if code := getMe(t, handler, session.Token); code != 200 {
+		t.Errorf("access token from the exchange: got %d, want 200", code)
+	}
+	if rec := doRequest(t, handler, "POST", "/api/login/oidc/exchange", "", map[string]string{"code": code}); rec.Code != 400 {
+		t.Errorf("exchanging the code again: got %d, want 400", rec.Code)
+	}
+	if rec := doRequest(t, handler, "POST", "/api/login/oidc/exchange", "", map[string]string{"code": session.Token}); rec.Code != 400 {
+		t.Errorf("exchanging an access token: got %d, want 400", rec.Code)
+	}
+}
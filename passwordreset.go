@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+const (
+	passwordResetTTL           = 30 * time.Minute
+	passwordResetPruneInterval = 10 * time.Minute
+	resetRequestEmailLimit     = 3
+	resetRequestIPLimit        = 10
+	resetRequestWindow         = time.Hour
+)
+
+// PasswordReset is an outstanding request to reset a user's password. Token
+// is the hash of the secret that was mailed out, as with refresh tokens.
+type PasswordReset struct {
+	Token     string
+	UserId    int
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// PasswordResets maps the hash of each reset token to its request.
+type PasswordResets struct {
+	Resets map[string]PasswordReset
+}
+
+// readPasswordResets loads outstanding resets, treating a missing file as
+// none since data directories from before password resets have none.
+func readPasswordResets(file string) (PasswordResets, error) {
+	resets := PasswordResets{}
+	err := readJSONFile(file, &resets)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return resets, err
+	}
+	if resets.Resets == nil {
+		resets.Resets = make(map[string]PasswordReset)
+	}
+	return resets, nil
+}
+
+func savePasswordResets(file string, resets PasswordResets) error {
+	return writeJSONFile(file, &resets)
+}
+
+// prunePasswordResetsEvery drops expired reset requests on a timer for the
+// life of the process.
+func (cfg *apiConfig) prunePasswordResetsEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			pruned, err := cfg.store.PrunePasswordResets(time.Now().UTC())
+			if err != nil {
+				fmt.Printf("Failed to prune password resets: %s\n", err)
+				continue
+			}
+			if pruned > 0 {
+				fmt.Printf("Pruned %d expired password resets\n", pruned)
+			}
+		}
+	}()
+}
+
+// requestPasswordReset mails a reset link to the address given, if it
+// belongs to an account. The response is the same either way, and the
+// lookup and mail happen after it is sent, so neither the body nor the
+// timing gives away which addresses have accounts.
+func (cfg *apiConfig) requestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Email string `json:"email"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil || params.Email == "" {
+		log.Printf("Error decoding parameters: %v", err)
+		w.WriteHeader(400)
+		return
+	}
+
+	ip := clientIP(r)
+	now := time.Now().UTC()
+	if ok, wait := cfg.resetRequestIPs.allow(ip, now); !ok {
+		writeTooManyRequests(w, wait, "Too many password reset requests, try again later")
+		return
+	}
+	if ok, wait := cfg.resetRequests.allow(throttleKey(params.Email), now); !ok {
+		writeTooManyRequests(w, wait, "Too many password reset requests, try again later")
+		return
+	}
+	go cfg.sendPasswordReset(params.Email, ip)
+
+	w.WriteHeader(202)
+	w.Write([]byte("If an account uses that address, a reset link is on its way\n"))
+}
+
+// sendPasswordReset stores a new reset request for the account using
+// email and mails its link. Failures can only be logged, since the client
+// has already had its answer.
+func (cfg *apiConfig) sendPasswordReset(email, ip string) {
+	user, err := cfg.store.GetUserByEmail(email)
+	if err == errNotFound {
+		cfg.audit.record(auditEvent{Event: "password.reset_requested", Email: email, IP: ip, Detail: "no such account"})
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error looking up user for password reset: %s\n", err)
+		return
+	}
+
+	secret := newRefreshToken()
+	now := time.Now().UTC()
+	err = cfg.store.SavePasswordReset(PasswordReset{
+		Token:     hashRefreshToken(secret),
+		UserId:    user.Id,
+		CreatedAt: now,
+		ExpiresAt: now.Add(passwordResetTTL),
+	})
+	if err != nil {
+		fmt.Printf("Error saving password reset for user %d: %s\n", user.Id, err)
+		return
+	}
+	link := getPasswordResetURL() + "?token=" + url.QueryEscape(secret)
+	err = cfg.mailer.Send(mailMessage{
+		To:      user.Email,
+		Subject: "Reset your Chirpy password",
+		Body: fmt.Sprintf("Follow this link within %s to choose a new password:\n\n%s\n\n"+
+			"If you did not ask for this, you can ignore this email and your password will stay the same.\n",
+			passwordResetTTL, link),
+	})
+	if err != nil {
+		fmt.Printf("Could not send password reset to user %d: %s\n", user.Id, err)
+		return
+	}
+	cfg.audit.record(auditEvent{Event: "password.reset_requested", UserId: user.Id, Email: user.Email, IP: ip})
+}
+
+// confirmPasswordReset sets a new password using the token from a reset
+// link. The token is only used up once the new password has passed the
+// policy, so a rejected password can be retried with the same link. Every
+// session is ended, since whoever knew the old password may hold one, and
+// the access tokens handed out for them stop working along with them.
+// Personal access tokens are revoked for the same reason.
+func (cfg *apiConfig) confirmPasswordReset(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Token       string `json:"token"`
+		NewPassword string `json:"new_password"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		log.Printf("Error decoding parameters: %s", err)
+		w.WriteHeader(400)
+		return
+	}
+
+	hash := hashRefreshToken(params.Token)
+	reset, err := cfg.store.GetPasswordReset(hash)
+	if err != nil && err != errNotFound {
+		fmt.Printf("Error reading password reset: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+	var user User
+	if err == nil && reset.ExpiresAt.After(time.Now().UTC()) {
+		user, err = cfg.store.GetUser(reset.UserId)
+	}
+	if err != nil || user.Id == 0 {
+		w.WriteHeader(400)
+		w.Write([]byte("Reset link is invalid or has expired\n"))
+		return
+	}
+	if violations := cfg.passwordPolicy.check(params.NewPassword, user.Email); len(violations) > 0 {
+		writePolicyViolations(w, violations)
+		return
+	}
+	passwordHash, err := cfg.passwords.Hash(params.NewPassword)
+	if err != nil {
+		fmt.Printf("There was an error generating a password hash: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	// Another request may have used the token since it was looked up.
+	if _, err := cfg.store.TakePasswordReset(hash); err != nil {
+		if err != errNotFound {
+			fmt.Printf("Error using password reset: %s\n", err)
+		}
+		w.WriteHeader(400)
+		w.Write([]byte("Reset link is invalid or has expired\n"))
+		return
+	}
+	_, err = cfg.store.UpdateUserFunc(user.Id, func(user *User) error {
+		user.PasswordHash = passwordHash
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("There was an error saving updated user: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+	if err := cfg.store.DeleteUserRefreshTokens(user.Id); err != nil {
+		fmt.Printf("Error ending sessions for user %d after password reset: %s\n", user.Id, err)
+	}
+	if err := cfg.store.DeleteUserPersonalAccessTokens(user.Id); err != nil {
+		fmt.Printf("Error revoking personal access tokens for user %d after password reset: %s\n", user.Id, err)
+	}
+	cfg.throttle.succeed(user.Email)
+	cfg.audit.record(auditEvent{
+		Event:  "password.reset",
+		UserId: user.Id,
+		Email:  user.Email,
+		IP:     clientIP(r),
+	})
+	w.WriteHeader(204)
+}
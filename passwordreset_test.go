@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var mailLinkPattern = regexp.MustCompile(`https?://\S+`)
+
+// The mailed link opens the reset page, and using it ends every session
+// along with the access tokens handed out for them, and revokes personal
+// access tokens.
+func TestPasswordResetEndsSessions(t *testing.T) {
+	cfg := newTestConfig(t)
+	handler := cfg.routes()
+	user := createTestUser(t, cfg, "forgetful@example.com")
+	session := login(t, handler, user.Email)
+	pat := createPAT(t, handler, session.Token)
+
+	cfg.sendPasswordReset(user.Email, "192.0.2.1")
+	msg, ok := cfg.mailer.(*testMailer).last()
+	if !ok {
+		t.Fatal("no reset mail was sent")
+	}
+	link, err := url.Parse(mailLinkPattern.FindString(msg.Body))
+	if err != nil {
+		t.Fatalf("parsing reset link in %q: %s", msg.Body, err)
+	}
+	page := doRequest(t, handler, "GET", link.Path, "", nil)
+	if page.Code != 200 || !strings.Contains(page.Body.String(), "/api/password-reset/confirm") {
+		t.Fatalf("GET %s: got %d, want the reset page", link.Path, page.Code)
+	}
+
+	rec := doRequest(t, handler, "POST", "/api/password-reset/confirm", "", map[string]string{
+		"token":        link.Query().Get("token"),
+		"new_password": "an-entirely-new-password",
+	})
+	if rec.Code != 204 {
+		t.Fatalf("confirming reset: got %d %q", rec.Code, rec.Body.String())
+	}
+	if code := getMe(t, handler, session.Token); code != 401 {
+		t.Errorf("access token from before the reset: got %d, want 401", code)
+	}
+	if code := getMe(t, handler, pat); code != 401 {
+		t.Errorf("personal access token from before the reset: got %d, want 401", code)
+	}
+	if rec := doRequest(t, handler, "POST", "/api/refresh", session.RefreshToken, nil); rec.Code != 401 {
+		t.Errorf("refresh token from before the reset: got %d, want 401", rec.Code)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	hasherBcrypt   = "bcrypt"
+	hasherArgon2id = "argon2id"
+)
+
+var errPasswordMismatch = errors.New("password does not match")
+
+// PasswordHasher hashes and checks user passwords. NeedsRehash reports
+// whether a stored hash was made with other settings than the hasher would
+// use now, so it can be replaced the next time the password is known.
+type PasswordHasher interface {
+	Hash(password string) ([]byte, error)
+	Verify(hash []byte, password string) error
+	NeedsRehash(hash []byte) bool
+}
+
+// newPasswordHasher returns a hasher that hashes with alg but can verify
+// hashes made by either algorithm, so switching PASSWORD_HASHER moves
+// users over as they log in.
+func newPasswordHasher(alg string, bcryptCost int) (PasswordHasher, error) {
+	hashers := migratingHasher{
+		bcrypt:   bcryptHasher{cost: bcryptCost},
+		argon2id: defaultArgon2idHasher,
+	}
+	switch alg {
+	case hasherBcrypt:
+		hashers.current = hashers.bcrypt
+	case hasherArgon2id:
+		hashers.current = hashers.argon2id
+	default:
+		return nil, fmt.Errorf("unsupported password hasher %q", alg)
+	}
+	return hashers, nil
+}
+
+type migratingHasher struct {
+	current  PasswordHasher
+	bcrypt   bcryptHasher
+	argon2id argon2idHasher
+}
+
+func (h migratingHasher) Hash(password string) ([]byte, error) {
+	return h.current.Hash(password)
+}
+
+func (h migratingHasher) Verify(hash []byte, password string) error {
+	if bytes.HasPrefix(hash, []byte(argon2idPrefix)) {
+		return h.argon2id.Verify(hash, password)
+	}
+	return h.bcrypt.Verify(hash, password)
+}
+
+func (h migratingHasher) NeedsRehash(hash []byte) bool {
+	return h.current.NeedsRehash(hash)
+}
+
+type bcryptHasher struct {
+	cost int
+}
+
+func (h bcryptHasher) Hash(password string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(password), h.cost)
+}
+
+func (h bcryptHasher) Verify(hash []byte, password string) error {
+	err := bcrypt.CompareHashAndPassword(hash, []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return errPasswordMismatch
+	}
+	return err
+}
+
+func (h bcryptHasher) NeedsRehash(hash []byte) bool {
+	cost, err := bcrypt.Cost(hash)
+	return err != nil || cost < h.cost
+}
+
+const argon2idPrefix = "$argon2id$"
+
+// argon2idHasher stores hashes in the PHC string format,
+// $argon2id$v=19$m=<KiB>,t=<passes>,p=<lanes>$<salt>$<key>.
+type argon2idHasher struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	keyLen  uint32
+	saltLen int
+}
+
+// defaultArgon2idHasher follows the second recommended option of RFC 9106.
+var defaultArgon2idHasher = argon2idHasher{
+	memory:  64 * 1024,
+	time:    3,
+	threads: 4,
+	keyLen:  32,
+	saltLen: 16,
+}
+
+func (h argon2idHasher) Hash(password string) ([]byte, error) {
+	salt := make([]byte, h.saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.time, h.memory, h.threads, h.keyLen)
+	b64 := base64.RawStdEncoding
+	return []byte(fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version,
+		h.memory, h.time, h.threads, b64.EncodeToString(salt), b64.EncodeToString(key))), nil
+}
+
+// decode splits an encoded hash into the settings it was made with, its
+// salt and its key.
+func (h argon2idHasher) decode(hash []byte) (argon2idHasher, []byte, []byte, error) {
+	params := argon2idHasher{}
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 || parts[1] != hasherArgon2id {
+		return params, nil, nil, errors.New("not an argon2id hash")
+	}
+	version := 0
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2 version %q", parts[2])
+	}
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads)
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("bad argon2id parameters %q", parts[3])
+	}
+	b64 := base64.RawStdEncoding
+	salt, err := b64.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	key, err := b64.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	params.saltLen = len(salt)
+	params.keyLen = uint32(len(key))
+	return params, salt, key, nil
+}
+
+func (h argon2idHasher) Verify(hash []byte, password string) error {
+	params, salt, key, err := h.decode(hash)
+	if err != nil {
+		return err
+	}
+	got := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, params.keyLen)
+	if subtle.ConstantTimeCompare(got, key) != 1 {
+		return errPasswordMismatch
+	}
+	return nil
+}
+
+func (h argon2idHasher) NeedsRehash(hash []byte) bool {
+	params, _, _, err := h.decode(hash)
+	if err != nil {
+		return true
+	}
+	return params.memory < h.memory || params.time < h.time || params.threads != h.threads ||
+		params.keyLen < h.keyLen || params.saltLen < h.saltLen
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	patPrefix               = "chirpy_pat_"
+	patDefaultTTLDays       = 90
+	patMaxTTLDays           = 365
+	patMaxNameLength        = 100
+	scopeChirpsWrite        = "chirps:write"
+	scopeChirpsDelete       = "chirps:delete"
+	scopeUsersRead          = "users:read"
+	maxPersonalAccessTokens = 50
+)
+
+// tokenScopes are the scopes a personal access token or OAuth client can be
+// given. A token can only use the routes that ask for one of its scopes.
+var tokenScopes = []string{scopeChirpsWrite, scopeChirpsDelete, scopeUsersRead}
+
+// PersonalAccessToken is a long-lived credential a user creates for a bot
+// or integration. Token is the hash of the secret, which is only shown once
+// when the token is created.
+type PersonalAccessToken struct {
+	Id        string
+	UserId    int
+	Name      string
+	Token     string
+	Scopes    []string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// PersonalAccessTokens maps each token's id to the token.
+type PersonalAccessTokens struct {
+	Tokens map[string]PersonalAccessToken
+}
+
+// PersonalAccessTokenInfo is what a user is shown of one of their tokens.
+// Token, the secret, is only filled in on the response that creates it.
+type PersonalAccessTokenInfo struct {
+	Id        string    `json:"id"`
+	Name      string    `json:"name"`
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Token     string    `json:"token,omitempty"`
+}
+
+// readPersonalAccessTokens loads the tokens, treating a missing file as
+// none since data directories from before personal access tokens have none.
+func readPersonalAccessTokens(file string) (PersonalAccessTokens, error) {
+	tokens := PersonalAccessTokens{}
+	err := readJSONFile(file, &tokens)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return tokens, err
+	}
+	if tokens.Tokens == nil {
+		tokens.Tokens = make(map[string]PersonalAccessToken)
+	}
+	return tokens, nil
+}
+
+func savePersonalAccessTokens(file string, tokens PersonalAccessTokens) error {
+	return writeJSONFile(file, &tokens)
+}
+
+func personalAccessTokenInfo(token PersonalAccessToken) PersonalAccessTokenInfo {
+	return PersonalAccessTokenInfo{
+		Id:        token.Id,
+		Name:      token.Name,
+		Scopes:    token.Scopes,
+		CreatedAt: token.CreatedAt,
+		ExpiresAt: token.ExpiresAt,
+	}
+}
+
+// authenticatePersonalAccessToken turns a personal access token into the
+// principal it acts as. It writes the response and returns false if the
+// token is no good.
+func (cfg *apiConfig) authenticatePersonalAccessToken(w http.ResponseWriter, secret string) (principal, bool) {
+	token, err := cfg.store.GetPersonalAccessToken(hashRefreshToken(secret))
+	if err == errNotFound {
+		writeUnauthorized(w, "token is invalid or has been revoked")
+		return principal{}, false
+	}
+	if err != nil {
+		fmt.Printf("Error reading personal access token: %s\n", err)
+		w.WriteHeader(500)
+		return principal{}, false
+	}
+	if !token.ExpiresAt.After(time.Now().UTC()) {
+		writeUnauthorized(w, "token has expired")
+		return principal{}, false
+	}
+	return principal{
+		UserId:    token.UserId,
+		TokenId:   token.Id,
+		ExpiresAt: token.ExpiresAt,
+		Scopes:    token.Scopes,
+	}, true
+}
+
+// createPersonalAccessToken makes a new token for the caller. Only a login
+// session can do this, so one token can never be used to mint another.
+func (cfg *apiConfig) createPersonalAccessToken(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+
+	type parameters struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expires_in_days"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		log.Printf("Error decoding parameters: %s", err)
+		w.WriteHeader(400)
+		return
+	}
+	name := strings.TrimSpace(params.Name)
+	if name == "" || len(name) > patMaxNameLength {
+		w.WriteHeader(400)
+		w.Write([]byte(fmt.Sprintf("Token name must be between 1 and %d characters\n", patMaxNameLength)))
+		return
+	}
+	if len(params.Scopes) == 0 {
+		w.WriteHeader(400)
+		w.Write([]byte(fmt.Sprintf("Token needs at least one scope of: %s\n", strings.Join(tokenScopes, ", "))))
+		return
+	}
+	for _, scope := range params.Scopes {
+		if !slices.Contains(tokenScopes, scope) {
+			w.WriteHeader(400)
+			w.Write([]byte(fmt.Sprintf("Unknown scope %q, must be one of: %s\n", scope, strings.Join(tokenScopes, ", "))))
+			return
+		}
+	}
+	days := params.ExpiresInDays
+	if days == 0 {
+		days = patDefaultTTLDays
+	}
+	if days < 0 || days > patMaxTTLDays {
+		w.WriteHeader(400)
+		w.Write([]byte(fmt.Sprintf("expires_in_days must be between 1 and %d\n", patMaxTTLDays)))
+		return
+	}
+
+	existing, err := cfg.store.GetUserPersonalAccessTokens(caller.UserId)
+	if err != nil {
+		fmt.Printf("Error reading personal access tokens for user %d: %s\n", caller.UserId, err)
+		w.WriteHeader(500)
+		return
+	}
+	if len(existing) >= maxPersonalAccessTokens {
+		w.WriteHeader(409)
+		w.Write([]byte(fmt.Sprintf("You already have %d personal access tokens, revoke one first\n", len(existing))))
+		return
+	}
+
+	scopes := slices.Clone(params.Scopes)
+	slices.Sort(scopes)
+	secret := patPrefix + newRefreshToken()
+	now := time.Now().UTC().Truncate(time.Second)
+	token := PersonalAccessToken{
+		Id:        newTokenId(),
+		UserId:    caller.UserId,
+		Name:      name,
+		Token:     hashRefreshToken(secret),
+		Scopes:    slices.Compact(scopes),
+		CreatedAt: now,
+		ExpiresAt: now.AddDate(0, 0, days),
+	}
+	if err := cfg.store.SavePersonalAccessToken(token); err != nil {
+		fmt.Printf("There was an error saving personal access token: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+	cfg.audit.record(auditEvent{
+		Event:  "pat.created",
+		UserId: caller.UserId,
+		IP:     clientIP(r),
+		Detail: fmt.Sprintf("%s (%s) with scopes %s", token.Id, token.Name, strings.Join(token.Scopes, " ")),
+	})
+
+	info := personalAccessTokenInfo(token)
+	info.Token = secret
+	data, err := json.Marshal(info)
+	if err != nil {
+		fmt.Printf("Error marshalling personal access token to JSON: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(201)
+	w.Write(data)
+}
+
+// listPersonalAccessTokens returns the caller's tokens, newest first,
+// without their secrets.
+func (cfg *apiConfig) listPersonalAccessTokens(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+
+	tokens, err := cfg.store.GetUserPersonalAccessTokens(caller.UserId)
+	if err != nil {
+		fmt.Printf("Error reading personal access tokens for user %d: %s\n", caller.UserId, err)
+		w.WriteHeader(500)
+		return
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.After(tokens[j].CreatedAt)
+	})
+	out := make([]PersonalAccessTokenInfo, 0, len(tokens))
+	for _, token := range tokens {
+		out = append(out, personalAccessTokenInfo(token))
+	}
+	data, err := json.Marshal(out)
+	if err != nil {
+		fmt.Printf("Error marshalling personal access tokens to JSON: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(data)
+}
+
+// revokePersonalAccessToken deletes one of the caller's tokens. Tokens
+// belonging to anyone else look the same as ones that do not exist.
+func (cfg *apiConfig) revokePersonalAccessToken(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+	id := r.PathValue("id")
+
+	tokens, err := cfg.store.GetUserPersonalAccessTokens(caller.UserId)
+	if err != nil {
+		fmt.Printf("Error reading personal access tokens for user %d: %s\n", caller.UserId, err)
+		w.WriteHeader(500)
+		return
+	}
+	idx := slices.IndexFunc(tokens, func(t PersonalAccessToken) bool { return t.Id == id })
+	if idx < 0 {
+		w.WriteHeader(404)
+		return
+	}
+	err = cfg.store.DeletePersonalAccessToken(id)
+	if err == errNotFound {
+		w.WriteHeader(404)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error deleting personal access token %s: %s\n", id, err)
+		w.WriteHeader(500)
+		return
+	}
+	cfg.audit.record(auditEvent{
+		Event:  "pat.revoked",
+		UserId: caller.UserId,
+		IP:     clientIP(r),
+		Detail: fmt.Sprintf("%s (%s)", id, tokens[idx].Name),
+	})
+	w.WriteHeader(204)
+}
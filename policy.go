@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	breachedPrefixLen = 5
+	// passwordMaxBytes is the most bcrypt will hash. It applies whichever
+	// hasher is configured, so switching hashers never strands a password.
+	passwordMaxBytes = 72
+)
+
+// policyViolation is one password rule that was not met.
+type policyViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// passwordPolicy is what a new password has to pass. breached is nil when
+// no breached-password list is configured.
+type passwordPolicy struct {
+	minLength int
+	breached  *breachedPasswords
+}
+
+// check returns every rule password breaks for the account with email.
+func (p passwordPolicy) check(password, email string) []policyViolation {
+	violations := []policyViolation{}
+	if utf8.RuneCountInString(password) < p.minLength {
+		violations = append(violations, policyViolation{
+			Rule:    "min_length",
+			Message: fmt.Sprintf("Password must be at least %d characters long", p.minLength),
+		})
+	}
+	if len(password) > passwordMaxBytes {
+		violations = append(violations, policyViolation{
+			Rule:    "max_length",
+			Message: fmt.Sprintf("Password must be at most %d bytes long, which is fewer characters if it uses accents or emoji", passwordMaxBytes),
+		})
+	}
+	if email != "" && strings.EqualFold(strings.TrimSpace(password), strings.TrimSpace(email)) {
+		violations = append(violations, policyViolation{
+			Rule:    "not_email",
+			Message: "Password must not be the same as the email address",
+		})
+	}
+	if p.breached != nil && p.breached.contains(password) {
+		violations = append(violations, policyViolation{
+			Rule:    "not_breached",
+			Message: "Password has appeared in a data breach and cannot be used",
+		})
+	}
+	return violations
+}
+
+func writePolicyViolations(w http.ResponseWriter, violations []policyViolation) {
+	data, err := json.Marshal(struct {
+		Error      string            `json:"error"`
+		Violations []policyViolation `json:"violations"`
+	}{"Password does not meet the password policy", violations})
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(400)
+	w.Write(data)
+}
+
+// breachedPasswords is a local copy of a breached-password corpus, held as
+// uppercase SHA-1 hashes grouped by their first five characters the same
+// way a k-anonymity range query returns them, so no password or full hash
+// ever leaves the process.
+type breachedPasswords struct {
+	ranges map[string]map[string]struct{}
+	count  int
+}
+
+// loadBreachedPasswords reads a breached-password list in either layout the
+// Pwned Passwords downloader produces. A file holds one full SHA-1 hash per
+// line, as "HASH:COUNT". A directory holds one file per range, named after
+// its five-character prefix with an optional .txt extension, each line
+// holding the remaining 35 characters as "SUFFIX:COUNT", the same as a
+// range query returns. Counts are optional and ignored; blank lines and
+// lines starting with # are skipped.
+func loadBreachedPasswords(path string) (*breachedPasswords, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	list := &breachedPasswords{ranges: make(map[string]map[string]struct{})}
+	if !info.IsDir() {
+		return list, list.readFile(path, "")
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		prefix := strings.ToUpper(strings.TrimSuffix(entry.Name(), ".txt"))
+		if len(prefix) != breachedPrefixLen || strings.Trim(prefix, "0123456789ABCDEF") != "" {
+			return nil, fmt.Errorf("%s is not named after a five-character hash prefix", entry.Name())
+		}
+		if err := list.readFile(filepath.Join(path, entry.Name()), prefix); err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+// readFile adds the hashes listed in file. With an empty prefix each line
+// holds a full hash; otherwise each holds the rest of a hash starting with
+// prefix.
+func (b *breachedPasswords) readFile(file, prefix string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		hash, _, _ := strings.Cut(text, ":")
+		hash = prefix + strings.ToUpper(hash)
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != sha1.Size*2 {
+			return fmt.Errorf("%s line %d is not a SHA-1 hash", file, line)
+		}
+		prefix, suffix := hash[:breachedPrefixLen], hash[breachedPrefixLen:]
+		if b.ranges[prefix] == nil {
+			b.ranges[prefix] = make(map[string]struct{})
+		}
+		b.ranges[prefix][suffix] = struct{}{}
+		b.count++
+	}
+	return scanner.Err()
+}
+
+func (b *breachedPasswords) contains(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	_, ok := b.ranges[hash[:breachedPrefixLen]][hash[breachedPrefixLen:]]
+	return ok
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	policy := passwordPolicy{minLength: 12}
+	tests := []struct {
+		name     string
+		password string
+		want     []string
+	}{
+		{"fine", "correct-horse-battery", nil},
+		{"too short", "short", []string{"min_length"}},
+		{"longest allowed", strings.Repeat("a", passwordMaxBytes), nil},
+		{"too long", strings.Repeat("a", passwordMaxBytes+1), []string{"max_length"}},
+		// 37 characters, but 74 bytes.
+		{"too long in bytes", strings.Repeat("é", 37), []string{"max_length"}},
+		{"same as email", "Someone@Example.com", []string{"not_email"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := []string{}
+			for _, v := range policy.check(tt.password, "someone@example.com") {
+				rules = append(rules, v.Rule)
+			}
+			if !slices.Equal(rules, tt.want) && !(len(rules) == 0 && len(tt.want) == 0) {
+				t.Errorf("got %v, want %v", rules, tt.want)
+			}
+		})
+	}
+}
+
+// A password bcrypt cannot hash is turned away as a policy violation, not
+// a server error.
+func TestOverlongPasswordIsRejected(t *testing.T) {
+	cfg := newTestConfig(t)
+	rec := doRequest(t, cfg.routes(), "POST", "/api/users", "", map[string]string{
+		"email":    "long@example.com",
+		"password": strings.Repeat("x", 100),
+	})
+	if rec.Code != 400 || !strings.Contains(rec.Body.String(), "max_length") {
+		t.Errorf("got %d %q, want 400 with max_length", rec.Code, rec.Body.String())
+	}
+}
+
+// The same hashes load from a single file of full hashes and from a
+// directory of range files named after their prefixes.
+func TestLoadBreachedPasswords(t *testing.T) {
+	// SHA-1 of "password" and "123456".
+	hashes := []string{
+		"5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8",
+		"7C4A8D09CA3762AF61E59520943DC26494F8941B",
+	}
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "pwned.txt")
+	full := "# full hashes\n" + hashes[0] + ":3861493\n" + strings.ToLower(hashes[1]) + "\n"
+	if err := os.WriteFile(file, []byte(full), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	rangeDir := filepath.Join(dir, "ranges")
+	if err := os.Mkdir(rangeDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	for _, hash := range hashes {
+		name := filepath.Join(rangeDir, hash[:breachedPrefixLen]+".txt")
+		if err := os.WriteFile(name, []byte(hash[breachedPrefixLen:]+":42\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, path := range []string{file, rangeDir} {
+		list, err := loadBreachedPasswords(path)
+		if err != nil {
+			t.Fatalf("loading %s: %s", path, err)
+		}
+		if list.count != 2 || !list.contains("password") || !list.contains("123456") {
+			t.Errorf("%s: got %d hashes, want both test passwords", path, list.count)
+		}
+		if list.contains("correct-horse-battery") {
+			t.Errorf("%s: matched a password not on the list", path)
+		}
+	}
+
+	bad := filepath.Join(dir, "bad")
+	if err := os.Mkdir(bad, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(bad, "5BAA6.txt"), []byte(hashes[0]+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadBreachedPasswords(bad); err == nil {
+		t.Error("loaded a range file holding full hashes")
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// rateLimiterMaxKeys is the most keys a rateLimiter tracks at once.
+const rateLimiterMaxKeys = 100000
+
+// rateLimitEntry holds the recent actions for one key, oldest first.
+type rateLimitEntry struct {
+	key   string
+	times []time.Time
+}
+
+// rateLimiter allows each key at most limit actions in any window. Like
+// loginThrottle it lives in memory, so a restart resets it. Keys are often
+// chosen by the caller, such as an email address, so like attemptRecords
+// it holds them from the most to the least recently used and never tracks
+// more than rateLimiterMaxKeys: when full, the key used longest ago is
+// dropped to make room.
+type rateLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	byKey  map[string]*list.Element
+	order  *list.List
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{limit: limit, window: window, byKey: make(map[string]*list.Element), order: list.New()}
+}
+
+// stale reports whether entry has no actions left inside the window.
+func (l *rateLimiter) stale(entry *rateLimitEntry, now time.Time) bool {
+	return len(entry.times) == 0 || now.Sub(entry.times[len(entry.times)-1]) >= l.window
+}
+
+// allow records an action for key if it is within the limit. Otherwise it
+// returns false and how long until the next action would be allowed.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	elem, ok := l.byKey[key]
+	if !ok {
+		// Keys at the back were used longest ago, so the stale ones are
+		// all there.
+		for back := l.order.Back(); back != nil && l.stale(back.Value.(*rateLimitEntry), now); back = l.order.Back() {
+			l.remove(back)
+		}
+		if l.order.Len() >= rateLimiterMaxKeys {
+			l.remove(l.order.Back())
+		}
+		elem = l.order.PushFront(&rateLimitEntry{key: key})
+		l.byKey[key] = elem
+	} else {
+		l.order.MoveToFront(elem)
+	}
+	entry := elem.Value.(*rateLimitEntry)
+
+	recent := entry.times[:0]
+	for _, t := range entry.times {
+		if now.Sub(t) < l.window {
+			recent = append(recent, t)
+		}
+	}
+	entry.times = recent
+	if len(recent) >= l.limit {
+		return false, recent[0].Add(l.window).Sub(now)
+	}
+	entry.times = append(recent, now)
+	return true, 0
+}
+
+func (l *rateLimiter) remove(elem *list.Element) {
+	l.order.Remove(elem)
+	delete(l.byKey, elem.Value.(*rateLimitEntry).key)
+}
+
+func (l *rateLimiter) len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.order.Len()
+}
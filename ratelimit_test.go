@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllowsLimitPerWindow(t *testing.T) {
+	limiter := newRateLimiter(2, time.Minute)
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := limiter.allow("someone@example.com", now); !ok {
+			t.Fatalf("action %d was refused", i+1)
+		}
+	}
+	if ok, wait := limiter.allow("someone@example.com", now.Add(10*time.Second)); ok || wait != 50*time.Second {
+		t.Errorf("action over the limit: got %v, wait %s, want refused for 50s", ok, wait)
+	}
+	if ok, _ := limiter.allow("someone@example.com", now.Add(time.Minute)); !ok {
+		t.Errorf("action once the window has passed was refused")
+	}
+}
+
+// A flood of new keys is capped, and evicts the keys used longest ago
+// rather than one that is still at its limit.
+func TestRateLimiterIsBounded(t *testing.T) {
+	limiter := newRateLimiter(1, time.Hour)
+	now := time.Now()
+
+	limiter.allow("target@example.com", now)
+	for i := 0; i < rateLimiterMaxKeys+100; i++ {
+		now = now.Add(time.Microsecond)
+		limiter.allow(fmt.Sprintf("user%d@example.com", i), now)
+		if i%1000 == 0 {
+			limiter.allow("target@example.com", now)
+		}
+	}
+
+	if n := limiter.len(); n != rateLimiterMaxKeys {
+		t.Errorf("got %d keys, want %d", n, rateLimiterMaxKeys)
+	}
+	if ok, _ := limiter.allow("target@example.com", now); ok {
+		t.Errorf("the key at its limit was evicted")
+	}
+	if ok, _ := limiter.allow("user0@example.com", now); !ok {
+		t.Errorf("the key used longest ago was kept")
+	}
+}
@@ -1,65 +1,180 @@
 package main
 
 import (
-	"bufio"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
-	"os"
-	"strings"
+	"strconv"
 	"time"
 )
 
+const (
+	// refreshTokenRetiredKept is how many retired secrets a session keeps
+	// for spotting replays. A thief replaying a secret older than that gets
+	// an ordinary 401, but the session's record stays small however long
+	// it lives.
+	refreshTokenRetiredKept   = 10
+	refreshTokenPruneInterval = 10 * time.Minute
+)
+
+// RefreshToken is one login session. Id is public and names the session
+// in the sessions API; Token is the secret the client refreshes with.
+// Retired holds the secrets the session has rotated away from, so a
+// replayed one can be spotted. Stores only ever see hashRefreshToken of a
+// secret, never the secret itself. Sessions granted to an OAuth client
+// have its ClientId and the Scopes the user consented to, and can only be
+// refreshed through the OAuth token endpoint.
 type RefreshToken struct {
+	Id            string
 	UserId        int
 	Token         string
 	ExirationDate time.Time
+	Device        string
+	UserAgent     string
+	IP            string
+	CreatedAt     time.Time
+	LastUsedAt    time.Time
+	Retired       []string
+	ClientId      string   `json:",omitempty"`
+	Scopes        []string `json:",omitempty"`
 }
 
+// RefreshTokens is the refresh token collection. Hashed is false for files
+// and backups written before secrets were hashed, whose Token and Retired
+// fields hold raw secrets.
 type RefreshTokens struct {
-	Tokens map[int]RefreshToken
+	Tokens map[string]RefreshToken
+	Hashed bool
 }
 
-func saveTokens(file string, tokens RefreshTokens) {
-	if err := os.Truncate(file, 0); err != nil {
-		fmt.Printf("Failed to truncate: %v", err)
+// SessionInfo is what the sessions API shows about a RefreshToken.
+type SessionInfo struct {
+	Id         string    `json:"id"`
+	Device     string    `json:"device"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
+	ClientId   string    `json:"client_id,omitempty"`
+	Scopes     []string  `json:"scopes,omitempty"`
+}
+
+// legacyTokenId is the session id given to tokens saved before sessions
+// had ids, when the collection was keyed by user id.
+func legacyTokenId(userId int) string {
+	return strconv.Itoa(userId)
+}
+
+// normalizeRefreshTokens keys every token by its session id, filling in
+// legacyTokenId for tokens that predate session ids.
+func normalizeRefreshTokens(tokens RefreshTokens) RefreshTokens {
+	out := RefreshTokens{Tokens: make(map[string]RefreshToken, len(tokens.Tokens)), Hashed: tokens.Hashed}
+	for _, val := range tokens.Tokens {
+		if val.Id == "" {
+			val.Id = legacyTokenId(val.UserId)
+		}
+		out.Tokens[val.Id] = val
 	}
-	db, err := os.OpenFile(file, os.O_WRONLY, 0666)
-	if err != nil {
-		fmt.Printf("There was an error opening DB for reading: %s\n", err)
+	return out
+}
+
+// pruneRefreshTokensEvery drops sessions that have expired, along with
+// their retired secrets, checking on a timer for the life of the process.
+func (cfg *apiConfig) pruneRefreshTokensEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			pruned, err := cfg.store.PruneRefreshTokens(time.Now().UTC())
+			if err != nil {
+				fmt.Printf("Failed to prune expired sessions: %s\n", err)
+				continue
+			}
+			if pruned > 0 {
+				fmt.Printf("Pruned %d expired sessions\n", pruned)
+			}
+		}
+	}()
+}
+
+// hashRefreshToken is what gets stored in place of a refresh token secret.
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+const refreshTokenSelectorLength = 16
+
+// refreshTokenSelector is the part of a refresh token hash the sqlite store
+// indexes and looks tokens up by. It is too short to be worth guessing on
+// its own; the rest of the hash is always checked with
+// refreshTokenHashEqual.
+func refreshTokenSelector(hash string) string {
+	if len(hash) < refreshTokenSelectorLength {
+		return hash
 	}
-	defer db.Close()
+	return hash[:refreshTokenSelectorLength]
+}
 
-	data, marshallError := json.Marshal(&tokens)
-	if marshallError != nil {
-		fmt.Printf("Error marshalling token data to JSON: %s\n", marshallError)
+// refreshTokenHashEqual compares two refresh token hashes in constant time.
+func refreshTokenHashEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// hashRefreshTokens replaces the raw secrets in a collection written before
+// secrets were hashed. Collections that are already hashed are returned as
+// they are.
+func hashRefreshTokens(tokens RefreshTokens) RefreshTokens {
+	if tokens.Hashed {
+		return tokens
 	}
-	_, err = db.Write(data)
-	if err != nil {
-		fmt.Printf("Problem writing tokens to db: %s\n", err)
+	out := RefreshTokens{Tokens: make(map[string]RefreshToken, len(tokens.Tokens)), Hashed: true}
+	for id, val := range tokens.Tokens {
+		val.Token = hashRefreshToken(val.Token)
+		retired := make([]string, 0, len(val.Retired))
+		for _, old := range val.Retired {
+			retired = append(retired, hashRefreshToken(old))
+		}
+		val.Retired = retired
+		out.Tokens[id] = val
 	}
+	return out
 }
 
-func readTokens(file string) RefreshTokens {
-	db, err := os.Open(file)
-	if err != nil {
-		fmt.Printf("There was an error opening DB for reading: %s\n", err)
-	}
-	defer db.Close()
+func saveTokens(file string, tokens RefreshTokens) error {
+	return writeJSONFile(file, &tokens)
+}
 
-	scanner := bufio.NewScanner(db)
+func readTokens(file string) (RefreshTokens, error) {
 	tokens := RefreshTokens{}
+	if err := readJSONFile(file, &tokens); err != nil {
+		return tokens, err
+	}
+	return normalizeRefreshTokens(tokens), nil
+}
 
-	for scanner.Scan() {
-		data := scanner.Text()
-		err := json.Unmarshal([]byte(data), &tokens)
-		if err != nil {
-			fmt.Printf("Error unmarshalling JSON from DB: %s\n", err)
-		}
+func newSessionId() string {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		fmt.Printf("Error generating random bytes")
 	}
-	return tokens
+	return hex.EncodeToString(b)
+}
+
+// clientIP is the address the request came from, without the port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
 }
 
 func newRefreshToken() string {
@@ -73,78 +188,123 @@ func newRefreshToken() string {
 	return encoded
 }
 
-func refreshUserAuth(w http.ResponseWriter, r *http.Request) {
-	header := r.Header.Get("authorization")
-	if header == "" {
-		out := "Request wasn't made with header 'Authorization: Bearer <my_auth_token>'"
-		w.Write([]byte(out))
-		w.WriteHeader(400)
+// refreshUserAuth trades a refresh token for a new access token and a new
+// refresh token. A refresh token can only be used once: if one that has
+// already been rotated turns up again, either it or its replacement has
+// been stolen, so the whole session is revoked.
+func (cfg *apiConfig) refreshUserAuth(w http.ResponseWriter, r *http.Request) {
+	tokenString, ok := bearerToken(r)
+	if !ok {
+		writeUnauthorized(w, "")
 		return
 	}
-	bearerToken := strings.Replace(header, "Bearer ", "", 1)
-	refreshTokens := readTokens(refreshTokenDbFile)
-	tokenExists := false
-	tokenValid := false
-	targetToken := RefreshToken{}
-
-	for _, val := range refreshTokens.Tokens {
-		if val.Token == bearerToken {
-			targetToken = val
-			tokenExists = true
-			if val.ExirationDate.After(time.Now().UTC()) {
-				tokenValid = true
-			}
-			break
-		}
+	presented := hashRefreshToken(tokenString)
+	targetToken, err := cfg.store.GetRefreshToken(presented)
+	if err == errTokenReused {
+		cfg.revokeReusedSession(r, targetToken)
+		w.WriteHeader(401)
+		return
 	}
-
-	if !tokenExists || !tokenValid {
+	// OAuth clients must refresh through /oauth/token, which checks the
+	// client's credentials and keeps the token's scopes.
+	if err != nil || targetToken.ClientId != "" || !targetToken.ExirationDate.After(time.Now().UTC()) {
 		w.WriteHeader(401)
 		return
 	}
 
 	type parameters struct {
-		Token string `json:"token"`
+		Token        string    `json:"token"`
+		ExpiresAt    time.Time `json:"expires_at"`
+		RefreshToken string    `json:"refresh_token"`
+	}
+	refreshToken := newRefreshToken()
+	rotated, err := cfg.store.RotateRefreshToken(targetToken.Id, presented, hashRefreshToken(refreshToken), time.Now().UTC())
+	if err == errTokenReused {
+		cfg.revokeReusedSession(r, rotated)
+		w.WriteHeader(401)
+		return
+	}
+	if err == errNotFound {
+		w.WriteHeader(401)
+		return
 	}
-	authToken, err := produceJWT(3600, targetToken.UserId)
+	if err != nil {
+		fmt.Printf("Error rotating refresh token: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+	authToken, expiresAt, err := cfg.produceJWT(cfg.refreshedAccessTTL, rotated.UserId, rotated.Id, "")
 	if err != nil {
 		fmt.Printf("Error creating JWT with supplied parameters: %s\n", err)
+		w.WriteHeader(500)
+		return
 	}
 
 	responseData := parameters{
-		Token: authToken,
+		Token:        authToken,
+		ExpiresAt:    expiresAt,
+		RefreshToken: refreshToken,
 	}
 
 	data, err := json.Marshal(&responseData)
 	if err != nil {
 		fmt.Printf("Error marshalling JWT response to JSON: %s\n", err)
+		w.WriteHeader(500)
+		return
 	}
-
-	w.Write(data)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
 	w.WriteHeader(200)
+	w.Write(data)
 	return
 }
 
-func revokeUserAuth(w http.ResponseWriter, r *http.Request) {
-	header := r.Header.Get("authorization")
-	if header == "" {
-		out := "Request wasn't made with header 'Authorization: Bearer <my_auth_token>'"
-		w.Write([]byte(out))
-		w.WriteHeader(400)
-		return
+// revokeReusedSession ends a session after one of its rotated refresh
+// tokens was presented again and logs it as a security event. Ending the
+// session also cuts off every access token issued from it, since
+// requireAuth only accepts tokens whose session still exists, so whoever
+// holds the stolen token is shut out straight away rather than when their
+// access token expires.
+func (cfg *apiConfig) revokeReusedSession(r *http.Request, session RefreshToken) {
+	fmt.Printf("SECURITY: reused refresh token for session %s (user %d) presented from %s, revoking session\n",
+		session.Id, session.UserId, clientIP(r))
+	cfg.audit.record(auditEvent{
+		Event:  "session.token_reused",
+		UserId: session.UserId,
+		IP:     clientIP(r),
+		Detail: "session " + session.Id + " revoked",
+	})
+	err := cfg.store.DeleteRefreshToken(session.Id)
+	if err != nil && err != errNotFound {
+		fmt.Printf("Error revoking session %s after token reuse: %s\n", session.Id, err)
 	}
-	bearerToken := strings.Replace(header, "Bearer ", "", 1)
-	refreshTokens := readTokens(refreshTokenDbFile)
+}
 
-	for id, val := range refreshTokens.Tokens {
-		if val.Token == bearerToken {
-			delete(refreshTokens.Tokens, id)
-			fmt.Println(refreshTokens)
-			saveTokens(refreshTokenDbFile, refreshTokens)
-			w.WriteHeader(204)
-			return
-		}
+func (cfg *apiConfig) revokeUserAuth(w http.ResponseWriter, r *http.Request) {
+	tokenString, ok := bearerToken(r)
+	if !ok {
+		writeUnauthorized(w, "")
+		return
+	}
+	presented := hashRefreshToken(tokenString)
+	targetToken, err := cfg.store.GetRefreshToken(presented)
+	if err == errNotFound {
+		w.WriteHeader(404)
+		return
+	}
+	if err == errTokenReused {
+		cfg.revokeReusedSession(r, targetToken)
+		w.WriteHeader(204)
+		return
+	}
+	if err == nil {
+		err = cfg.store.DeleteRefreshToken(targetToken.Id)
+	}
+	if err != nil {
+		fmt.Printf("There was an error revoking refresh token: %s\n", err)
+		w.WriteHeader(500)
+		return
 	}
-	w.WriteHeader(404)
+	w.WriteHeader(204)
 	return
 }
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// A long-lived session keeps only its most recent retired secrets, and
+// pruning drops expired sessions along with theirs.
+func TestRefreshTokenRetiredCapAndPrune(t *testing.T) {
+	stores := map[string]Store{
+		"memory": newMemoryStore(),
+		"sqlite": newTestSQLiteStore(t),
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			user, err := store.CreateUser(User{Email: "rotator@example.com", PasswordHash: []byte("hash")})
+			if err != nil {
+				t.Fatal(err)
+			}
+			now := time.Now().UTC()
+			current := hashRefreshToken(newRefreshToken())
+			session := RefreshToken{Id: newSessionId(), UserId: user.Id, Token: current, ExirationDate: now.Add(time.Hour)}
+			if err := store.SaveRefreshToken(session); err != nil {
+				t.Fatal(err)
+			}
+			var retired []string
+			for i := 0; i < refreshTokenRetiredKept+5; i++ {
+				next := hashRefreshToken(newRefreshToken())
+				if _, err := store.RotateRefreshToken(session.Id, current, next, now); err != nil {
+					t.Fatalf("rotation %d: %s", i, err)
+				}
+				retired = append(retired, current)
+				current = next
+			}
+
+			if _, err := store.GetRefreshToken(retired[len(retired)-1]); err != errTokenReused {
+				t.Errorf("latest retired secret: got %v, want errTokenReused", err)
+			}
+			if _, err := store.GetRefreshToken(retired[0]); err != errNotFound {
+				t.Errorf("oldest retired secret: got %v, want errNotFound once past the cap", err)
+			}
+
+			expired := RefreshToken{Id: newSessionId(), UserId: user.Id, Token: hashRefreshToken(newRefreshToken()), ExirationDate: now.Add(-time.Minute)}
+			if err := store.SaveRefreshToken(expired); err != nil {
+				t.Fatal(err)
+			}
+			pruned, err := store.PruneRefreshTokens(now)
+			if err != nil || pruned != 1 {
+				t.Fatalf("pruning: got %d, %v, want 1", pruned, err)
+			}
+			if _, err := store.GetRefreshToken(expired.Token); err != errNotFound {
+				t.Errorf("pruned session: got %v, want errNotFound", err)
+			}
+			if found, err := store.GetRefreshToken(current); err != nil || found.Id != session.Id {
+				t.Errorf("live session after pruning: got %+v, %v", found, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+const revocationPruneInterval = 10 * time.Minute
+
+// AccessRevocations maps the jti of each revoked access token to the time
+// the token expires, after which the entry can be dropped.
+type AccessRevocations struct {
+	Revoked map[string]time.Time
+}
+
+// readRevocations loads the revocation list, treating a missing file as an
+// empty list since data directories from before logout existed have none.
+func readRevocations(file string) (AccessRevocations, error) {
+	revocations := AccessRevocations{}
+	err := readJSONFile(file, &revocations)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return revocations, err
+	}
+	if revocations.Revoked == nil {
+		revocations.Revoked = make(map[string]time.Time)
+	}
+	return revocations, nil
+}
+
+func saveRevocations(file string, revocations AccessRevocations) error {
+	return writeJSONFile(file, &revocations)
+}
+
+// pruneRevocationsEvery drops revocations for tokens that can no longer
+// pass validation, checking on a timer for the life of the process.
+func (cfg *apiConfig) pruneRevocationsEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			pruned, err := cfg.store.PruneRevocations(time.Now().UTC().Add(-cfg.jwtLeeway))
+			if err != nil {
+				fmt.Printf("Failed to prune access token revocations: %s\n", err)
+				continue
+			}
+			if pruned > 0 {
+				fmt.Printf("Pruned %d expired access token revocations\n", pruned)
+			}
+		}
+	}()
+}
+
+// logout revokes the access token the request was made with and ends the
+// session it belongs to, so neither it nor the session's refresh token
+// can be used again.
+func (cfg *apiConfig) logout(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+
+	err := cfg.store.RevokeAccessToken(caller.TokenId, caller.ExpiresAt)
+	if err != nil && err != errAlreadyRevoked {
+		fmt.Printf("Error revoking access token: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+	if caller.SessionId != "" {
+		err = cfg.store.DeleteRefreshToken(caller.SessionId)
+		if err != nil && err != errNotFound {
+			fmt.Printf("Error ending session %s on logout: %s\n", caller.SessionId, err)
+			w.WriteHeader(500)
+			return
+		}
+	}
+	w.WriteHeader(204)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// listSessions shows the caller's unexpired sessions, most recently used
+// first, flagging the one the request itself was made from.
+func (cfg *apiConfig) listSessions(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+
+	tokens, err := cfg.store.GetUserRefreshTokens(caller.UserId)
+	if err != nil {
+		fmt.Printf("Error reading sessions for user %d: %s\n", caller.UserId, err)
+		w.WriteHeader(500)
+		return
+	}
+	now := time.Now().UTC()
+	sessions := []SessionInfo{}
+	for _, token := range tokens {
+		if !token.ExirationDate.After(now) {
+			continue
+		}
+		sessions = append(sessions, SessionInfo{
+			Id:         token.Id,
+			Device:     token.Device,
+			UserAgent:  token.UserAgent,
+			IP:         token.IP,
+			CreatedAt:  token.CreatedAt,
+			LastUsedAt: token.LastUsedAt,
+			ExpiresAt:  token.ExirationDate,
+			Current:    token.Id == caller.SessionId,
+			ClientId:   token.ClientId,
+			Scopes:     token.Scopes,
+		})
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+	})
+
+	data, err := json.Marshal(sessions)
+	if err != nil {
+		fmt.Printf("Error marshalling sessions to JSON: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(data)
+}
+
+// revokeSession ends one of the caller's sessions. Sessions belonging to
+// someone else get the same 404 as ones that do not exist.
+func (cfg *apiConfig) revokeSession(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+
+	tokens, err := cfg.store.GetUserRefreshTokens(caller.UserId)
+	if err != nil {
+		fmt.Printf("Error reading sessions for user %d: %s\n", caller.UserId, err)
+		w.WriteHeader(500)
+		return
+	}
+	id := r.PathValue("id")
+	for _, token := range tokens {
+		if token.Id != id {
+			continue
+		}
+		err := cfg.store.DeleteRefreshToken(id)
+		if err != nil && err != errNotFound {
+			fmt.Printf("Error revoking session %s: %s\n", id, err)
+			w.WriteHeader(500)
+			return
+		}
+		w.WriteHeader(204)
+		return
+	}
+	w.WriteHeader(404)
+}
+
+// revokeAllSessions logs the caller out everywhere, this device included.
+// Access tokens die with their sessions, so none of them work afterwards
+// either.
+func (cfg *apiConfig) revokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+
+	if err := cfg.store.DeleteUserRefreshTokens(caller.UserId); err != nil {
+		fmt.Printf("Error revoking sessions for user %d: %s\n", caller.UserId, err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(204)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Files with these extensions hold data or secrets and are never served,
+// even if someone drops one into the static root or allowlists it.
+var deniedStaticExtensions = []string{".json", ".db", ".db-wal", ".db-shm", ".wal", ".env", ".tar.gz", ".tgz"}
+
+// staticFileServer serves files from root, but only paths matching one of
+// the allowlist entries. An entry ending in "/" allows everything below
+// that directory; any other entry must match the path exactly. Dotfiles,
+// data files and directory listings are always answered with 404. No page
+// may be framed, so the consent page cannot be clickjacked.
+func staticFileServer(root string, allowlist []string) http.Handler {
+	files := http.FileServer(http.Dir(root))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+		if name == "" || name == "." {
+			name = "index.html"
+		} else if strings.HasSuffix(r.URL.Path, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		if !staticPathAllowed(name, allowlist) {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+		files.ServeHTTP(w, r)
+	})
+}
+
+func staticPathAllowed(name string, allowlist []string) bool {
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return false
+		}
+	}
+	lower := strings.ToLower(name)
+	for _, ext := range deniedStaticExtensions {
+		if strings.HasSuffix(lower, ext) {
+			return false
+		}
+	}
+	for _, entry := range allowlist {
+		if strings.HasSuffix(entry, "/") && strings.HasPrefix(name, entry) {
+			return true
+		}
+		if name == entry {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeStaticRoot lays out a static root next to the kind of files that end
+// up beside it when it is pointed at the working directory.
+func writeStaticRoot(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	files := map[string]string{
+		"index.html":        "<h1>Chirpy</h1>",
+		"assets/logo.png":   "png",
+		"assets/app.js":     "js",
+		"assets/.DS_Store":  "junk",
+		"assets/seed.json":  "{}",
+		".env":              "JWT_SECRET=secret",
+		".git/config":       "[core]",
+		"chirpy.db":         "sqlite",
+		"chirpy.wal":        "wal",
+		"users.json":        `{"users":{}}`,
+		"keys.json":         `{"keys":[]}`,
+		"backup.tar.gz":     "backup",
+		"notes.txt":         "not allowlisted",
+		"private/notes.txt": "not allowlisted",
+	}
+	for name, content := range files {
+		file := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestStaticFileServer(t *testing.T) {
+	t.Setenv("STATIC_DIR", writeStaticRoot(t))
+	t.Setenv("STATIC_ALLOWLIST", "index.html,assets/")
+	handler := newTestConfig(t).routes()
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/app/", 200},
+		{"/app/index.html", 301},
+		{"/app/assets/logo.png", 200},
+		{"/app/assets/app.js", 200},
+		{"/app/assets/", 404},
+		{"/app/assets/.DS_Store", 404},
+		{"/app/assets/seed.json", 404},
+		{"/app/.env", 404},
+		{"/app/.git/config", 404},
+		{"/app/.git/", 404},
+		{"/app/chirpy.db", 404},
+		{"/app/chirpy.wal", 404},
+		{"/app/users.json", 404},
+		{"/app/keys.json", 404},
+		{"/app/backup.tar.gz", 404},
+		{"/app/notes.txt", 404},
+		{"/app/private/notes.txt", 404},
+		{"/app/assets/%2e%2e/.env", 404},
+		{"/app/missing.html", 404},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rec := doRequest(t, handler, "GET", tt.path, "", nil)
+			if rec.Code != tt.want {
+				t.Errorf("GET %s: got %d, want %d", tt.path, rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+// Data files stay hidden even when the allowlist names them.
+func TestStaticFileServerDeniesAllowlistedDataFiles(t *testing.T) {
+	handler := staticFileServer(writeStaticRoot(t), []string{"index.html", "users.json", "chirpy.db", ".env", ".git/", "assets/"})
+
+	for _, path := range []string{"/users.json", "/chirpy.db", "/.env", "/.git/config", "/assets/seed.json", "/assets/../users.json"} {
+		rec := doRequest(t, handler, "GET", path, "", nil)
+		if rec.Code != 404 {
+			t.Errorf("GET %s: got %d, want 404", path, rec.Code)
+		}
+	}
+	rec := doRequest(t, handler, "GET", "/assets/logo.png", "", nil)
+	if rec.Code != 200 || rec.Body.String() != "png" {
+		t.Errorf("GET /assets/logo.png: got %d %q", rec.Code, rec.Body.String())
+	}
+}
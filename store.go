@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	errNotFound       = errors.New("record not found")
+	errDuplicateEmail = errors.New("email address already in use")
+	errTokenReused    = errors.New("refresh token has already been rotated")
+	errAlreadyRevoked = errors.New("access token has already been revoked")
+)
+
+type ChirpStore interface {
+	GetChirps() ([]Chirp, error)
+	GetChirp(id int) (Chirp, error)
+	CreateChirp(chirp Chirp) (Chirp, error)
+	DeleteChirp(id int) error
+}
+
+// UserStore holds accounts. GetUserByOIDCSubject finds the user linked to
+// an identity provider account.
+//
+// UpdateUserFunc is the only way to change a user: it reads the current
+// record, passes it to update and saves the result in one atomic step, so
+// two requests changing different fields of the same user cannot undo each
+// other. If update returns an error nothing is saved and that error is
+// returned. update runs with the user locked and must not call the store.
+type UserStore interface {
+	GetUser(id int) (User, error)
+	GetUserByEmail(email string) (User, error)
+	GetUserByOIDCSubject(issuer, subject string) (User, error)
+	CreateUser(user User) (User, error)
+	UpdateUserFunc(id int, update func(user *User) error) (User, error)
+}
+
+// RefreshTokenStore holds login sessions. GetRefreshToken looks a session
+// up by the hash of its secret token; GetSession and everything else go by
+// session id, which the caller sets before the first save. Stores never see a raw
+// secret, only hashRefreshToken of one.
+//
+// Each refresh swaps a session's secret for a new one with
+// RotateRefreshToken, and the old secret is kept on the session as retired.
+// Presenting a retired secret to GetRefreshToken, or rotating with a secret
+// that is no longer current, returns the session with errTokenReused. Only
+// the last refreshTokenRetiredKept retired secrets are kept.
+// PruneRefreshTokens drops the sessions that expired before the given time.
+type RefreshTokenStore interface {
+	GetRefreshToken(token string) (RefreshToken, error)
+	GetSession(id string) (RefreshToken, error)
+	GetUserRefreshTokens(userId int) ([]RefreshToken, error)
+	SaveRefreshToken(token RefreshToken) error
+	RotateRefreshToken(id, oldToken, newToken string, usedAt time.Time) (RefreshToken, error)
+	DeleteRefreshToken(id string) error
+	DeleteUserRefreshTokens(userId int) error
+	DeleteClientRefreshTokens(clientId string) error
+	PruneRefreshTokens(before time.Time) (int, error)
+}
+
+// PersonalAccessTokenStore holds the long-lived tokens users create for
+// bots and integrations. As with refresh tokens, stores only ever see the
+// hash of a token's secret: GetPersonalAccessToken looks one up by that
+// hash, and everything else goes by the token's id.
+// DeleteUserPersonalAccessTokens drops all of a user's tokens, for when
+// their password changes.
+type PersonalAccessTokenStore interface {
+	GetPersonalAccessToken(token string) (PersonalAccessToken, error)
+	GetUserPersonalAccessTokens(userId int) ([]PersonalAccessToken, error)
+	SavePersonalAccessToken(token PersonalAccessToken) error
+	DeletePersonalAccessToken(id string) error
+	DeleteUserPersonalAccessTokens(userId int) error
+}
+
+// OAuthClientStore holds the third-party applications registered to use
+// the OAuth authorization server, by client id. A confidential client's
+// Secret is stored as a hash, like every other secret.
+type OAuthClientStore interface {
+	GetOAuthClient(id string) (OAuthClient, error)
+	GetUserOAuthClients(ownerId int) ([]OAuthClient, error)
+	SaveOAuthClient(client OAuthClient) error
+	DeleteOAuthClient(id string) error
+}
+
+// RevocationStore remembers access tokens, by jti, that were revoked before
+// they expired. Entries are only needed until expiresAt and
+// PruneRevocations drops the ones that expired before the given time.
+// RevokeAccessToken returns errAlreadyRevoked if the jti is already on the
+// list, which makes it the way to use up a one-time token: of any number of
+// requests racing to revoke it, exactly one gets nil. Revocations are not
+// part of snapshots.
+type RevocationStore interface {
+	RevokeAccessToken(jti string, expiresAt time.Time) error
+	IsAccessTokenRevoked(jti string) (bool, error)
+	PruneRevocations(before time.Time) (int, error)
+}
+
+// PasswordResetStore holds outstanding password reset requests by the hash
+// of their secret token. TakePasswordReset is how a request gets used: it
+// deletes the request along with every other one for the same user, and
+// returns errNotFound if it was already gone, so each works at most once.
+// PrunePasswordResets drops the ones that expired before the given time.
+// Like revocations, resets are not part of snapshots, and a restore
+// discards them.
+type PasswordResetStore interface {
+	GetPasswordReset(token string) (PasswordReset, error)
+	SavePasswordReset(reset PasswordReset) error
+	TakePasswordReset(token string) (PasswordReset, error)
+	PrunePasswordResets(before time.Time) (int, error)
+}
+
+// storeSnapshot is a point-in-time copy of every collection, used for
+// backups, restores and moving data between backends.
+type storeSnapshot struct {
+	Chirps       ChirpData            `json:"chirps"`
+	Users        UserData             `json:"users"`
+	Tokens       RefreshTokens        `json:"tokens"`
+	AccessTokens PersonalAccessTokens `json:"access_tokens"`
+	OAuthClients OAuthClients         `json:"oauth_clients"`
+}
+
+// Store is everything the handlers need to persist. CreateChirp and
+// CreateUser assign the record id, so callers leave it zero. CreateUser and
+// UpdateUserFunc return errDuplicateEmail rather than letting two users share an
+// address. Snapshot returns a consistent copy of all collections and Restore
+// replaces all of them in one atomic step. Implementations must be safe for
+// concurrent use.
+type Store interface {
+	ChirpStore
+	UserStore
+	RefreshTokenStore
+	PersonalAccessTokenStore
+	OAuthClientStore
+	RevocationStore
+	PasswordResetStore
+	Snapshot() (storeSnapshot, error)
+	Restore(snap storeSnapshot) error
+	Close() error
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// jsonStore keeps the data in memory, with each collection snapshotted to
+// its own JSON file. Mutations are appended to a write-ahead log instead of
+// rewriting the snapshot, and compact folds the log back into the snapshots
+// from time to time. On startup the log is replayed over the snapshots.
+type jsonStore struct {
+	*memoryStore
+	wal *writeAheadLog
+
+	chirpFile      string
+	userFile       string
+	tokenFile      string
+	patFile        string
+	clientFile     string
+	revocationFile string
+	resetFile      string
+}
+
+func newJSONStore(chirpFile, userFile, tokenFile, patFile, clientFile, revocationFile, resetFile, walFile string) (*jsonStore, error) {
+	mem, err := readJSONSnapshots(chirpFile, userFile, tokenFile, patFile, clientFile, revocationFile, resetFile)
+	if err != nil {
+		return nil, err
+	}
+	wal, err := openWAL(walFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := wal.replay(mem.apply); err != nil {
+		wal.Close()
+		return nil, err
+	}
+	mem.journal = wal.append
+
+	store := &jsonStore{
+		memoryStore:    mem,
+		wal:            wal,
+		chirpFile:      chirpFile,
+		userFile:       userFile,
+		tokenFile:      tokenFile,
+		patFile:        patFile,
+		clientFile:     clientFile,
+		revocationFile: revocationFile,
+		resetFile:      resetFile,
+	}
+	// Refresh tokens saved before secrets were hashed are hashed in place and
+	// written out straight away, so raw secrets do not outlive the upgrade.
+	if !mem.tokens.Hashed {
+		mem.tokens = hashRefreshTokens(mem.tokens)
+		mem.reindexTokens()
+		if err := store.writeSnapshot(); err != nil {
+			wal.Close()
+			return nil, fmt.Errorf("hashing stored refresh tokens: %w", err)
+		}
+		fmt.Printf("Hashed %d stored refresh tokens\n", len(mem.tokens.Tokens))
+	}
+	return store, nil
+}
+
+// readJSONSnapshots loads every collection's snapshot file into a
+// memoryStore, without the write-ahead log.
+func readJSONSnapshots(chirpFile, userFile, tokenFile, patFile, clientFile, revocationFile, resetFile string) (*memoryStore, error) {
+	chirps, err := readChirps(chirpFile)
+	if err != nil {
+		return nil, err
+	}
+	users, err := readUsers(userFile)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := readTokens(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	pats, err := readPersonalAccessTokens(patFile)
+	if err != nil {
+		return nil, err
+	}
+	clients, err := readOAuthClients(clientFile)
+	if err != nil {
+		return nil, err
+	}
+	revocations, err := readRevocations(revocationFile)
+	if err != nil {
+		return nil, err
+	}
+	resets, err := readPasswordResets(resetFile)
+	if err != nil {
+		return nil, err
+	}
+
+	mem := newMemoryStore()
+	mem.chirps = chirps
+	mem.users = users
+	mem.tokens = tokens
+	mem.reindexTokens()
+	mem.pats = pats
+	mem.reindexPATs()
+	mem.clients = clients
+	mem.revoked = revocations
+	mem.resets = resets
+	return mem, nil
+}
+
+// readJSONStore loads the JSON store, write-ahead log included, for reading
+// only. Unlike newJSONStore it writes nothing back: a torn final log entry
+// is skipped rather than truncated, and refresh tokens from before hashing
+// are only hashed in memory.
+func readJSONStore(chirpFile, userFile, tokenFile, patFile, clientFile, revocationFile, resetFile, walFile string) (*memoryStore, error) {
+	mem, err := readJSONSnapshots(chirpFile, userFile, tokenFile, patFile, clientFile, revocationFile, resetFile)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(walFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		defer file.Close()
+		if _, _, err := replayWALEntries(file, mem.apply); err != nil {
+			return nil, err
+		}
+	}
+	if !mem.tokens.Hashed {
+		mem.tokens = hashRefreshTokens(mem.tokens)
+		mem.reindexTokens()
+	}
+	return mem, nil
+}
+
+// compact writes a snapshot of every collection and empties the log. The
+// read locks keep writers out so the snapshots and the log agree.
+func (s *jsonStore) compact() error {
+	s.rLockAll()
+	defer s.rUnlockAll()
+
+	if s.wal.len() == 0 {
+		return nil
+	}
+	return s.writeSnapshot()
+}
+
+// writeSnapshot saves every collection and empties the log. The caller must
+// keep writers out.
+func (s *jsonStore) writeSnapshot() error {
+	if err := saveChirps(s.chirpFile, s.chirps); err != nil {
+		return err
+	}
+	if err := saveUsers(s.userFile, s.users); err != nil {
+		return err
+	}
+	if err := saveTokens(s.tokenFile, s.tokens); err != nil {
+		return err
+	}
+	if err := savePersonalAccessTokens(s.patFile, s.pats); err != nil {
+		return err
+	}
+	if err := saveOAuthClients(s.clientFile, s.clients); err != nil {
+		return err
+	}
+	if err := saveRevocations(s.revocationFile, s.revoked); err != nil {
+		return err
+	}
+	if err := savePasswordResets(s.resetFile, s.resets); err != nil {
+		return err
+	}
+	return s.wal.reset()
+}
+
+// compactEvery runs compact on a timer for the life of the process.
+func (s *jsonStore) compactEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			if err := s.compact(); err != nil {
+				fmt.Printf("Failed to compact write-ahead log: %s\n", err)
+			}
+		}
+	}()
+}
+
+func (s *jsonStore) Close() error {
+	if err := s.compact(); err != nil {
+		return err
+	}
+	return s.wal.Close()
+}
@@ -0,0 +1,715 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryStore holds everything in maps guarded by one lock per collection.
+// On its own it never touches disk and is meant for tests and throwaway
+// local runs. jsonStore builds on it by setting journal, which is handed
+// every mutation with the collection lock held before the mutation is
+// applied; if it fails the mutation is not applied.
+type memoryStore struct {
+	chirpMu sync.RWMutex
+	chirps  ChirpData
+
+	userMu sync.RWMutex
+	users  UserData
+
+	tokenMu    sync.RWMutex
+	tokens     RefreshTokens
+	tokenIndex map[string]string
+
+	patMu    sync.RWMutex
+	pats     PersonalAccessTokens
+	patIndex map[string]string
+
+	clientMu sync.RWMutex
+	clients  OAuthClients
+
+	revokedMu sync.RWMutex
+	revoked   AccessRevocations
+
+	resetMu sync.RWMutex
+	resets  PasswordResets
+
+	journal func(walEntry) error
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		chirps:     ChirpData{Chirps: make(map[int]Chirp), NextId: 1},
+		users:      UserData{Users: make(map[int]User), NextId: 1},
+		tokens:     RefreshTokens{Tokens: make(map[string]RefreshToken), Hashed: true},
+		tokenIndex: make(map[string]string),
+		pats:       PersonalAccessTokens{Tokens: make(map[string]PersonalAccessToken)},
+		patIndex:   make(map[string]string),
+		clients:    OAuthClients{Clients: make(map[string]OAuthClient)},
+		revoked:    AccessRevocations{Revoked: make(map[string]time.Time)},
+		resets:     PasswordResets{Resets: make(map[string]PasswordReset)},
+	}
+}
+
+// commit journals entry and then applies it. The caller must hold the lock
+// for the collection entry touches.
+func (s *memoryStore) commit(entry walEntry) error {
+	if s.journal != nil {
+		if err := s.journal(entry); err != nil {
+			return err
+		}
+	}
+	s.apply(entry)
+	return nil
+}
+
+// apply makes the change described by entry without taking any locks. It is
+// also used to replay the write-ahead log before the store is shared.
+func (s *memoryStore) apply(entry walEntry) {
+	switch entry.Op {
+	case opPutChirp:
+		s.chirps.Chirps[entry.Chirp.Id] = *entry.Chirp
+		s.chirps.NextId = max(s.chirps.NextId, entry.Chirp.Id+1)
+	case opDeleteChirp:
+		delete(s.chirps.Chirps, entry.Id)
+	case opPutUser:
+		s.users.Users[entry.User.Id] = *entry.User
+		s.users.NextId = max(s.users.NextId, entry.User.Id+1)
+	case opPutToken:
+		token := *entry.Token
+		if token.Id == "" {
+			token.Id = legacyTokenId(token.UserId)
+		}
+		s.unindexToken(s.tokens.Tokens[token.Id])
+		s.tokens.Tokens[token.Id] = token
+		s.indexToken(token)
+	case opDeleteToken:
+		if entry.Key == "" {
+			entry.Key = legacyTokenId(entry.Id)
+		}
+		s.unindexToken(s.tokens.Tokens[entry.Key])
+		delete(s.tokens.Tokens, entry.Key)
+	case opDeleteUserTokens:
+		for id, val := range s.tokens.Tokens {
+			if val.UserId == entry.Id {
+				s.unindexToken(val)
+				delete(s.tokens.Tokens, id)
+			}
+		}
+	case opDeleteClientTokens:
+		for id, val := range s.tokens.Tokens {
+			if val.ClientId == entry.Key {
+				s.unindexToken(val)
+				delete(s.tokens.Tokens, id)
+			}
+		}
+	case opPruneTokens:
+		for id, val := range s.tokens.Tokens {
+			if val.ExirationDate.Before(*entry.Time) {
+				s.unindexToken(val)
+				delete(s.tokens.Tokens, id)
+			}
+		}
+	case opPutPAT:
+		delete(s.patIndex, s.pats.Tokens[entry.PAT.Id].Token)
+		s.pats.Tokens[entry.PAT.Id] = *entry.PAT
+		s.patIndex[entry.PAT.Token] = entry.PAT.Id
+	case opDeletePAT:
+		delete(s.patIndex, s.pats.Tokens[entry.Key].Token)
+		delete(s.pats.Tokens, entry.Key)
+	case opDeleteUserPATs:
+		for id, val := range s.pats.Tokens {
+			if val.UserId == entry.Id {
+				delete(s.patIndex, val.Token)
+				delete(s.pats.Tokens, id)
+			}
+		}
+	case opPutClient:
+		s.clients.Clients[entry.Client.Id] = *entry.Client
+	case opDeleteClient:
+		delete(s.clients.Clients, entry.Key)
+	case opRevokeAccess:
+		s.revoked.Revoked[entry.Key] = *entry.Time
+	case opPruneRevocations:
+		for jti, expiresAt := range s.revoked.Revoked {
+			if expiresAt.Before(*entry.Time) {
+				delete(s.revoked.Revoked, jti)
+			}
+		}
+	case opPutReset:
+		s.resets.Resets[entry.Reset.Token] = *entry.Reset
+	case opTakeReset:
+		for hash, val := range s.resets.Resets {
+			if val.UserId == entry.Id {
+				delete(s.resets.Resets, hash)
+			}
+		}
+	case opPruneResets:
+		for hash, val := range s.resets.Resets {
+			if val.ExpiresAt.Before(*entry.Time) {
+				delete(s.resets.Resets, hash)
+			}
+		}
+	case opRestore:
+		snap := copySnapshot(*entry.Snapshot)
+		s.chirps = snap.Chirps
+		s.chirps.setNextId()
+		s.users = snap.Users
+		s.users.setNextId()
+		s.tokens = snap.Tokens
+		s.reindexTokens()
+		s.pats = snap.AccessTokens
+		s.reindexPATs()
+		s.clients = snap.OAuthClients
+		s.resets = PasswordResets{Resets: make(map[string]PasswordReset)}
+	}
+}
+
+// reindexPATs rebuilds the hash to id index of personal access tokens.
+// The caller must hold patMu for writing.
+func (s *memoryStore) reindexPATs() {
+	s.patIndex = make(map[string]string, len(s.pats.Tokens))
+	for id, val := range s.pats.Tokens {
+		s.patIndex[val.Token] = id
+	}
+}
+
+// indexToken records which session each of token's current and retired
+// hashes belongs to. The caller must hold tokenMu for writing.
+func (s *memoryStore) indexToken(token RefreshToken) {
+	s.tokenIndex[token.Token] = token.Id
+	for _, old := range token.Retired {
+		s.tokenIndex[old] = token.Id
+	}
+}
+
+func (s *memoryStore) unindexToken(token RefreshToken) {
+	delete(s.tokenIndex, token.Token)
+	for _, old := range token.Retired {
+		delete(s.tokenIndex, old)
+	}
+}
+
+func (s *memoryStore) reindexTokens() {
+	s.tokenIndex = make(map[string]string, len(s.tokens.Tokens))
+	for _, val := range s.tokens.Tokens {
+		s.indexToken(val)
+	}
+}
+
+func (s *memoryStore) GetChirps() ([]Chirp, error) {
+	s.chirpMu.RLock()
+	defer s.chirpMu.RUnlock()
+
+	out := make([]Chirp, 0, len(s.chirps.Chirps))
+	for _, val := range s.chirps.Chirps {
+		out = append(out, val)
+	}
+	return out, nil
+}
+
+func (s *memoryStore) GetChirp(id int) (Chirp, error) {
+	s.chirpMu.RLock()
+	defer s.chirpMu.RUnlock()
+
+	chirp, ok := s.chirps.Chirps[id]
+	if !ok {
+		return Chirp{}, errNotFound
+	}
+	return chirp, nil
+}
+
+func (s *memoryStore) CreateChirp(chirp Chirp) (Chirp, error) {
+	s.chirpMu.Lock()
+	defer s.chirpMu.Unlock()
+
+	chirp.Id = s.chirps.NextId
+	if err := s.commit(walEntry{Op: opPutChirp, Chirp: &chirp}); err != nil {
+		return Chirp{}, err
+	}
+	return chirp, nil
+}
+
+func (s *memoryStore) DeleteChirp(id int) error {
+	s.chirpMu.Lock()
+	defer s.chirpMu.Unlock()
+
+	if _, ok := s.chirps.Chirps[id]; !ok {
+		return errNotFound
+	}
+	return s.commit(walEntry{Op: opDeleteChirp, Id: id})
+}
+
+func (s *memoryStore) GetUser(id int) (User, error) {
+	s.userMu.RLock()
+	defer s.userMu.RUnlock()
+
+	user, ok := s.users.Users[id]
+	if !ok {
+		return User{}, errNotFound
+	}
+	return user, nil
+}
+
+func (s *memoryStore) GetUserByEmail(email string) (User, error) {
+	s.userMu.RLock()
+	defer s.userMu.RUnlock()
+
+	return s.findUserByEmail(email)
+}
+
+func (s *memoryStore) GetUserByOIDCSubject(issuer, subject string) (User, error) {
+	s.userMu.RLock()
+	defer s.userMu.RUnlock()
+
+	for _, val := range s.users.Users {
+		if val.OIDCSubject != "" && val.OIDCIssuer == issuer && val.OIDCSubject == subject {
+			return val, nil
+		}
+	}
+	return User{}, errNotFound
+}
+
+func (s *memoryStore) findUserByEmail(email string) (User, error) {
+	for _, val := range s.users.Users {
+		if strings.ToLower(val.Email) == strings.ToLower(email) {
+			return val, nil
+		}
+	}
+	return User{}, errNotFound
+}
+
+func (s *memoryStore) CreateUser(user User) (User, error) {
+	s.userMu.Lock()
+	defer s.userMu.Unlock()
+
+	if _, err := s.findUserByEmail(user.Email); err == nil {
+		return User{}, errDuplicateEmail
+	}
+	user.Id = s.users.NextId
+	if err := s.commit(walEntry{Op: opPutUser, User: &user}); err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+func (s *memoryStore) UpdateUserFunc(id int, update func(user *User) error) (User, error) {
+	s.userMu.Lock()
+	defer s.userMu.Unlock()
+
+	user, ok := s.users.Users[id]
+	if !ok {
+		return User{}, errNotFound
+	}
+	// The stored slice must not change if update fails.
+	user.RecoveryCodes = slices.Clone(user.RecoveryCodes)
+	if err := update(&user); err != nil {
+		return User{}, err
+	}
+	user.Id = id
+	if other, err := s.findUserByEmail(user.Email); err == nil && other.Id != id {
+		return User{}, errDuplicateEmail
+	}
+	if err := s.commit(walEntry{Op: opPutUser, User: &user}); err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+func (s *memoryStore) GetRefreshToken(token string) (RefreshToken, error) {
+	s.tokenMu.RLock()
+	defer s.tokenMu.RUnlock()
+
+	val, ok := s.tokens.Tokens[s.tokenIndex[token]]
+	if !ok {
+		return RefreshToken{}, errNotFound
+	}
+	if refreshTokenHashEqual(val.Token, token) {
+		return val, nil
+	}
+	if slices.Contains(val.Retired, token) {
+		return val, errTokenReused
+	}
+	return RefreshToken{}, errNotFound
+}
+
+func (s *memoryStore) GetSession(id string) (RefreshToken, error) {
+	s.tokenMu.RLock()
+	defer s.tokenMu.RUnlock()
+
+	val, ok := s.tokens.Tokens[id]
+	if !ok {
+		return RefreshToken{}, errNotFound
+	}
+	return val, nil
+}
+
+func (s *memoryStore) GetUserRefreshTokens(userId int) ([]RefreshToken, error) {
+	s.tokenMu.RLock()
+	defer s.tokenMu.RUnlock()
+
+	out := []RefreshToken{}
+	for _, val := range s.tokens.Tokens {
+		if val.UserId == userId {
+			out = append(out, val)
+		}
+	}
+	return out, nil
+}
+
+func (s *memoryStore) SaveRefreshToken(token RefreshToken) error {
+	s.tokenMu.Lock()
+	defer s.tokenMu.Unlock()
+
+	return s.commit(walEntry{Op: opPutToken, Token: &token})
+}
+
+func (s *memoryStore) RotateRefreshToken(id, oldToken, newToken string, usedAt time.Time) (RefreshToken, error) {
+	s.tokenMu.Lock()
+	defer s.tokenMu.Unlock()
+
+	val, ok := s.tokens.Tokens[id]
+	if !ok {
+		return RefreshToken{}, errNotFound
+	}
+	if !refreshTokenHashEqual(val.Token, oldToken) {
+		return val, errTokenReused
+	}
+	retired := append(slices.Clip(val.Retired), oldToken)
+	if len(retired) > refreshTokenRetiredKept {
+		retired = slices.Clone(retired[len(retired)-refreshTokenRetiredKept:])
+	}
+	val.Retired = retired
+	val.Token = newToken
+	val.LastUsedAt = usedAt
+	if err := s.commit(walEntry{Op: opPutToken, Token: &val}); err != nil {
+		return RefreshToken{}, err
+	}
+	return val, nil
+}
+
+func (s *memoryStore) DeleteRefreshToken(id string) error {
+	s.tokenMu.Lock()
+	defer s.tokenMu.Unlock()
+
+	if _, ok := s.tokens.Tokens[id]; !ok {
+		return errNotFound
+	}
+	return s.commit(walEntry{Op: opDeleteToken, Key: id})
+}
+
+func (s *memoryStore) DeleteUserRefreshTokens(userId int) error {
+	s.tokenMu.Lock()
+	defer s.tokenMu.Unlock()
+
+	return s.commit(walEntry{Op: opDeleteUserTokens, Id: userId})
+}
+
+func (s *memoryStore) DeleteClientRefreshTokens(clientId string) error {
+	s.tokenMu.Lock()
+	defer s.tokenMu.Unlock()
+
+	return s.commit(walEntry{Op: opDeleteClientTokens, Key: clientId})
+}
+
+func (s *memoryStore) PruneRefreshTokens(before time.Time) (int, error) {
+	s.tokenMu.Lock()
+	defer s.tokenMu.Unlock()
+
+	expired := 0
+	for _, val := range s.tokens.Tokens {
+		if val.ExirationDate.Before(before) {
+			expired++
+		}
+	}
+	if expired == 0 {
+		return 0, nil
+	}
+	if err := s.commit(walEntry{Op: opPruneTokens, Time: &before}); err != nil {
+		return 0, err
+	}
+	return expired, nil
+}
+
+func (s *memoryStore) GetPersonalAccessToken(token string) (PersonalAccessToken, error) {
+	s.patMu.RLock()
+	defer s.patMu.RUnlock()
+
+	id, ok := s.patIndex[token]
+	if !ok {
+		return PersonalAccessToken{}, errNotFound
+	}
+	return clonePAT(s.pats.Tokens[id]), nil
+}
+
+func (s *memoryStore) GetUserPersonalAccessTokens(userId int) ([]PersonalAccessToken, error) {
+	s.patMu.RLock()
+	defer s.patMu.RUnlock()
+
+	tokens := []PersonalAccessToken{}
+	for _, val := range s.pats.Tokens {
+		if val.UserId == userId {
+			tokens = append(tokens, clonePAT(val))
+		}
+	}
+	return tokens, nil
+}
+
+func (s *memoryStore) SavePersonalAccessToken(token PersonalAccessToken) error {
+	s.patMu.Lock()
+	defer s.patMu.Unlock()
+
+	token = clonePAT(token)
+	return s.commit(walEntry{Op: opPutPAT, PAT: &token})
+}
+
+func (s *memoryStore) DeletePersonalAccessToken(id string) error {
+	s.patMu.Lock()
+	defer s.patMu.Unlock()
+
+	if _, ok := s.pats.Tokens[id]; !ok {
+		return errNotFound
+	}
+	return s.commit(walEntry{Op: opDeletePAT, Key: id})
+}
+
+func (s *memoryStore) DeleteUserPersonalAccessTokens(userId int) error {
+	s.patMu.Lock()
+	defer s.patMu.Unlock()
+
+	return s.commit(walEntry{Op: opDeleteUserPATs, Id: userId})
+}
+
+func clonePAT(token PersonalAccessToken) PersonalAccessToken {
+	token.Scopes = slices.Clone(token.Scopes)
+	return token
+}
+
+func (s *memoryStore) GetOAuthClient(id string) (OAuthClient, error) {
+	s.clientMu.RLock()
+	defer s.clientMu.RUnlock()
+
+	client, ok := s.clients.Clients[id]
+	if !ok {
+		return OAuthClient{}, errNotFound
+	}
+	return cloneOAuthClient(client), nil
+}
+
+func (s *memoryStore) GetUserOAuthClients(ownerId int) ([]OAuthClient, error) {
+	s.clientMu.RLock()
+	defer s.clientMu.RUnlock()
+
+	clients := []OAuthClient{}
+	for _, val := range s.clients.Clients {
+		if val.OwnerId == ownerId {
+			clients = append(clients, cloneOAuthClient(val))
+		}
+	}
+	return clients, nil
+}
+
+func (s *memoryStore) SaveOAuthClient(client OAuthClient) error {
+	s.clientMu.Lock()
+	defer s.clientMu.Unlock()
+
+	client = cloneOAuthClient(client)
+	return s.commit(walEntry{Op: opPutClient, Client: &client})
+}
+
+func (s *memoryStore) DeleteOAuthClient(id string) error {
+	s.clientMu.Lock()
+	defer s.clientMu.Unlock()
+
+	if _, ok := s.clients.Clients[id]; !ok {
+		return errNotFound
+	}
+	return s.commit(walEntry{Op: opDeleteClient, Key: id})
+}
+
+func cloneOAuthClient(client OAuthClient) OAuthClient {
+	client.RedirectURIs = slices.Clone(client.RedirectURIs)
+	return client
+}
+
+func (s *memoryStore) RevokeAccessToken(jti string, expiresAt time.Time) error {
+	s.revokedMu.Lock()
+	defer s.revokedMu.Unlock()
+
+	if _, ok := s.revoked.Revoked[jti]; ok {
+		return errAlreadyRevoked
+	}
+	return s.commit(walEntry{Op: opRevokeAccess, Key: jti, Time: &expiresAt})
+}
+
+func (s *memoryStore) IsAccessTokenRevoked(jti string) (bool, error) {
+	s.revokedMu.RLock()
+	defer s.revokedMu.RUnlock()
+
+	_, ok := s.revoked.Revoked[jti]
+	return ok, nil
+}
+
+func (s *memoryStore) PruneRevocations(before time.Time) (int, error) {
+	s.revokedMu.Lock()
+	defer s.revokedMu.Unlock()
+
+	expired := 0
+	for _, expiresAt := range s.revoked.Revoked {
+		if expiresAt.Before(before) {
+			expired++
+		}
+	}
+	if expired == 0 {
+		return 0, nil
+	}
+	if err := s.commit(walEntry{Op: opPruneRevocations, Time: &before}); err != nil {
+		return 0, err
+	}
+	return expired, nil
+}
+
+func (s *memoryStore) GetPasswordReset(token string) (PasswordReset, error) {
+	s.resetMu.RLock()
+	defer s.resetMu.RUnlock()
+
+	reset, ok := s.resets.Resets[token]
+	if !ok {
+		return PasswordReset{}, errNotFound
+	}
+	return reset, nil
+}
+
+func (s *memoryStore) SavePasswordReset(reset PasswordReset) error {
+	s.resetMu.Lock()
+	defer s.resetMu.Unlock()
+
+	return s.commit(walEntry{Op: opPutReset, Reset: &reset})
+}
+
+func (s *memoryStore) TakePasswordReset(token string) (PasswordReset, error) {
+	s.resetMu.Lock()
+	defer s.resetMu.Unlock()
+
+	reset, ok := s.resets.Resets[token]
+	if !ok {
+		return PasswordReset{}, errNotFound
+	}
+	if err := s.commit(walEntry{Op: opTakeReset, Id: reset.UserId}); err != nil {
+		return PasswordReset{}, err
+	}
+	return reset, nil
+}
+
+func (s *memoryStore) PrunePasswordResets(before time.Time) (int, error) {
+	s.resetMu.Lock()
+	defer s.resetMu.Unlock()
+
+	expired := 0
+	for _, val := range s.resets.Resets {
+		if val.ExpiresAt.Before(before) {
+			expired++
+		}
+	}
+	if expired == 0 {
+		return 0, nil
+	}
+	if err := s.commit(walEntry{Op: opPruneResets, Time: &before}); err != nil {
+		return 0, err
+	}
+	return expired, nil
+}
+
+func (s *memoryStore) lockAll() {
+	s.chirpMu.Lock()
+	s.userMu.Lock()
+	s.tokenMu.Lock()
+	s.patMu.Lock()
+	s.clientMu.Lock()
+	s.revokedMu.Lock()
+	s.resetMu.Lock()
+}
+
+func (s *memoryStore) unlockAll() {
+	s.resetMu.Unlock()
+	s.revokedMu.Unlock()
+	s.clientMu.Unlock()
+	s.patMu.Unlock()
+	s.tokenMu.Unlock()
+	s.userMu.Unlock()
+	s.chirpMu.Unlock()
+}
+
+func (s *memoryStore) rLockAll() {
+	s.chirpMu.RLock()
+	s.userMu.RLock()
+	s.tokenMu.RLock()
+	s.patMu.RLock()
+	s.clientMu.RLock()
+	s.revokedMu.RLock()
+	s.resetMu.RLock()
+}
+
+func (s *memoryStore) rUnlockAll() {
+	s.resetMu.RUnlock()
+	s.revokedMu.RUnlock()
+	s.clientMu.RUnlock()
+	s.patMu.RUnlock()
+	s.tokenMu.RUnlock()
+	s.userMu.RUnlock()
+	s.chirpMu.RUnlock()
+}
+
+func (s *memoryStore) Snapshot() (storeSnapshot, error) {
+	s.rLockAll()
+	defer s.rUnlockAll()
+
+	return copySnapshot(storeSnapshot{Chirps: s.chirps, Users: s.users, Tokens: s.tokens, AccessTokens: s.pats, OAuthClients: s.clients}), nil
+}
+
+func (s *memoryStore) Restore(snap storeSnapshot) error {
+	s.lockAll()
+	defer s.unlockAll()
+
+	return s.commit(walEntry{Op: opRestore, Snapshot: &snap})
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// copySnapshot returns a snapshot whose maps share nothing with snap.
+func copySnapshot(snap storeSnapshot) storeSnapshot {
+	out := storeSnapshot{
+		Chirps: ChirpData{Chirps: make(map[int]Chirp, len(snap.Chirps.Chirps)), NextId: snap.Chirps.NextId},
+		Users:  UserData{Users: make(map[int]User, len(snap.Users.Users)), NextId: snap.Users.NextId},
+		Tokens: RefreshTokens{Tokens: make(map[string]RefreshToken, len(snap.Tokens.Tokens)), Hashed: snap.Tokens.Hashed},
+		AccessTokens: PersonalAccessTokens{
+			Tokens: make(map[string]PersonalAccessToken, len(snap.AccessTokens.Tokens)),
+		},
+		OAuthClients: OAuthClients{
+			Clients: make(map[string]OAuthClient, len(snap.OAuthClients.Clients)),
+		},
+	}
+	for id, val := range snap.Chirps.Chirps {
+		out.Chirps.Chirps[id] = val
+	}
+	for id, val := range snap.Users.Users {
+		val.RecoveryCodes = slices.Clone(val.RecoveryCodes)
+		out.Users.Users[id] = val
+	}
+	for id, val := range snap.Tokens.Tokens {
+		val.Retired = slices.Clone(val.Retired)
+		val.Scopes = slices.Clone(val.Scopes)
+		out.Tokens.Tokens[id] = val
+	}
+	for id, val := range snap.AccessTokens.Tokens {
+		out.AccessTokens.Tokens[id] = clonePAT(val)
+	}
+	for id, val := range snap.OAuthClients.Clients {
+		out.OAuthClients.Clients[id] = cloneOAuthClient(val)
+	}
+	return out
+}
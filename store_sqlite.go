@@ -0,0 +1,796 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// sqliteStore keeps everything in a single embedded SQLite database. The
+// schema is owned by migrations.go and brought up to date on open.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+// openSQLite opens the database with transactions that take the write lock
+// as they begin, so a transaction that reads a row and then updates it
+// cannot lose the race to another writer halfway through.
+func openSQLite(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate")
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func newSQLiteStore(path string) (*sqliteStore, error) {
+	db, err := openSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := migrateUp(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *sqliteStore) GetChirps() ([]Chirp, error) {
+	rows, err := s.db.Query(`SELECT id, body, author_id FROM chirps`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []Chirp{}
+	for rows.Next() {
+		chirp := Chirp{}
+		if err := rows.Scan(&chirp.Id, &chirp.Body, &chirp.AuthorId); err != nil {
+			return nil, err
+		}
+		out = append(out, chirp)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqliteStore) GetChirp(id int) (Chirp, error) {
+	chirp := Chirp{}
+	err := s.db.QueryRow(`SELECT id, body, author_id FROM chirps WHERE id = ?`, id).
+		Scan(&chirp.Id, &chirp.Body, &chirp.AuthorId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, errNotFound
+	}
+	return chirp, err
+}
+
+func (s *sqliteStore) CreateChirp(chirp Chirp) (Chirp, error) {
+	res, err := s.db.Exec(`INSERT INTO chirps (body, author_id) VALUES (?, ?)`, chirp.Body, chirp.AuthorId)
+	if err != nil {
+		return Chirp{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Chirp{}, err
+	}
+	chirp.Id = int(id)
+	return chirp, nil
+}
+
+func (s *sqliteStore) DeleteChirp(id int) error {
+	return expectOneRow(s.db.Exec(`DELETE FROM chirps WHERE id = ?`, id))
+}
+
+const userColumns = `id, email, password_hash, is_chirpy_red, pending_email, email_verified,
+	totp_secret, totp_pending_secret, totp_last_step, recovery_codes, oidc_issuer, oidc_subject`
+
+func (s *sqliteStore) GetUser(id int) (User, error) {
+	return scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+}
+
+func (s *sqliteStore) GetUserByEmail(email string) (User, error) {
+	return scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE email = ?`, email))
+}
+
+func (s *sqliteStore) GetUserByOIDCSubject(issuer, subject string) (User, error) {
+	return scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users
+		WHERE oidc_subject != '' AND oidc_issuer = ? AND oidc_subject = ?`, issuer, subject))
+}
+
+func (s *sqliteStore) CreateUser(user User) (User, error) {
+	res, err := s.db.Exec(`INSERT INTO users (email, password_hash, is_chirpy_red, pending_email, email_verified,
+		totp_secret, totp_pending_secret, totp_last_step, recovery_codes, oidc_issuer, oidc_subject)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		user.Email, user.PasswordHash, user.IsChirpyRed, user.PendingEmail, user.EmailVerified,
+		user.TOTPSecret, user.TOTPPendingSecret, user.TOTPLastStep, strings.Join(user.RecoveryCodes, " "),
+		user.OIDCIssuer, user.OIDCSubject)
+	if isUniqueViolation(err) {
+		return User{}, errDuplicateEmail
+	}
+	if err != nil {
+		return User{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return User{}, err
+	}
+	user.Id = int(id)
+	return user, nil
+}
+
+func (s *sqliteStore) UpdateUserFunc(id int, update func(user *User) error) (User, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	user, err := scanUser(tx.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+	if err != nil {
+		return User{}, err
+	}
+	if err := update(&user); err != nil {
+		return User{}, err
+	}
+	user.Id = id
+	if err := updateUser(tx, user); err != nil {
+		return User{}, err
+	}
+	return user, tx.Commit()
+}
+
+func updateUser(tx *sql.Tx, user User) error {
+	err := expectOneRow(tx.Exec(`UPDATE users SET email = ?, password_hash = ?, is_chirpy_red = ?, pending_email = ?,
+		email_verified = ?, totp_secret = ?, totp_pending_secret = ?, totp_last_step = ?, recovery_codes = ?,
+		oidc_issuer = ?, oidc_subject = ?
+		WHERE id = ?`,
+		user.Email, user.PasswordHash, user.IsChirpyRed, user.PendingEmail, user.EmailVerified,
+		user.TOTPSecret, user.TOTPPendingSecret, user.TOTPLastStep, strings.Join(user.RecoveryCodes, " "),
+		user.OIDCIssuer, user.OIDCSubject, user.Id))
+	if isUniqueViolation(err) {
+		return errDuplicateEmail
+	}
+	return err
+}
+
+const refreshTokenColumns = `id, user_id, token, expires_at, device, user_agent, ip, created_at, last_used_at,
+	client_id, scopes`
+
+func scanRefreshToken(row rowScanner) (RefreshToken, error) {
+	token := RefreshToken{}
+	expiresAt, createdAt, lastUsedAt := int64(0), int64(0), int64(0)
+	scopes := ""
+	err := row.Scan(&token.Id, &token.UserId, &token.Token, &expiresAt,
+		&token.Device, &token.UserAgent, &token.IP, &createdAt, &lastUsedAt,
+		&token.ClientId, &scopes)
+	if errors.Is(err, sql.ErrNoRows) {
+		return RefreshToken{}, errNotFound
+	}
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	token.ExirationDate = time.Unix(expiresAt, 0).UTC()
+	token.CreatedAt = time.Unix(createdAt, 0).UTC()
+	token.LastUsedAt = time.Unix(lastUsedAt, 0).UTC()
+	if scopes != "" {
+		token.Scopes = strings.Fields(scopes)
+	}
+	return token, nil
+}
+
+func scanRefreshTokens(rows *sql.Rows) ([]RefreshToken, error) {
+	defer rows.Close()
+	out := []RefreshToken{}
+	for rows.Next() {
+		token, err := scanRefreshToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, token)
+	}
+	return out, rows.Err()
+}
+
+// GetRefreshToken finds candidates by selector and compares the full hash
+// in Go, in constant time, rather than letting the database compare it.
+func (s *sqliteStore) GetRefreshToken(token string) (RefreshToken, error) {
+	selector := refreshTokenSelector(token)
+	rows, err := s.db.Query(`SELECT `+refreshTokenColumns+` FROM refresh_tokens WHERE selector = ?`, selector)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	candidates, err := scanRefreshTokens(rows)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	for _, found := range candidates {
+		if refreshTokenHashEqual(found.Token, token) {
+			return found, nil
+		}
+	}
+
+	rows, err = s.db.Query(`SELECT token, session_id FROM retired_refresh_tokens WHERE selector = ?`, selector)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	defer rows.Close()
+	sessionId := ""
+	for rows.Next() {
+		retired, id := "", ""
+		if err := rows.Scan(&retired, &id); err != nil {
+			return RefreshToken{}, err
+		}
+		if refreshTokenHashEqual(retired, token) {
+			sessionId = id
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return RefreshToken{}, err
+	}
+	if sessionId == "" {
+		return RefreshToken{}, errNotFound
+	}
+	found, err := s.GetSession(sessionId)
+	if err != nil {
+		return found, err
+	}
+	return found, errTokenReused
+}
+
+func (s *sqliteStore) GetSession(id string) (RefreshToken, error) {
+	return scanRefreshToken(s.db.QueryRow(`SELECT `+refreshTokenColumns+` FROM refresh_tokens WHERE id = ?`, id))
+}
+
+func (s *sqliteStore) GetUserRefreshTokens(userId int) ([]RefreshToken, error) {
+	rows, err := s.db.Query(`SELECT `+refreshTokenColumns+` FROM refresh_tokens WHERE user_id = ?`, userId)
+	if err != nil {
+		return nil, err
+	}
+	return scanRefreshTokens(rows)
+}
+
+func (s *sqliteStore) SaveRefreshToken(token RefreshToken) error {
+	return saveRefreshToken(s.db, token)
+}
+
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func saveRefreshToken(db execer, token RefreshToken) error {
+	_, err := db.Exec(`INSERT INTO refresh_tokens (`+refreshTokenColumns+`, selector) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET token = excluded.token, selector = excluded.selector, expires_at = excluded.expires_at,
+			device = excluded.device, user_agent = excluded.user_agent, ip = excluded.ip,
+			last_used_at = excluded.last_used_at, scopes = excluded.scopes`,
+		token.Id, token.UserId, token.Token, token.ExirationDate.Unix(), token.Device,
+		token.UserAgent, token.IP, token.CreatedAt.Unix(), token.LastUsedAt.Unix(),
+		token.ClientId, strings.Join(token.Scopes, " "), refreshTokenSelector(token.Token))
+	return err
+}
+
+func saveRetiredRefreshToken(db execer, token, sessionId string) error {
+	_, err := db.Exec(`INSERT INTO retired_refresh_tokens (token, session_id, selector) VALUES (?, ?, ?)`,
+		token, sessionId, refreshTokenSelector(token))
+	return err
+}
+
+// RotateRefreshToken only swaps the secret if it is still oldToken, so of
+// two refreshes racing with the same token exactly one wins. The
+// transaction holds the write lock from the start, so the secret cannot
+// change between checking and replacing it.
+func (s *sqliteStore) RotateRefreshToken(id, oldToken, newToken string, usedAt time.Time) (RefreshToken, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	defer tx.Rollback()
+
+	current, err := scanRefreshToken(tx.QueryRow(`SELECT `+refreshTokenColumns+` FROM refresh_tokens WHERE id = ?`, id))
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	if !refreshTokenHashEqual(current.Token, oldToken) {
+		return current, errTokenReused
+	}
+	_, err = tx.Exec(`UPDATE refresh_tokens SET token = ?, selector = ?, last_used_at = ? WHERE id = ?`,
+		newToken, refreshTokenSelector(newToken), usedAt.Unix(), id)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	if err := saveRetiredRefreshToken(tx, oldToken, id); err != nil {
+		return RefreshToken{}, err
+	}
+	_, err = tx.Exec(`DELETE FROM retired_refresh_tokens WHERE session_id = ? AND rowid NOT IN (
+		SELECT rowid FROM retired_refresh_tokens WHERE session_id = ? ORDER BY rowid DESC LIMIT ?)`,
+		id, id, refreshTokenRetiredKept)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	rotated, err := scanRefreshToken(tx.QueryRow(`SELECT `+refreshTokenColumns+` FROM refresh_tokens WHERE id = ?`, id))
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	return rotated, tx.Commit()
+}
+
+func (s *sqliteStore) DeleteRefreshToken(id string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM retired_refresh_tokens WHERE session_id = ?`, id); err != nil {
+		return err
+	}
+	if err := expectOneRow(tx.Exec(`DELETE FROM refresh_tokens WHERE id = ?`, id)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) DeleteUserRefreshTokens(userId int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM retired_refresh_tokens
+		WHERE session_id IN (SELECT id FROM refresh_tokens WHERE user_id = ?)`, userId)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM refresh_tokens WHERE user_id = ?`, userId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) PruneRefreshTokens(before time.Time) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM retired_refresh_tokens
+		WHERE session_id IN (SELECT id FROM refresh_tokens WHERE expires_at < ?)`, before.Unix())
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec(`DELETE FROM refresh_tokens WHERE expires_at < ?`, before.Unix())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), tx.Commit()
+}
+
+func (s *sqliteStore) DeleteClientRefreshTokens(clientId string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM retired_refresh_tokens
+		WHERE session_id IN (SELECT id FROM refresh_tokens WHERE client_id = ?)`, clientId)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM refresh_tokens WHERE client_id = ?`, clientId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const patColumns = `id, user_id, name, token, scopes, created_at, expires_at`
+
+func scanPersonalAccessToken(row rowScanner) (PersonalAccessToken, error) {
+	token := PersonalAccessToken{}
+	scopes := ""
+	createdAt, expiresAt := int64(0), int64(0)
+	err := row.Scan(&token.Id, &token.UserId, &token.Name, &token.Token, &scopes, &createdAt, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return PersonalAccessToken{}, errNotFound
+	}
+	if err != nil {
+		return PersonalAccessToken{}, err
+	}
+	token.Scopes = strings.Fields(scopes)
+	token.CreatedAt = time.Unix(createdAt, 0).UTC()
+	token.ExpiresAt = time.Unix(expiresAt, 0).UTC()
+	return token, nil
+}
+
+func scanPersonalAccessTokens(rows *sql.Rows) ([]PersonalAccessToken, error) {
+	defer rows.Close()
+	out := []PersonalAccessToken{}
+	for rows.Next() {
+		token, err := scanPersonalAccessToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, token)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqliteStore) GetPersonalAccessToken(token string) (PersonalAccessToken, error) {
+	return scanPersonalAccessToken(s.db.QueryRow(`SELECT `+patColumns+` FROM personal_access_tokens WHERE token = ?`, token))
+}
+
+func (s *sqliteStore) GetUserPersonalAccessTokens(userId int) ([]PersonalAccessToken, error) {
+	rows, err := s.db.Query(`SELECT `+patColumns+` FROM personal_access_tokens WHERE user_id = ?`, userId)
+	if err != nil {
+		return nil, err
+	}
+	return scanPersonalAccessTokens(rows)
+}
+
+func (s *sqliteStore) SavePersonalAccessToken(token PersonalAccessToken) error {
+	return savePersonalAccessToken(s.db, token)
+}
+
+func savePersonalAccessToken(db execer, token PersonalAccessToken) error {
+	_, err := db.Exec(`INSERT OR REPLACE INTO personal_access_tokens (`+patColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		token.Id, token.UserId, token.Name, token.Token, strings.Join(token.Scopes, " "),
+		token.CreatedAt.Unix(), token.ExpiresAt.Unix())
+	return err
+}
+
+func (s *sqliteStore) DeletePersonalAccessToken(id string) error {
+	return expectOneRow(s.db.Exec(`DELETE FROM personal_access_tokens WHERE id = ?`, id))
+}
+
+func (s *sqliteStore) DeleteUserPersonalAccessTokens(userId int) error {
+	_, err := s.db.Exec(`DELETE FROM personal_access_tokens WHERE user_id = ?`, userId)
+	return err
+}
+
+const oauthClientColumns = `id, owner_id, name, redirect_uris, secret, created_at`
+
+func scanOAuthClient(row rowScanner) (OAuthClient, error) {
+	client := OAuthClient{}
+	redirectURIs := ""
+	createdAt := int64(0)
+	err := row.Scan(&client.Id, &client.OwnerId, &client.Name, &redirectURIs, &client.Secret, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return OAuthClient{}, errNotFound
+	}
+	if err != nil {
+		return OAuthClient{}, err
+	}
+	client.RedirectURIs = strings.Fields(redirectURIs)
+	client.CreatedAt = time.Unix(createdAt, 0).UTC()
+	return client, nil
+}
+
+func scanOAuthClients(rows *sql.Rows) ([]OAuthClient, error) {
+	defer rows.Close()
+	out := []OAuthClient{}
+	for rows.Next() {
+		client, err := scanOAuthClient(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, client)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqliteStore) GetOAuthClient(id string) (OAuthClient, error) {
+	return scanOAuthClient(s.db.QueryRow(`SELECT `+oauthClientColumns+` FROM oauth_clients WHERE id = ?`, id))
+}
+
+func (s *sqliteStore) GetUserOAuthClients(ownerId int) ([]OAuthClient, error) {
+	rows, err := s.db.Query(`SELECT `+oauthClientColumns+` FROM oauth_clients WHERE owner_id = ?`, ownerId)
+	if err != nil {
+		return nil, err
+	}
+	return scanOAuthClients(rows)
+}
+
+func (s *sqliteStore) SaveOAuthClient(client OAuthClient) error {
+	return saveOAuthClient(s.db, client)
+}
+
+// saveOAuthClient stores redirect URIs space separated, which is safe as
+// validRedirectURI refuses any with a space in them.
+func saveOAuthClient(db execer, client OAuthClient) error {
+	_, err := db.Exec(`INSERT OR REPLACE INTO oauth_clients (`+oauthClientColumns+`) VALUES (?, ?, ?, ?, ?, ?)`,
+		client.Id, client.OwnerId, client.Name, strings.Join(client.RedirectURIs, " "),
+		client.Secret, client.CreatedAt.Unix())
+	return err
+}
+
+func (s *sqliteStore) DeleteOAuthClient(id string) error {
+	return expectOneRow(s.db.Exec(`DELETE FROM oauth_clients WHERE id = ?`, id))
+}
+
+func (s *sqliteStore) RevokeAccessToken(jti string, expiresAt time.Time) error {
+	res, err := s.db.Exec(`INSERT INTO revoked_access_tokens (jti, expires_at) VALUES (?, ?) ON CONFLICT (jti) DO NOTHING`,
+		jti, expiresAt.Unix())
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		return errAlreadyRevoked
+	}
+	return err
+}
+
+func (s *sqliteStore) IsAccessTokenRevoked(jti string) (bool, error) {
+	revoked := false
+	err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM revoked_access_tokens WHERE jti = ?)`, jti).Scan(&revoked)
+	return revoked, err
+}
+
+func (s *sqliteStore) PruneRevocations(before time.Time) (int, error) {
+	res, err := s.db.Exec(`DELETE FROM revoked_access_tokens WHERE expires_at < ?`, before.Unix())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func scanPasswordReset(row rowScanner) (PasswordReset, error) {
+	reset := PasswordReset{}
+	createdAt, expiresAt := int64(0), int64(0)
+	err := row.Scan(&reset.Token, &reset.UserId, &createdAt, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return PasswordReset{}, errNotFound
+	}
+	reset.CreatedAt = time.Unix(createdAt, 0).UTC()
+	reset.ExpiresAt = time.Unix(expiresAt, 0).UTC()
+	return reset, err
+}
+
+func (s *sqliteStore) GetPasswordReset(token string) (PasswordReset, error) {
+	return scanPasswordReset(s.db.QueryRow(`SELECT token, user_id, created_at, expires_at
+		FROM password_resets WHERE token = ?`, token))
+}
+
+func (s *sqliteStore) SavePasswordReset(reset PasswordReset) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO password_resets (token, user_id, created_at, expires_at)
+		VALUES (?, ?, ?, ?)`, reset.Token, reset.UserId, reset.CreatedAt.Unix(), reset.ExpiresAt.Unix())
+	return err
+}
+
+func (s *sqliteStore) TakePasswordReset(token string) (PasswordReset, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return PasswordReset{}, err
+	}
+	defer tx.Rollback()
+
+	reset, err := scanPasswordReset(tx.QueryRow(`SELECT token, user_id, created_at, expires_at
+		FROM password_resets WHERE token = ?`, token))
+	if err != nil {
+		return PasswordReset{}, err
+	}
+	if _, err := tx.Exec(`DELETE FROM password_resets WHERE user_id = ?`, reset.UserId); err != nil {
+		return PasswordReset{}, err
+	}
+	return reset, tx.Commit()
+}
+
+func (s *sqliteStore) PrunePasswordResets(before time.Time) (int, error) {
+	res, err := s.db.Exec(`DELETE FROM password_resets WHERE expires_at < ?`, before.Unix())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanUser(row rowScanner) (User, error) {
+	user := User{}
+	recoveryCodes := ""
+	err := row.Scan(&user.Id, &user.Email, &user.PasswordHash, &user.IsChirpyRed, &user.PendingEmail, &user.EmailVerified,
+		&user.TOTPSecret, &user.TOTPPendingSecret, &user.TOTPLastStep, &recoveryCodes,
+		&user.OIDCIssuer, &user.OIDCSubject)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, errNotFound
+	}
+	user.RecoveryCodes = strings.Fields(recoveryCodes)
+	return user, err
+}
+
+func expectOneRow(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func isUniqueViolation(err error) bool {
+	sqliteErr := &sqlite.Error{}
+	return errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+}
+
+// Snapshot reads every table inside one transaction so the copy is
+// consistent even while writers are active.
+func (s *sqliteStore) Snapshot() (storeSnapshot, error) {
+	snap := storeSnapshot{
+		Chirps: ChirpData{Chirps: make(map[int]Chirp)},
+		Users:  UserData{Users: make(map[int]User)},
+		Tokens: RefreshTokens{Tokens: make(map[string]RefreshToken), Hashed: true},
+		AccessTokens: PersonalAccessTokens{
+			Tokens: make(map[string]PersonalAccessToken),
+		},
+		OAuthClients: OAuthClients{
+			Clients: make(map[string]OAuthClient),
+		},
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return snap, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT ` + userColumns + ` FROM users`)
+	if err != nil {
+		return snap, err
+	}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			rows.Close()
+			return snap, err
+		}
+		snap.Users.Users[user.Id] = user
+	}
+	rows.Close()
+
+	rows, err = tx.Query(`SELECT id, body, author_id FROM chirps`)
+	if err != nil {
+		return snap, err
+	}
+	for rows.Next() {
+		chirp := Chirp{}
+		if err := rows.Scan(&chirp.Id, &chirp.Body, &chirp.AuthorId); err != nil {
+			rows.Close()
+			return snap, err
+		}
+		snap.Chirps.Chirps[chirp.Id] = chirp
+	}
+	rows.Close()
+
+	rows, err = tx.Query(`SELECT ` + refreshTokenColumns + ` FROM refresh_tokens`)
+	if err != nil {
+		return snap, err
+	}
+	tokens, err := scanRefreshTokens(rows)
+	if err != nil {
+		return snap, err
+	}
+	for _, token := range tokens {
+		snap.Tokens.Tokens[token.Id] = token
+	}
+
+	rows, err = tx.Query(`SELECT ` + patColumns + ` FROM personal_access_tokens`)
+	if err != nil {
+		return snap, err
+	}
+	pats, err := scanPersonalAccessTokens(rows)
+	if err != nil {
+		return snap, err
+	}
+	for _, token := range pats {
+		snap.AccessTokens.Tokens[token.Id] = token
+	}
+
+	rows, err = tx.Query(`SELECT ` + oauthClientColumns + ` FROM oauth_clients`)
+	if err != nil {
+		return snap, err
+	}
+	clients, err := scanOAuthClients(rows)
+	if err != nil {
+		return snap, err
+	}
+	for _, client := range clients {
+		snap.OAuthClients.Clients[client.Id] = client
+	}
+
+	rows, err = tx.Query(`SELECT token, session_id FROM retired_refresh_tokens`)
+	if err != nil {
+		return snap, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		retired, sessionId := "", ""
+		if err := rows.Scan(&retired, &sessionId); err != nil {
+			return snap, err
+		}
+		token, ok := snap.Tokens.Tokens[sessionId]
+		if !ok {
+			continue
+		}
+		token.Retired = append(token.Retired, retired)
+		snap.Tokens.Tokens[sessionId] = token
+	}
+	return snap, rows.Err()
+}
+
+// Restore replaces the contents of every table in one transaction. Ids are
+// kept so existing JWT subjects and chirp links stay valid.
+func (s *sqliteStore) Restore(snap storeSnapshot) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"password_resets", "personal_access_tokens", "oauth_clients", "retired_refresh_tokens", "refresh_tokens", "chirps", "users"} {
+		if _, err := tx.Exec(`DELETE FROM ` + table); err != nil {
+			return err
+		}
+	}
+	for _, user := range snap.Users.Users {
+		_, err := tx.Exec(`INSERT INTO users (`+userColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			user.Id, user.Email, user.PasswordHash, user.IsChirpyRed, user.PendingEmail, user.EmailVerified,
+			user.TOTPSecret, user.TOTPPendingSecret, user.TOTPLastStep, strings.Join(user.RecoveryCodes, " "),
+			user.OIDCIssuer, user.OIDCSubject)
+		if err != nil {
+			return fmt.Errorf("restoring user %d: %w", user.Id, err)
+		}
+	}
+	for _, chirp := range snap.Chirps.Chirps {
+		_, err := tx.Exec(`INSERT INTO chirps (id, body, author_id) VALUES (?, ?, ?)`,
+			chirp.Id, chirp.Body, chirp.AuthorId)
+		if err != nil {
+			return fmt.Errorf("restoring chirp %d: %w", chirp.Id, err)
+		}
+	}
+	for _, token := range snap.Tokens.Tokens {
+		if err := saveRefreshToken(tx, token); err != nil {
+			return fmt.Errorf("restoring session %s: %w", token.Id, err)
+		}
+		for _, retired := range token.Retired {
+			if err := saveRetiredRefreshToken(tx, retired, token.Id); err != nil {
+				return fmt.Errorf("restoring session %s: %w", token.Id, err)
+			}
+		}
+	}
+	for _, token := range snap.AccessTokens.Tokens {
+		if err := savePersonalAccessToken(tx, token); err != nil {
+			return fmt.Errorf("restoring personal access token %s: %w", token.Id, err)
+		}
+	}
+	for _, client := range snap.OAuthClients.Clients {
+		if err := saveOAuthClient(tx, client); err != nil {
+			return fmt.Errorf("restoring OAuth client %s: %w", client.Id, err)
+		}
+	}
+	return tx.Commit()
+}
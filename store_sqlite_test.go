@@ -0,0 +1,98 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestSQLiteStore(t *testing.T) *sqliteStore {
+	t.Helper()
+	store, err := newSQLiteStore(filepath.Join(t.TempDir(), sqliteDbFile))
+	if err != nil {
+		t.Fatalf("opening sqlite store: %s", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestSQLiteRefreshTokenLookup(t *testing.T) {
+	store := newTestSQLiteStore(t)
+	user, err := store.CreateUser(User{Email: "sqlite@example.com", PasswordHash: []byte("hash")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	first := hashRefreshToken(newRefreshToken())
+	session := RefreshToken{Id: newSessionId(), UserId: user.Id, Token: first, ExirationDate: now.Add(time.Hour)}
+	if err := store.SaveRefreshToken(session); err != nil {
+		t.Fatal(err)
+	}
+
+	if found, err := store.GetRefreshToken(first); err != nil || found.Id != session.Id {
+		t.Fatalf("looking up current token: got %+v, %v", found, err)
+	}
+	// Same selector, different hash.
+	forged := first[:refreshTokenSelectorLength] + hashRefreshToken("forged")[refreshTokenSelectorLength:]
+	if _, err := store.GetRefreshToken(forged); err != errNotFound {
+		t.Fatalf("looking up a hash sharing only the selector: got %v, want errNotFound", err)
+	}
+
+	second := hashRefreshToken(newRefreshToken())
+	if _, err := store.RotateRefreshToken(session.Id, first, second, now); err != nil {
+		t.Fatalf("rotating: %s", err)
+	}
+	if found, err := store.GetRefreshToken(second); err != nil || found.Id != session.Id {
+		t.Fatalf("looking up rotated token: got %+v, %v", found, err)
+	}
+	if found, err := store.GetRefreshToken(first); err != errTokenReused || found.Id != session.Id {
+		t.Fatalf("looking up retired token: got %+v, %v, want errTokenReused", found, err)
+	}
+	if _, err := store.RotateRefreshToken(session.Id, first, hashRefreshToken(newRefreshToken()), now); err != errTokenReused {
+		t.Fatalf("rotating with a retired token: got %v, want errTokenReused", err)
+	}
+	if _, err := store.RotateRefreshToken(session.Id, forged, hashRefreshToken(newRefreshToken()), now); err != errTokenReused {
+		t.Fatalf("rotating with a forged token: got %v, want errTokenReused", err)
+	}
+}
+
+func TestSQLiteMigrationsRoundTrip(t *testing.T) {
+	store := newTestSQLiteStore(t)
+	if err := migrateDown(store.db, 0); err != nil {
+		t.Fatalf("migrating down: %s", err)
+	}
+	if err := migrateUp(store.db); err != nil {
+		t.Fatalf("migrating back up: %s", err)
+	}
+}
+
+// Users from before email verification existed count as verified once
+// migration 17 has run; users created afterwards do not.
+func TestSQLiteGrandfathersEmailVerification(t *testing.T) {
+	store := newTestSQLiteStore(t)
+	if err := migrateDown(store.db, 8); err != nil {
+		t.Fatalf("migrating down: %s", err)
+	}
+	_, err := store.db.Exec(`INSERT INTO users (email, password_hash) VALUES (?, ?)`, "old@example.com", []byte("hash"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateUp(store.db); err != nil {
+		t.Fatalf("migrating up: %s", err)
+	}
+
+	old, err := store.GetUserByEmail("old@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !old.EmailVerified {
+		t.Errorf("existing user is not verified after the upgrade")
+	}
+	fresh, err := store.CreateUser(User{Email: "new@example.com", PasswordHash: []byte("hash")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fresh, _ = store.GetUser(fresh.Id); fresh.EmailVerified {
+		t.Errorf("new user is verified without following a link")
+	}
+}
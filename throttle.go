@@ -0,0 +1,250 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	accountFreeAttempts = 5
+	ipFreeAttempts      = 20
+	throttleBaseDelay   = time.Second
+	throttleMaxDelay    = 15 * time.Minute
+	throttleForgetAfter = time.Hour
+	throttleMaxRecords  = 100000
+)
+
+// attemptRecord counts the failed logins for one account or IP.
+type attemptRecord struct {
+	key         string
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// stale reports whether rec can be forgotten: it is not locked and has had
+// no failure for throttleForgetAfter.
+func (rec *attemptRecord) stale(now time.Time) bool {
+	return now.Sub(rec.lastFailure) > throttleForgetAfter && !now.Before(rec.lockedUntil)
+}
+
+// attemptRecords holds the records for accounts or for IPs, ordered from
+// the most to the least recently failed. There are never more than
+// throttleMaxRecords of them: when full, the record that failed longest
+// ago is dropped to make room, so a flood of failures from new keys cannot
+// exhaust memory. A key under active attack keeps failing and stays at the
+// front, out of reach of eviction.
+type attemptRecords struct {
+	byKey map[string]*list.Element
+	order *list.List
+}
+
+func newAttemptRecords() *attemptRecords {
+	return &attemptRecords{byKey: make(map[string]*list.Element), order: list.New()}
+}
+
+// get returns the live record for key, dropping it first if it has gone
+// stale.
+func (rs *attemptRecords) get(key string, now time.Time) *attemptRecord {
+	elem, ok := rs.byKey[key]
+	if !ok {
+		return nil
+	}
+	rec := elem.Value.(*attemptRecord)
+	if rec.stale(now) {
+		rs.remove(key)
+		return nil
+	}
+	return rec
+}
+
+// fail records a failure for key, adding a record if there is none, and
+// moves it to the front.
+func (rs *attemptRecords) fail(key string, now time.Time) *attemptRecord {
+	rec := rs.get(key, now)
+	if rec == nil {
+		// Records at the back failed longest ago, so the stale ones are
+		// all there.
+		for back := rs.order.Back(); back != nil && back.Value.(*attemptRecord).stale(now); back = rs.order.Back() {
+			rs.remove(back.Value.(*attemptRecord).key)
+		}
+		if rs.order.Len() >= throttleMaxRecords {
+			rs.remove(rs.order.Back().Value.(*attemptRecord).key)
+		}
+		rec = &attemptRecord{key: key}
+		rs.byKey[key] = rs.order.PushFront(rec)
+	} else {
+		rs.order.MoveToFront(rs.byKey[key])
+	}
+	rec.failures++
+	rec.lastFailure = now
+	return rec
+}
+
+// remove forgets key, reporting whether there was a record for it.
+func (rs *attemptRecords) remove(key string) bool {
+	elem, ok := rs.byKey[key]
+	if !ok {
+		return false
+	}
+	rs.order.Remove(elem)
+	delete(rs.byKey, key)
+	return true
+}
+
+func (rs *attemptRecords) len() int {
+	return rs.order.Len()
+}
+
+// loginThrottle slows down password guessing. Once an account or an IP has
+// used up its free failed attempts, each further failure locks it for twice
+// as long as the last, up to throttleMaxDelay. Records are forgotten after
+// throttleForgetAfter without a failure. State is kept in memory, so a
+// restart clears it.
+type loginThrottle struct {
+	mu       sync.Mutex
+	accounts *attemptRecords
+	ips      *attemptRecords
+}
+
+func newLoginThrottle() *loginThrottle {
+	return &loginThrottle{
+		accounts: newAttemptRecords(),
+		ips:      newAttemptRecords(),
+	}
+}
+
+func throttleKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// backoff is how long to lock something out after its failures-th failure.
+func backoff(failures, free int) time.Duration {
+	over := failures - free
+	if over < 0 {
+		return 0
+	}
+	if over >= 30 {
+		return throttleMaxDelay
+	}
+	return min(throttleBaseDelay<<over, throttleMaxDelay)
+}
+
+// check returns how long to wait before email may be tried from ip again,
+// or zero if the attempt can go ahead.
+func (t *loginThrottle) check(email, ip string, now time.Time) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	wait := time.Duration(0)
+	for _, rec := range []*attemptRecord{t.accounts.get(throttleKey(email), now), t.ips.get(ip, now)} {
+		if rec != nil && rec.lockedUntil.After(now) {
+			wait = max(wait, rec.lockedUntil.Sub(now))
+		}
+	}
+	return wait
+}
+
+// fail records a failed attempt on email from ip and returns how long the
+// account and the IP are now locked for, zero meaning not locked.
+func (t *loginThrottle) fail(email, ip string, now time.Time) (time.Duration, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	record := func(records *attemptRecords, key string, free int) time.Duration {
+		rec := records.fail(key, now)
+		lock := backoff(rec.failures, free)
+		if lock > 0 {
+			rec.lockedUntil = now.Add(lock)
+		}
+		return lock
+	}
+	return record(t.accounts, throttleKey(email), accountFreeAttempts), record(t.ips, ip, ipFreeAttempts)
+}
+
+// succeed clears the failures against an account after a good login. The
+// IP's failures stand, so logging in to one account cannot be used to
+// keep guessing at others.
+func (t *loginThrottle) succeed(email string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.accounts.remove(throttleKey(email))
+}
+
+// unlock clears an account's failures and lockout, reporting whether it had
+// any.
+func (t *loginThrottle) unlock(email string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.accounts.remove(throttleKey(email))
+}
+
+// loginFailed records a failed login and audits any lockout it causes.
+// userId is zero when the email does not belong to an account.
+func (cfg *apiConfig) loginFailed(email, ip string, userId int) {
+	accountLock, ipLock := cfg.throttle.fail(email, ip, time.Now().UTC())
+	if accountLock > 0 {
+		cfg.audit.record(auditEvent{
+			Event:  "login.account_locked",
+			UserId: userId,
+			Email:  email,
+			IP:     ip,
+			Detail: fmt.Sprintf("locked for %s", accountLock),
+		})
+	}
+	if ipLock > 0 {
+		cfg.audit.record(auditEvent{
+			Event:  "login.ip_locked",
+			Email:  email,
+			IP:     ip,
+			Detail: fmt.Sprintf("locked for %s", ipLock),
+		})
+	}
+}
+
+func writeTooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	writeTooManyRequests(w, wait, "Too many failed login attempts, try again later")
+}
+
+func writeTooManyRequests(w http.ResponseWriter, wait time.Duration, message string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(429)
+	w.Write([]byte(message + "\n"))
+}
+
+// unlockUser lets an admin clear the lockout on an account.
+func (cfg *apiConfig) unlockUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("userId"))
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	user, err := cfg.store.GetUser(id)
+	if err == errNotFound {
+		w.WriteHeader(404)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error reading user %d to unlock: %s\n", id, err)
+		w.WriteHeader(500)
+		return
+	}
+	wasLocked := cfg.throttle.unlock(user.Email)
+	cfg.audit.record(auditEvent{
+		Event:  "account.unlocked",
+		UserId: user.Id,
+		Email:  user.Email,
+		IP:     clientIP(r),
+		Detail: fmt.Sprintf("by admin, had failed attempts: %t", wasLocked),
+	})
+	w.WriteHeader(204)
+}
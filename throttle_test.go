@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLoginThrottleLocksAfterFreeAttempts(t *testing.T) {
+	throttle := newLoginThrottle()
+	now := time.Now()
+
+	for i := 0; i < accountFreeAttempts-1; i++ {
+		if lock, _ := throttle.fail("Victim@example.com", fmt.Sprintf("10.0.0.%d", i), now); lock != 0 {
+			t.Fatalf("failure %d locked the account for %s", i+1, lock)
+		}
+	}
+	lock, _ := throttle.fail("victim@example.com ", "10.0.1.1", now)
+	if lock != throttleBaseDelay {
+		t.Fatalf("failure %d locked for %s, want %s", accountFreeAttempts, lock, throttleBaseDelay)
+	}
+	if wait := throttle.check("victim@example.com", "10.0.2.2", now); wait != lock {
+		t.Errorf("check from a new IP: wait %s, want %s", wait, lock)
+	}
+	throttle.succeed("victim@example.com")
+	if wait := throttle.check("victim@example.com", "10.0.2.2", now); wait != 0 {
+		t.Errorf("check after a good login: wait %s, want 0", wait)
+	}
+}
+
+func TestLoginThrottleForgetsStaleRecords(t *testing.T) {
+	throttle := newLoginThrottle()
+	now := time.Now()
+	throttle.fail("old@example.com", "10.0.0.1", now)
+
+	later := now.Add(throttleForgetAfter + time.Minute)
+	throttle.fail("new@example.com", "10.0.0.2", later)
+	if n := throttle.accounts.len(); n != 1 {
+		t.Errorf("got %d account records, want the stale one dropped", n)
+	}
+	if n := throttle.ips.len(); n != 1 {
+		t.Errorf("got %d IP records, want the stale one dropped", n)
+	}
+}
+
+// A flood of failures from new IPs is capped, and evicts the records that
+// failed longest ago rather than one that is still being attacked.
+func TestLoginThrottleIsBounded(t *testing.T) {
+	throttle := newLoginThrottle()
+	now := time.Now()
+
+	for i := 0; i < ipFreeAttempts+1; i++ {
+		throttle.fail("target@example.com", "192.0.2.1", now)
+	}
+	for i := 0; i < throttleMaxRecords+100; i++ {
+		now = now.Add(time.Microsecond)
+		throttle.fail(fmt.Sprintf("user%d@example.com", i), fmt.Sprintf("ip-%d", i), now)
+		if i%1000 == 0 {
+			throttle.fail("target@example.com", "192.0.2.1", now)
+		}
+	}
+
+	if n := throttle.accounts.len(); n != throttleMaxRecords {
+		t.Errorf("got %d account records, want %d", n, throttleMaxRecords)
+	}
+	if n := throttle.ips.len(); n != throttleMaxRecords {
+		t.Errorf("got %d IP records, want %d", n, throttleMaxRecords)
+	}
+	if wait := throttle.check("target@example.com", "192.0.2.1", now); wait == 0 {
+		t.Errorf("the record under attack was evicted")
+	}
+	if throttle.accounts.get("user0@example.com", now) != nil {
+		t.Errorf("the record that failed longest ago was kept")
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const accessTokenAudience = "chirpy-api"
+
+// newTokenId returns a random jti so a single access token can be revoked.
+func newTokenId() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		fmt.Printf("Error generating random bytes")
+	}
+	return hex.EncodeToString(b)
+}
+
+// produceJWT signs an access token for uid that lasts for ttl and returns
+// it with its expiry. sessionId ties the token to the refresh token session
+// it came from. scope is empty for a login session and limits the token to
+// those scopes otherwise.
+func (cfg *apiConfig) produceJWT(ttl time.Duration, uid int, sessionId, scope string) (string, time.Time, error) {
+	now := time.Now().UTC()
+	expiresAt := now.Add(ttl).Truncate(time.Second)
+	claims := accessClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    cfg.issuer,
+			Audience:  jwt.ClaimStrings{accessTokenAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			Subject:   strconv.Itoa(uid),
+			ID:        newTokenId(),
+		},
+		Scope:     scope,
+		SessionId: sessionId,
+	}
+	tokenString, err := cfg.keys.sign(claims)
+	if err != nil {
+		fmt.Printf("There was an error signing JWT: %s\n", err)
+		return "", time.Time{}, err
+	}
+	return tokenString, expiresAt, nil
+}
+
+// validateAccessToken is the one place access tokens are checked. The
+// token must name a key in the keyring by kid and use that key's alg, must
+// carry exp, iat, jti, iss and aud, and gets cfg.jwtLeeway of clock skew
+// on the time based claims.
+func (cfg *apiConfig) validateAccessToken(tokenString string) (*accessClaims, error) {
+	claims := &accessClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, cfg.keys.keyfunc,
+		jwt.WithValidMethods([]string{algEdDSA, algRS256}),
+		jwt.WithIssuer(cfg.issuer),
+		jwt.WithAudience(accessTokenAudience),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(cfg.jwtLeeway),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if claims.IssuedAt == nil {
+		return nil, errors.New("token has no iat claim")
+	}
+	if claims.ID == "" {
+		return nil, errors.New("token has no jti claim")
+	}
+	return claims, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestValidateAccessToken(t *testing.T) {
+	cfg := newTestConfig(t)
+	active, err := cfg.keys.activeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stranger, err := generateSigningKey(algEdDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+
+	valid := func() accessClaims {
+		return accessClaims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    cfg.issuer,
+				Audience:  jwt.ClaimStrings{accessTokenAudience},
+				IssuedAt:  jwt.NewNumericDate(now),
+				ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+				Subject:   "1",
+				ID:        newTokenId(),
+			},
+			SessionId: "session",
+		}
+	}
+	// sign signs claims as the keyring would, but with the given method and
+	// key, under the active key's kid.
+	sign := func(claims accessClaims, method jwt.SigningMethod, key interface{}) string {
+		token := jwt.NewWithClaims(method, claims)
+		token.Header["kid"] = active.Id
+		out, err := token.SignedString(key)
+		if err != nil {
+			t.Fatalf("signing token: %s", err)
+		}
+		return out
+	}
+	signed := func(edit func(*accessClaims)) func() string {
+		return func() string {
+			claims := valid()
+			edit(&claims)
+			return sign(claims, jwt.SigningMethodEdDSA, active.signer)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		token func() string
+		ok    bool
+	}{
+		{"valid", signed(func(c *accessClaims) {}), true},
+		{"alg none", func() string {
+			return sign(valid(), jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType)
+		}, false},
+		{"signed by another key", func() string {
+			return sign(valid(), jwt.SigningMethodEdDSA, stranger.signer)
+		}, false},
+		{"unknown kid", func() string {
+			token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, valid())
+			token.Header["kid"] = "unknown"
+			out, _ := token.SignedString(active.signer)
+			return out
+		}, false},
+		{"wrong issuer", signed(func(c *accessClaims) { c.Issuer = "someone-else" }), false},
+		{"no issuer", signed(func(c *accessClaims) { c.Issuer = "" }), false},
+		{"wrong audience", signed(func(c *accessClaims) { c.Audience = jwt.ClaimStrings{emailTokenAudience} }), false},
+		{"no audience", signed(func(c *accessClaims) { c.Audience = nil }), false},
+		{"expired", signed(func(c *accessClaims) {
+			c.IssuedAt = jwt.NewNumericDate(now.Add(-2 * time.Hour))
+			c.ExpiresAt = jwt.NewNumericDate(now.Add(-time.Hour))
+		}), false},
+		{"expired within leeway", signed(func(c *accessClaims) {
+			c.ExpiresAt = jwt.NewNumericDate(now.Add(-cfg.jwtLeeway / 2))
+		}), true},
+		{"no exp", signed(func(c *accessClaims) { c.ExpiresAt = nil }), false},
+		{"future iat", signed(func(c *accessClaims) { c.IssuedAt = jwt.NewNumericDate(now.Add(time.Hour)) }), false},
+		{"iat within leeway", signed(func(c *accessClaims) {
+			c.IssuedAt = jwt.NewNumericDate(now.Add(cfg.jwtLeeway / 2))
+		}), true},
+		{"no iat", signed(func(c *accessClaims) { c.IssuedAt = nil }), false},
+		{"not yet valid", signed(func(c *accessClaims) { c.NotBefore = jwt.NewNumericDate(now.Add(time.Hour)) }), false},
+		{"no jti", signed(func(c *accessClaims) { c.ID = "" }), false},
+		{"garbage", func() string { return "not.a.token" }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := cfg.validateAccessToken(tt.token())
+			if tt.ok && err != nil {
+				t.Fatalf("want token accepted, got %s", err)
+			}
+			if !tt.ok && err == nil {
+				t.Fatalf("want token rejected, got claims %+v", claims)
+			}
+		})
+	}
+}
+
+func TestProduceJWTRoundTrip(t *testing.T) {
+	cfg := newTestConfig(t)
+	token, expiresAt, err := cfg.produceJWT(time.Minute, 7, "session", scopeChirpsWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := cfg.validateAccessToken(token)
+	if err != nil {
+		t.Fatalf("validating a token just produced: %s", err)
+	}
+	if claims.Subject != "7" || claims.SessionId != "session" || claims.Scope != scopeChirpsWrite {
+		t.Errorf("got claims %+v", claims)
+	}
+	if !claims.ExpiresAt.Time.Equal(expiresAt) {
+		t.Errorf("exp is %s, want %s", claims.ExpiresAt.Time, expiresAt)
+	}
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	twoFactorAudience     = "chirpy-2fa"
+	twoFactorChallengeTTL = 5 * time.Minute
+)
+
+var (
+	errTwoFactorCode         = errors.New("two-factor code is incorrect")
+	errTwoFactorOn           = errors.New("two-factor authentication is already enabled")
+	errTwoFactorOff          = errors.New("two-factor authentication is not enabled")
+	errNoTwoFactorEnrollment = errors.New("no two-factor enrollment in progress")
+)
+
+// twoFactorClaims are carried by the challenge token handed out when a
+// password checks out but a second factor is still needed. They remember
+// what the client asked for at the first step so the second step only
+// needs the token and a code.
+type twoFactorClaims struct {
+	jwt.RegisteredClaims
+	Expiry int    `json:"expires_in_seconds,omitempty"`
+	Device string `json:"device,omitempty"`
+}
+
+func (cfg *apiConfig) produceTwoFactorChallenge(userId, expiry int, device string) (string, time.Time, error) {
+	now := time.Now().UTC()
+	expiresAt := now.Add(twoFactorChallengeTTL)
+	token, err := cfg.keys.sign(twoFactorClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    cfg.issuer,
+			Audience:  jwt.ClaimStrings{twoFactorAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			Subject:   strconv.Itoa(userId),
+			ID:        newTokenId(),
+		},
+		Expiry: expiry,
+		Device: device,
+	})
+	return token, expiresAt, err
+}
+
+func (cfg *apiConfig) validateTwoFactorChallenge(tokenString string) (*twoFactorClaims, error) {
+	claims := &twoFactorClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, cfg.keys.keyfunc,
+		jwt.WithValidMethods([]string{algEdDSA, algRS256}),
+		jwt.WithIssuer(cfg.issuer),
+		jwt.WithAudience(twoFactorAudience),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(cfg.jwtLeeway),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if claims.ID == "" {
+		return nil, errors.New("challenge token is missing claims")
+	}
+	return claims, nil
+}
+
+// writeTwoFactorChallenge answers a login whose password was right for an
+// account with two-factor authentication on.
+func (cfg *apiConfig) writeTwoFactorChallenge(w http.ResponseWriter, user User, expiry int, device string) {
+	token, expiresAt, err := cfg.produceTwoFactorChallenge(user.Id, expiry, device)
+	if err != nil {
+		fmt.Printf("Something is wrong with creating a two-factor challenge: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+	data, err := json.Marshal(struct {
+		TwoFactorRequired bool      `json:"two_factor_required"`
+		ChallengeToken    string    `json:"challenge_token"`
+		ExpiresAt         time.Time `json:"expires_at"`
+	}{true, token, expiresAt})
+	if err != nil {
+		fmt.Printf("Error marshalling two-factor challenge to JSON: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(200)
+	w.Write(data)
+}
+
+// completeTwoFactorLogin is the second step of logging in to an account
+// with two-factor authentication: it trades a challenge token and a TOTP
+// or recovery code for a session. Wrong codes count towards the same
+// lockout as wrong passwords, and each challenge gets a single attempt, so
+// after a wrong code the user starts over with their password.
+func (cfg *apiConfig) completeTwoFactorLogin(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		ChallengeToken string `json:"challenge_token"`
+		Code           string `json:"code"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		log.Printf("Error decoding parameters: %s", err)
+		w.WriteHeader(400)
+		return
+	}
+
+	claims, err := cfg.validateTwoFactorChallenge(params.ChallengeToken)
+	if err != nil {
+		writeUnauthorized(w, "challenge is invalid or has expired")
+		return
+	}
+	// The challenge is used up before the code is looked at, so two
+	// requests racing with the same challenge cannot both get a session.
+	err = cfg.store.RevokeAccessToken(claims.ID, claims.ExpiresAt.Time)
+	if err == errAlreadyRevoked {
+		writeUnauthorized(w, "challenge is invalid or has expired")
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error using two-factor challenge: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+	uid, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		writeUnauthorized(w, "challenge is invalid or has expired")
+		return
+	}
+	user, err := cfg.store.GetUser(uid)
+	if err != nil || user.TOTPSecret == "" {
+		writeUnauthorized(w, "challenge is invalid or has expired")
+		return
+	}
+
+	ip := clientIP(r)
+	now := time.Now().UTC()
+	if wait := cfg.throttle.check(user.Email, ip, now); wait > 0 {
+		writeTooManyAttempts(w, wait)
+		return
+	}
+	recovery := false
+	updated, err := cfg.store.UpdateUserFunc(uid, func(user *User) error {
+		if user.TOTPSecret == "" {
+			return errTwoFactorOff
+		}
+		used, ok := checkSecondFactor(user, params.Code, now)
+		if !ok {
+			return errTwoFactorCode
+		}
+		recovery = used
+		return nil
+	})
+	if err == errTwoFactorCode {
+		cfg.loginFailed(user.Email, ip, uid)
+		writeUnauthorized(w, "two-factor code is incorrect")
+		return
+	}
+	if err == errNotFound || err == errTwoFactorOff {
+		writeUnauthorized(w, "challenge is invalid or has expired")
+		return
+	}
+	if err != nil {
+		fmt.Printf("There was an error saving updated user: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+	user = updated
+	cfg.throttle.succeed(user.Email)
+	if recovery {
+		cfg.audit.record(auditEvent{
+			Event:  "2fa.recovery_code_used",
+			UserId: user.Id,
+			Email:  user.Email,
+			IP:     ip,
+			Detail: fmt.Sprintf("%d recovery codes left", len(user.RecoveryCodes)),
+		})
+	}
+	cfg.startSession(w, r, user, claims.Expiry, claims.Device)
+}
+
+// enrollTwoFactor starts turning on two-factor authentication. It hands
+// out a new secret, which only takes effect once confirmTwoFactor has seen
+// a code generated from it, so a botched scan cannot lock the user out.
+func (cfg *apiConfig) enrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+
+	type parameters struct {
+		CurrentPassword string `json:"current_password"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		log.Printf("Error decoding parameters: %s", err)
+		w.WriteHeader(400)
+		return
+	}
+	user, err := cfg.store.GetUser(caller.UserId)
+	if err != nil {
+		writeUnauthorized(w, "user no longer exists")
+		return
+	}
+	if user.TOTPSecret != "" {
+		w.WriteHeader(409)
+		w.Write([]byte("Two-factor authentication is already enabled\n"))
+		return
+	}
+	if !cfg.checkCurrentPassword(w, r, user, params.CurrentPassword) {
+		return
+	}
+	secret, err := newTOTPSecret()
+	if err != nil {
+		fmt.Printf("Error generating TOTP secret: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+	_, err = cfg.store.UpdateUserFunc(user.Id, func(user *User) error {
+		if user.TOTPSecret != "" {
+			return errTwoFactorOn
+		}
+		user.TOTPPendingSecret = secret
+		return nil
+	})
+	if err == errTwoFactorOn {
+		w.WriteHeader(409)
+		w.Write([]byte("Two-factor authentication is already enabled\n"))
+		return
+	}
+	if err != nil {
+		fmt.Printf("There was an error saving updated user: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	data, err := json.Marshal(struct {
+		Secret          string `json:"secret"`
+		ProvisioningURI string `json:"provisioning_uri"`
+	}{secret, totpProvisioningURI(secret, user.Email)})
+	if err != nil {
+		fmt.Printf("Error marshalling TOTP enrollment to JSON: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(data)
+}
+
+// confirmTwoFactor finishes turning on two-factor authentication with a
+// code from the secret enrollTwoFactor handed out. The response carries the
+// recovery codes, the only time they are shown.
+func (cfg *apiConfig) confirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+
+	type parameters struct {
+		Code string `json:"code"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		log.Printf("Error decoding parameters: %s", err)
+		w.WriteHeader(400)
+		return
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		fmt.Printf("Error generating recovery codes: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+	user, err := cfg.store.UpdateUserFunc(caller.UserId, func(user *User) error {
+		if user.TOTPPendingSecret == "" {
+			return errNoTwoFactorEnrollment
+		}
+		step, ok := verifyTOTP(user.TOTPPendingSecret, params.Code, 0, time.Now().UTC())
+		if !ok {
+			return errTwoFactorCode
+		}
+		user.TOTPSecret = user.TOTPPendingSecret
+		user.TOTPPendingSecret = ""
+		user.TOTPLastStep = step
+		user.RecoveryCodes = hashes
+		return nil
+	})
+	if err == errNotFound {
+		writeUnauthorized(w, "user no longer exists")
+		return
+	}
+	if err == errNoTwoFactorEnrollment {
+		w.WriteHeader(400)
+		w.Write([]byte("No two-factor enrollment in progress\n"))
+		return
+	}
+	if err == errTwoFactorCode {
+		w.WriteHeader(400)
+		w.Write([]byte("Two-factor code is incorrect\n"))
+		return
+	}
+	if err != nil {
+		fmt.Printf("There was an error saving updated user: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+	cfg.audit.record(auditEvent{
+		Event:  "2fa.enabled",
+		UserId: user.Id,
+		Email:  user.Email,
+		IP:     clientIP(r),
+	})
+
+	data, err := json.Marshal(struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{codes})
+	if err != nil {
+		fmt.Printf("Error marshalling recovery codes to JSON: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(data)
+}
+
+// disableTwoFactor turns two-factor authentication off. It takes both the
+// current password and a code, the same as logging in would.
+func (cfg *apiConfig) disableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+
+	type parameters struct {
+		CurrentPassword string `json:"current_password"`
+		Code            string `json:"code"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		log.Printf("Error decoding parameters: %s", err)
+		w.WriteHeader(400)
+		return
+	}
+	user, err := cfg.store.GetUser(caller.UserId)
+	if err != nil {
+		writeUnauthorized(w, "user no longer exists")
+		return
+	}
+	if user.TOTPSecret == "" {
+		w.WriteHeader(409)
+		w.Write([]byte("Two-factor authentication is not enabled\n"))
+		return
+	}
+	if !cfg.checkCurrentPassword(w, r, user, params.CurrentPassword) {
+		return
+	}
+	now := time.Now().UTC()
+	_, err = cfg.store.UpdateUserFunc(user.Id, func(user *User) error {
+		if user.TOTPSecret == "" {
+			return errTwoFactorOff
+		}
+		if _, ok := checkSecondFactor(user, params.Code, now); !ok {
+			return errTwoFactorCode
+		}
+		clearTwoFactor(user)
+		return nil
+	})
+	if err == errTwoFactorCode {
+		cfg.loginFailed(user.Email, clientIP(r), user.Id)
+		w.WriteHeader(403)
+		w.Write([]byte("Two-factor code is incorrect\n"))
+		return
+	}
+	if err == errTwoFactorOff {
+		w.WriteHeader(409)
+		w.Write([]byte("Two-factor authentication is not enabled\n"))
+		return
+	}
+	if err != nil {
+		fmt.Printf("There was an error saving updated user: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+	cfg.audit.record(auditEvent{
+		Event:  "2fa.disabled",
+		UserId: user.Id,
+		Email:  user.Email,
+		IP:     clientIP(r),
+	})
+	w.WriteHeader(204)
+}
+
+// resetTwoFactor lets an admin turn off two-factor authentication for a
+// user who has lost both their authenticator and their recovery codes.
+func (cfg *apiConfig) resetTwoFactor(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("userId"))
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	wasEnabled := false
+	user, err := cfg.store.UpdateUserFunc(id, func(user *User) error {
+		wasEnabled = user.TOTPSecret != ""
+		clearTwoFactor(user)
+		return nil
+	})
+	if err == errNotFound {
+		w.WriteHeader(404)
+		return
+	}
+	if err != nil {
+		fmt.Printf("There was an error resetting two-factor authentication for user %d: %s\n", id, err)
+		w.WriteHeader(500)
+		return
+	}
+	cfg.audit.record(auditEvent{
+		Event:  "2fa.reset",
+		UserId: user.Id,
+		Email:  user.Email,
+		IP:     clientIP(r),
+		Detail: fmt.Sprintf("by admin, was enabled: %t", wasEnabled),
+	})
+	w.WriteHeader(204)
+}
+
+func clearTwoFactor(user *User) {
+	user.TOTPSecret = ""
+	user.TOTPPendingSecret = ""
+	user.TOTPLastStep = 0
+	user.RecoveryCodes = nil
+}
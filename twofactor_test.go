@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// enableTwoFactor turns two-factor authentication on for user and returns
+// their recovery codes.
+func enableTwoFactor(t *testing.T, cfg *apiConfig, user User) []string {
+	t.Helper()
+	secret, err := newTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cfg.store.UpdateUserFunc(user.Id, func(user *User) error {
+		user.TOTPSecret = secret
+		user.RecoveryCodes = hashes
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("turning on two-factor authentication: %s", err)
+	}
+	return codes
+}
+
+// twoFactorChallenge logs in with testPassword and returns the challenge
+// token handed out in place of a session.
+func twoFactorChallenge(t *testing.T, handler http.Handler, email string) string {
+	t.Helper()
+	rec := doRequest(t, handler, "POST", "/api/login", "", map[string]string{
+		"email":    email,
+		"password": testPassword,
+	})
+	out := struct {
+		ChallengeToken string `json:"challenge_token"`
+	}{}
+	decodeBody(t, rec, &out)
+	if rec.Code != 200 || out.ChallengeToken == "" {
+		t.Fatalf("login as %s: got %d %q, want a two-factor challenge", email, rec.Code, rec.Body.String())
+	}
+	return out.ChallengeToken
+}
+
+// Each request below brings a different, valid recovery code, so only the
+// challenge being used up can stop them all getting a session.
+func TestTwoFactorChallengeWorksOnce(t *testing.T) {
+	cfg := newTestConfig(t)
+	handler := cfg.routes()
+	user := createTestUser(t, cfg, "twofactor@example.com")
+	codes := enableTwoFactor(t, cfg, user)
+	challenge := twoFactorChallenge(t, handler, user.Email)
+
+	const n = 5
+	var wg sync.WaitGroup
+	statuses := make(chan int, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(code string) {
+			defer wg.Done()
+			rec := doRequest(t, handler, "POST", "/api/login/2fa", "", map[string]string{
+				"challenge_token": challenge,
+				"code":            code,
+			})
+			statuses <- rec.Code
+		}(codes[i])
+	}
+	wg.Wait()
+	close(statuses)
+	sessions := 0
+	for status := range statuses {
+		switch status {
+		case 200:
+			sessions++
+		case 401:
+		default:
+			t.Errorf("got %d, want 200 or 401", status)
+		}
+	}
+	if sessions != 1 {
+		t.Errorf("one challenge started %d sessions, want 1", sessions)
+	}
+}
+
+func TestRevokeAccessTokenOnce(t *testing.T) {
+	stores := map[string]Store{
+		"memory": newMemoryStore(),
+		"sqlite": newTestSQLiteStore(t),
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			expiresAt := time.Now().Add(time.Hour)
+			if err := store.RevokeAccessToken("jti", expiresAt); err != nil {
+				t.Fatalf("first revoke: %s", err)
+			}
+			if err := store.RevokeAccessToken("jti", expiresAt); err != errAlreadyRevoked {
+				t.Errorf("second revoke: got %v, want errAlreadyRevoked", err)
+			}
+		})
+	}
+}
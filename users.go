@@ -1,84 +1,105 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"os"
 	"regexp"
-	"strconv"
-	"strings"
 	"time"
-
-	"github.com/golang-jwt/jwt/v5"
-	"golang.org/x/crypto/bcrypt"
 )
 
+// User is an account. EmailVerified is set once the user has followed a
+// link sent to Email. PendingEmail is an address the user has asked to
+// change to, which only replaces Email once it has been verified.
+//
+// Two-factor authentication is on when TOTPSecret is set. TOTPPendingSecret
+// holds a secret that has been handed out but not yet confirmed with a
+// code, TOTPLastStep is the time step of the last code accepted, so a code
+// cannot be used twice, and RecoveryCodes are the hashes of the unused
+// recovery codes.
+//
+// OIDCIssuer and OIDCSubject identify the identity provider account the
+// user signs in with, if they have used federated login.
 type User struct {
-	Id           int    `json:"id"`
-	Email        string `json:"email"`
-	PasswordHash []byte `json:"password"`
-	IsChirpyRed  bool   `json:"is_chirpy_red"`
+	Id                int      `json:"id"`
+	Email             string   `json:"email"`
+	PasswordHash      []byte   `json:"password"`
+	IsChirpyRed       bool     `json:"is_chirpy_red"`
+	EmailVerified     bool     `json:"email_verified"`
+	PendingEmail      string   `json:"pending_email,omitempty"`
+	TOTPSecret        string   `json:"totp_secret,omitempty"`
+	TOTPPendingSecret string   `json:"totp_pending_secret,omitempty"`
+	TOTPLastStep      int64    `json:"totp_last_step,omitempty"`
+	RecoveryCodes     []string `json:"recovery_codes,omitempty"`
+	OIDCIssuer        string   `json:"oidc_issuer,omitempty"`
+	OIDCSubject       string   `json:"oidc_subject,omitempty"`
+}
+
+// UnmarshalJSON reads a user saved before email verification existed,
+// which has no email_verified field, as verified, the same as sqlite
+// migration 17 does.
+func (u *User) UnmarshalJSON(data []byte) error {
+	type plain User
+	user := plain{EmailVerified: true}
+	if err := json.Unmarshal(data, &user); err != nil {
+		return err
+	}
+	*u = User(user)
+	return nil
 }
 
 type UserAuth struct {
-	Id           int    `json:"id"`
-	Email        string `json:"email"`
-	Token        string `json:"token"`
-	RefreshToken string `json:"refresh_token"`
-	IsChirpyRed  bool   `json:"is_chirpy_red"`
+	Id            int       `json:"id"`
+	Email         string    `json:"email"`
+	Token         string    `json:"token"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	RefreshToken  string    `json:"refresh_token"`
+	IsChirpyRed   bool      `json:"is_chirpy_red"`
+	EmailVerified bool      `json:"email_verified"`
 }
 
 type UserInfo struct {
-	Id          int    `json:"id"`
-	Email       string `json:"email"`
-	IsChirpyRed bool   `json:"is_chirpy_red"`
+	Id               int    `json:"id"`
+	Email            string `json:"email"`
+	IsChirpyRed      bool   `json:"is_chirpy_red"`
+	EmailVerified    bool   `json:"email_verified"`
+	TwoFactorEnabled bool   `json:"two_factor_enabled"`
+	PendingEmail     string `json:"pending_email,omitempty"`
 }
 
+// UserData holds every user by id. NextId is the id the next user gets.
 type UserData struct {
-	Users map[int]User `json:"users"`
+	Users  map[int]User `json:"users"`
+	NextId int          `json:"next_id,omitempty"`
 }
 
-func readUsers(file string) UserData {
-	db, err := os.Open(file)
-	if err != nil {
-		fmt.Printf("There was an error opening DB for reading: %s\n", err)
-	}
-	defer db.Close()
-
-	scanner := bufio.NewScanner(db)
-	users := UserData{}
-
-	for scanner.Scan() {
-		data := scanner.Text()
-		err := json.Unmarshal([]byte(data), &users)
-		if err != nil {
-			fmt.Printf("Error unmarshalling JSON from DB: %s\n", err)
+// setNextId moves NextId past every user in u, for data saved before the
+// counter was kept.
+func (u *UserData) setNextId() {
+	for id := range u.Users {
+		if id >= u.NextId {
+			u.NextId = id + 1
 		}
 	}
-	return users
 }
 
-func saveUsers(file string, users UserData) {
-	if err := os.Truncate(file, 0); err != nil {
-		fmt.Printf("Failed to truncate: %v", err)
+func readUsers(file string) (UserData, error) {
+	users := UserData{}
+	if err := readJSONFile(file, &users); err != nil {
+		return users, err
 	}
-	db, err := os.OpenFile(file, os.O_WRONLY, 0666)
-	if err != nil {
-		fmt.Printf("There was an error opening DB for reading: %s\n", err)
+	if users.Users == nil {
+		users.Users = make(map[int]User)
 	}
-	defer db.Close()
+	users.setNextId()
+	return users, nil
+}
 
-	data, marshallError := json.Marshal(&users)
-	if marshallError != nil {
-		fmt.Printf("Error marshalling chirpdata to JSON: %s\n", marshallError)
-	}
-	_, err = db.Write(data)
-	if err != nil {
-		fmt.Printf("Problem writing chirps to db: %s\n", err)
-	}
+func saveUsers(file string, users UserData) error {
+	return writeJSONFile(file, &users)
 }
 
 func validateEmail(email string) bool {
@@ -89,16 +110,12 @@ func validateEmail(email string) bool {
 	return false
 }
 
-func duplicateUserCheck(users UserData, email string) bool {
-	for _, val := range users.Users {
-		if strings.ToLower(val.Email) == strings.ToLower(email) {
-			return true
-		}
-	}
-	return false
+func duplicateUserCheck(users UserStore, email string) bool {
+	_, err := users.GetUserByEmail(email)
+	return err == nil
 }
 
-func newUser(w http.ResponseWriter, r *http.Request) {
+func (cfg *apiConfig) newUser(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
@@ -112,40 +129,55 @@ func newUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	users := readUsers(userDbFile)
-
-	if duplicateUserCheck(users, params.Email) {
+	if duplicateUserCheck(cfg.store, params.Email) {
 		out := fmt.Sprintf("Email address %s already exists\n", params.Email)
-		w.Write([]byte(out))
 		w.WriteHeader(400)
+		w.Write([]byte(out))
 		return
 	}
 
 	if !validateEmail(params.Email) {
 		out := fmt.Sprintf("%s is not a valid email address\n", params.Email)
-		w.Write([]byte(out))
 		w.WriteHeader(400)
+		w.Write([]byte(out))
+		return
+	}
+
+	if violations := cfg.passwordPolicy.check(params.Password, params.Email); len(violations) > 0 {
+		writePolicyViolations(w, violations)
 		return
 	}
 
 	if validateEmail(params.Email) {
-		users := readUsers(userDbFile)
-		hash, err := bcrypt.GenerateFromPassword([]byte(params.Password), 2)
+		hash, err := cfg.passwords.Hash(params.Password)
 		if err != nil {
-			fmt.Printf("There was an error generating a password hash: %s", err)
+			fmt.Printf("There was an error generating a password hash: %s\n", err)
+			w.WriteHeader(500)
+			return
 		}
-		user := User{
-			Id:           (len(users.Users) + 1),
+		user, err := cfg.store.CreateUser(User{
 			Email:        params.Email,
 			PasswordHash: hash,
 			IsChirpyRed:  false,
+		})
+		if err == errDuplicateEmail {
+			out := fmt.Sprintf("Email address %s already exists\n", params.Email)
+			w.WriteHeader(400)
+			w.Write([]byte(out))
+			return
+		}
+		if err != nil {
+			fmt.Printf("There was an error saving new user: %s\n", err)
+			w.WriteHeader(500)
+			return
+		}
+		if err := cfg.sendEmailVerification(user, user.Email); err != nil {
+			fmt.Printf("Could not send email verification to user %d: %s\n", user.Id, err)
 		}
 		userResp := UserInfo{
-			Id:    (len(users.Users) + 1),
-			Email: params.Email,
+			Id:    user.Id,
+			Email: user.Email,
 		}
-		users.Users[user.Id] = user
-		saveUsers(userDbFile, users)
 		data, err := json.Marshal(userResp)
 		if err != nil {
 			fmt.Printf("Error marshalling userInfo to JSON: %s\n", err)
@@ -159,30 +191,12 @@ func newUser(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func produceJWT(expiry, uid int) (string, error) {
-	secret := os.Getenv("JWT_SECRET")
-
-	now := time.Now().UTC()
-	claims := jwt.RegisteredClaims{
-		Issuer:    "chirpy",
-		IssuedAt:  jwt.NewNumericDate(now),
-		ExpiresAt: jwt.NewNumericDate(now.Add(time.Duration(expiry) * time.Second)),
-		Subject:   strconv.Itoa(uid),
-	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString([]byte(secret))
-	if err != nil {
-		fmt.Printf("There was an error signing JWT: %s\n", err)
-		return "", err
-	}
-	return tokenString, nil
-}
-
-func authenticateUser(w http.ResponseWriter, r *http.Request) {
+func (cfg *apiConfig) authenticateUser(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
 		Expiry   int    `json:"expires_in_seconds"`
+		Device   string `json:"device"`
 	}
 	params := parameters{}
 	decoder := json.NewDecoder(r.Body)
@@ -192,51 +206,84 @@ func authenticateUser(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(500)
 		return
 	}
-	users := readUsers(userDbFile)
-	storedUserData := User{}
-	for _, val := range users.Users {
-		if strings.ToLower(val.Email) == strings.ToLower(params.Email) {
-			storedUserData = val
-		}
+	ip := clientIP(r)
+	if wait := cfg.throttle.check(params.Email, ip, time.Now().UTC()); wait > 0 {
+		writeTooManyAttempts(w, wait)
+		return
 	}
-	if storedUserData.Email == "" {
+	storedUserData, err := cfg.store.GetUserByEmail(params.Email)
+	if err != nil {
+		cfg.loginFailed(params.Email, ip, 0)
 		w.WriteHeader(401)
 		w.Write([]byte("User does not exist or password was incorrect: 401 Unauthorized"))
 		return
 	}
-	err = bcrypt.CompareHashAndPassword(storedUserData.PasswordHash, []byte(params.Password))
+	err = cfg.passwords.Verify(storedUserData.PasswordHash, params.Password)
 	if err != nil {
+		if err != errPasswordMismatch {
+			fmt.Printf("Could not check password for user %d: %s\n", storedUserData.Id, err)
+		}
+		cfg.loginFailed(params.Email, ip, storedUserData.Id)
 		w.WriteHeader(401)
 		w.Write([]byte("User does not exist or password was incorrect: 401 Unauthorized"))
 		return
 	}
-	token := ""
-	if params.Expiry == 0 {
-		token, err = produceJWT(86400, storedUserData.Id)
-		if err != nil {
-			fmt.Printf("Something is wrong with creating JWT for login request: %s\n", err)
-		}
-	} else {
-		token, err = produceJWT(params.Expiry, storedUserData.Id)
-		if err != nil {
-			fmt.Printf("Something is wrong with creating JWT for login request: %s\n", err)
-		}
+	if cfg.passwords.NeedsRehash(storedUserData.PasswordHash) {
+		cfg.rehashPassword(storedUserData, params.Password)
+	}
+	// The account's failures are only cleared once the second factor is in
+	// too, or knowing the password would allow unlimited guesses at codes.
+	if storedUserData.TOTPSecret != "" {
+		cfg.writeTwoFactorChallenge(w, storedUserData, params.Expiry, params.Device)
+		return
 	}
+	cfg.throttle.succeed(params.Email)
+	cfg.startSession(w, r, storedUserData, params.Expiry, params.Device)
+}
+
+// startSession logs user in: it opens a session and responds with an access
+// token and the session's refresh token. expiry is the access token
+// lifetime the client asked for in seconds, zero for the default.
+func (cfg *apiConfig) startSession(w http.ResponseWriter, r *http.Request, user User, expiry int, device string) {
+	sessionId := newSessionId()
+	// Clients may shorten the access token's lifetime but not extend it.
+	ttl := cfg.accessTokenTTL
+	if expiry > 0 && expiry < int(ttl/time.Second) {
+		ttl = time.Duration(expiry) * time.Second
+	}
+	token, expiresAt, err := cfg.produceJWT(ttl, user.Id, sessionId, "")
+	if err != nil {
+		fmt.Printf("Something is wrong with creating JWT for login request: %s\n", err)
+		w.WriteHeader(500)
+		return
+	}
+	now := time.Now().UTC()
 	refreshToken := newRefreshToken()
-	tokens := readTokens(refreshTokenDbFile)
-	tokens.Tokens[storedUserData.Id] = RefreshToken{
-		UserId:        storedUserData.Id,
-		Token:         refreshToken,
-		ExirationDate: time.Now().UTC().AddDate(0, 0, 60),
+	err = cfg.store.SaveRefreshToken(RefreshToken{
+		Id:            sessionId,
+		UserId:        user.Id,
+		Token:         hashRefreshToken(refreshToken),
+		ExirationDate: now.Add(cfg.refreshTokenTTL),
+		Device:        device,
+		UserAgent:     r.UserAgent(),
+		IP:            clientIP(r),
+		CreatedAt:     now,
+		LastUsedAt:    now,
+	})
+	if err != nil {
+		fmt.Printf("There was an error saving refresh token: %s\n", err)
+		w.WriteHeader(500)
+		return
 	}
-	saveTokens(refreshTokenDbFile, tokens)
 
 	userInfo := UserAuth{
-		Id:           storedUserData.Id,
-		Email:        storedUserData.Email,
-		IsChirpyRed:  storedUserData.IsChirpyRed,
-		Token:        token,
-		RefreshToken: refreshToken,
+		Id:            user.Id,
+		Email:         user.Email,
+		IsChirpyRed:   user.IsChirpyRed,
+		EmailVerified: user.EmailVerified,
+		Token:         token,
+		ExpiresAt:     expiresAt,
+		RefreshToken:  refreshToken,
 	}
 	data, marshallErr := json.Marshal(userInfo)
 	if marshallErr != nil {
@@ -245,99 +292,34 @@ func authenticateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
 	w.WriteHeader(200)
 	w.Write(data)
 	return
 }
 
-func updateUser(w http.ResponseWriter, r *http.Request) {
-	type parameters struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
-	}
-	decoder := json.NewDecoder(r.Body)
-	params := parameters{}
-	err := decoder.Decode(&params)
+// errPasswordChanged means the stored password hash is no longer the one a
+// request checked, because the password was changed in the meantime.
+var errPasswordChanged = errors.New("password changed since it was checked")
+
+// rehashPassword replaces a stored hash made with outdated settings. It runs
+// after a successful login, the only time the password is known, and a
+// failure only means trying again next time. If the password was changed
+// since the login checked it, the new one is left alone.
+func (cfg *apiConfig) rehashPassword(user User, password string) {
+	hash, err := cfg.passwords.Hash(password)
 	if err != nil {
-		log.Printf("Error decoding parameters: %s", err)
-		w.WriteHeader(500)
+		fmt.Printf("Could not rehash password for user %d: %s\n", user.Id, err)
 		return
 	}
-	header := r.Header.Get("authorization")
-	if header == "" {
-		out := "Request wasn't made with header 'Authorization: Bearer <my_auth_token>'"
-		w.Write([]byte(out))
-		w.WriteHeader(400)
-		return
-	}
-	bearerToken := strings.Replace(header, "Bearer ", "", 1)
-	secret := os.Getenv("JWT_SECRET")
-	claims := &jwt.RegisteredClaims{}
-	parsedToken, err := jwt.ParseWithClaims(bearerToken, claims, func(t *jwt.Token) (interface{}, error) {
-		return []byte(secret), nil
+	_, err = cfg.store.UpdateUserFunc(user.Id, func(current *User) error {
+		if !bytes.Equal(current.PasswordHash, user.PasswordHash) {
+			return errPasswordChanged
+		}
+		current.PasswordHash = hash
+		return nil
 	})
-	if err != nil {
-		fmt.Printf("Error parsing claims from received token: %s\n", err)
-		w.WriteHeader(401)
-		return
+	if err != nil && err != errPasswordChanged {
+		fmt.Printf("Could not save rehashed password for user %d: %s\n", user.Id, err)
 	}
-	issuer, err := parsedToken.Claims.GetIssuer()
-	if err != nil {
-		fmt.Printf("There was an error reading issuer from parsed token claims: %s\n", err)
-	}
-	if issuer != "chirpy" {
-		fmt.Println("Parsed a JWT that we did not issue")
-		w.WriteHeader(401)
-		return
-	}
-	uid, err := parsedToken.Claims.GetSubject()
-	users := readUsers(userDbFile)
-	if duplicateUserCheck(users, params.Email) {
-		out := fmt.Sprintf("Email address %s is already in use\n", params.Email)
-		w.Write([]byte(out))
-		w.WriteHeader(400)
-		return
-	}
-	if !validateEmail(params.Email) {
-		out := fmt.Sprintf("%s is not a valid email address\n", params.Email)
-		w.Write([]byte(out))
-		w.WriteHeader(400)
-		return
-	}
-	uidInt, err := strconv.Atoi(uid)
-	if err != nil {
-		fmt.Printf("There was an error converting token parsed user id to a number: %s\n", err)
-		w.WriteHeader(401)
-		return
-	}
-	updatedUser, ok := users.Users[uidInt]
-	if !ok {
-		fmt.Println("Targeted user no longer exists!")
-		w.WriteHeader(401)
-		return
-	}
-	hash, err := bcrypt.GenerateFromPassword([]byte(params.Password), 2)
-	if err != nil {
-		fmt.Printf("There was an error generating a password hash: %s", err)
-		w.WriteHeader(401)
-		return
-	}
-	updatedUser.Email = params.Email
-	updatedUser.PasswordHash = hash
-	users.Users[uidInt] = updatedUser
-	saveUsers(userDbFile, users)
-	user := UserInfo{
-		Id:    uidInt,
-		Email: updatedUser.Email,
-	}
-	data, err := json.Marshal(&user)
-	if err != nil {
-		fmt.Printf("There was an error marshalling updated user to JSON: %s\n", err)
-		w.WriteHeader(500)
-		return
-	}
-
-	w.Write(data)
-	w.WriteHeader(200)
-	return
 }
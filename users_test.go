@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestUserJSONGrandfathersEmailVerification(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want bool
+	}{
+		{"saved before verification existed", `{"id":1,"email":"old@example.com"}`, true},
+		{"unverified", `{"id":2,"email":"new@example.com","email_verified":false}`, false},
+		{"verified", `{"id":3,"email":"done@example.com","email_verified":true}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := User{}
+			if err := json.Unmarshal([]byte(tt.data), &user); err != nil {
+				t.Fatal(err)
+			}
+			if user.EmailVerified != tt.want {
+				t.Errorf("EmailVerified is %t, want %t", user.EmailVerified, tt.want)
+			}
+		})
+	}
+
+	data := UserData{}
+	if err := json.Unmarshal([]byte(`{"users":{"1":{"id":1,"email":"old@example.com"}}}`), &data); err != nil {
+		t.Fatal(err)
+	}
+	if !data.Users[1].EmailVerified {
+		t.Errorf("user read from a users file is not verified")
+	}
+}
+
+func TestSignupRejectsDuplicateEmail(t *testing.T) {
+	cfg := newTestConfig(t)
+	handler := cfg.routes()
+	signup := map[string]string{"email": "twice@example.com", "password": testPassword}
+
+	if rec := doRequest(t, handler, "POST", "/api/users", "", signup); rec.Code != 201 {
+		t.Fatalf("first signup: got %d %q", rec.Code, rec.Body.String())
+	}
+	rec := doRequest(t, handler, "POST", "/api/users", "", signup)
+	if rec.Code != 400 || !strings.Contains(rec.Body.String(), "already exists") {
+		t.Errorf("second signup: got %d %q, want 400", rec.Code, rec.Body.String())
+	}
+	signup["email"] = "not-an-address"
+	if rec := doRequest(t, handler, "POST", "/api/users", "", signup); rec.Code != 400 {
+		t.Errorf("signup with an invalid address: got %d, want 400", rec.Code)
+	}
+}
@@ -1,8 +1,18 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 func getPort() string {
@@ -13,44 +23,418 @@ func getPort() string {
 	return port
 }
 
-func bootStrapChirpDb() {
-	db, err := os.OpenFile(dbFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
-	if err != nil {
-		fmt.Printf("Could not open chirp db: %s", err)
-		os.Exit(1)
+// getBaseURL is where the server can be reached from outside, used to build
+// links sent to users and as the issuer of the tokens it signs, read from
+// BASE_URL. It defaults to this host and PORT.
+func getBaseURL() string {
+	base := os.Getenv("BASE_URL")
+	if len(base) < 1 {
+		base = "http://localhost:" + getPort()
 	}
-	dbInfo, _ := db.Stat()
-	if dbInfo.Size() <= 0 {
-		db.Close()
-		chirps := ChirpData{Chirps: make(map[int]Chirp)}
-		saveChirps(dbFile, chirps)
+	return strings.TrimSuffix(base, "/")
+}
+
+// getMailer picks how mail is delivered, read from MAILER: outbox (the
+// default) writes it to files for development, smtp sends it through
+// SMTP_ADDR, logging in with SMTP_USERNAME and SMTP_PASSWORD if set.
+func getMailer() string {
+	kind := os.Getenv("MAILER")
+	if len(kind) < 1 {
+		kind = mailerOutbox
 	}
+	return kind
 }
 
-func bootStrapUserDb() {
-	db, err := os.OpenFile(userDbFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+// getMailFrom is the From address on mail sent to users, read from
+// MAIL_FROM.
+func getMailFrom() string {
+	from := os.Getenv("MAIL_FROM")
+	if len(from) < 1 {
+		from = "Chirpy <no-reply@localhost>"
+	}
+	return from
+}
+
+// getMailOutboxDir is where the outbox mailer writes mail, read from
+// MAIL_OUTBOX.
+func getMailOutboxDir() string {
+	dir := os.Getenv("MAIL_OUTBOX")
+	if len(dir) < 1 {
+		dir = "outbox"
+	}
+	return dir
+}
+
+// getPasswordResetURL is the page password reset links point at, read from
+// PASSWORD_RESET_URL. The page is expected to take the token from the query
+// string and post it to /api/password-reset/confirm with the new password,
+// which is what the default, static/reset-password.html, does.
+func getPasswordResetURL() string {
+	link := os.Getenv("PASSWORD_RESET_URL")
+	if len(link) < 1 {
+		link = getBaseURL() + "/app/reset-password.html"
+	}
+	return link
+}
+
+// getOIDCIssuer is the identity provider federated login goes through,
+// read from OIDC_ISSUER. Federated login is off when it is not set.
+func getOIDCIssuer() string {
+	return strings.TrimSuffix(os.Getenv("OIDC_ISSUER"), "/")
+}
+
+// getOIDCClientId is the client id Chirpy is registered with at the
+// identity provider, read from OIDC_CLIENT_ID.
+func getOIDCClientId() string {
+	return os.Getenv("OIDC_CLIENT_ID")
+}
+
+// getOIDCClientSecret is the client secret, read from OIDC_CLIENT_SECRET.
+// It can be left unset if the provider registered Chirpy as a public
+// client, since PKCE is always used.
+func getOIDCClientSecret() string {
+	return os.Getenv("OIDC_CLIENT_SECRET")
+}
+
+// getOIDCRedirectURL is where the identity provider sends users back to,
+// read from OIDC_REDIRECT_URL. It must be registered with the provider.
+func getOIDCRedirectURL() string {
+	link := os.Getenv("OIDC_REDIRECT_URL")
+	if len(link) < 1 {
+		link = getBaseURL() + "/api/login/oidc/callback"
+	}
+	return link
+}
+
+// getOIDCScopes are the scopes asked of the identity provider, read from
+// OIDC_SCOPES as a space separated list. openid and email are always
+// asked for.
+func getOIDCScopes() []string {
+	scopes := strings.Fields(os.Getenv("OIDC_SCOPES"))
+	for _, required := range []string{"openid", "email"} {
+		if !slices.Contains(scopes, required) {
+			scopes = append(scopes, required)
+		}
+	}
+	return scopes
+}
+
+// getOIDCAppURL is the app page a finished federated login is handed off
+// to, with a one-time code to trade for a session, read from OIDC_APP_URL.
+// When it is not set the callback responds with the session itself.
+func getOIDCAppURL() string {
+	return os.Getenv("OIDC_APP_URL")
+}
+
+// getOIDCAutoProvision reports whether federated login creates an account
+// for a verified email address that has none, read from
+// OIDC_AUTO_PROVISION. Otherwise only existing accounts can be linked.
+func getOIDCAutoProvision() bool {
+	provision, _ := strconv.ParseBool(os.Getenv("OIDC_AUTO_PROVISION"))
+	return provision
+}
+
+// getStaticDir is the directory served under /app, read from STATIC_DIR.
+func getStaticDir() string {
+	dir := os.Getenv("STATIC_DIR")
+	if len(dir) < 1 {
+		dir = "static"
+	}
+	return dir
+}
+
+// getStaticAllowlist lists the paths under the static dir that /app may
+// serve, read from STATIC_ALLOWLIST as a comma separated list. Entries
+// ending in "/" allow a whole directory. A list that leaves out
+// reset-password.html or authorize.html breaks password reset links or
+// OAuth consent, unless PASSWORD_RESET_URL points elsewhere.
+func getStaticAllowlist() []string {
+	raw := os.Getenv("STATIC_ALLOWLIST")
+	if len(raw) < 1 {
+		raw = "index.html,assets/,reset-password.html,authorize.html"
+	}
+	allowlist := []string{}
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimPrefix(strings.TrimSpace(entry), "/")
+		if entry != "" {
+			allowlist = append(allowlist, entry)
+		}
+	}
+	return allowlist
+}
+
+// getStoreBackend picks the storage implementation, read from
+// STORE_BACKEND: json (the default) or sqlite. Moving an existing
+// deployment to sqlite takes a run of import-json first.
+func getStoreBackend() string {
+	backend := os.Getenv("STORE_BACKEND")
+	if len(backend) < 1 {
+		backend = "json"
+	}
+	return backend
+}
+
+// readJSONFile decodes file into v. An empty or unparseable file is an
+// error rather than an empty dataset, since that is what a torn write from
+// an older build leaves behind.
+func readJSONFile(file string, v any) error {
+	data, err := os.ReadFile(file)
 	if err != nil {
-		fmt.Printf("Could not open user db: %s", err)
-		os.Exit(1)
+		return err
+	}
+	if len(data) == 0 {
+		return fmt.Errorf("%s is empty", file)
 	}
-	dbInfo, _ := db.Stat()
-	if dbInfo.Size() <= 0 {
-		db.Close()
-		users := UserData{Users: make(map[int]User)}
-		saveUsers(userDbFile, users)
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s is corrupt: %w", file, err)
 	}
+	return nil
 }
 
-func bootStrapRefreshTokenDb() {
-	db, err := os.OpenFile(refreshTokenDbFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+func writeJSONFile(file string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(file, data, 0666)
+}
+
+// writeFileAtomic writes data to a temp file next to file, fsyncs it and
+// renames it into place, so readers see either the old or the new contents
+// and never a partial write.
+func writeFileAtomic(file string, data []byte, perm os.FileMode) error {
+	return writeFileAtomicFunc(file, perm, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// writeFileAtomicFunc is writeFileAtomic for contents produced by write. If
+// write fails, file is left as it was.
+func writeFileAtomicFunc(file string, perm os.FileMode, write func(w io.Writer) error) error {
+	dir := filepath.Dir(file)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(file)+".tmp-*")
 	if err != nil {
-		fmt.Printf("Could not open token db: %s", err)
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpName, perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, file); err != nil {
+		return err
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// bootStrapJSONDb creates file from empty if it does not exist yet and
+// otherwise makes sure it still parses, exiting if it does not.
+func bootStrapJSONDb(name, file string, empty any, check func(string) error) {
+	if _, err := os.Stat(file); errors.Is(err, os.ErrNotExist) {
+		if err := writeJSONFile(file, empty); err != nil {
+			fmt.Printf("Could not create %s db: %s\n", name, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if err := check(file); err != nil {
+		fmt.Printf("Refusing to start, %s db failed its integrity check: %s\n", name, err)
 		os.Exit(1)
 	}
-	dbInfo, _ := db.Stat()
-	if dbInfo.Size() <= 0 {
-		db.Close()
-		tokens := RefreshTokens{Tokens: make(map[int]RefreshToken)}
-		saveTokens(refreshTokenDbFile, tokens)
+}
+
+// openStore opens the backend picked by STORE_BACKEND, creating or
+// migrating its files as needed.
+func openStore() (Store, error) {
+	switch getStoreBackend() {
+	case "json":
+		bootStrapChirpDb()
+		bootStrapUserDb()
+		bootStrapRefreshTokenDb()
+		store, err := newJSONStore(dbFile, userDbFile, refreshTokenDbFile, accessTokenDbFile, oauthClientDbFile, revocationDbFile, passwordResetDbFile, walFile)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case "sqlite":
+		store, err := newSQLiteStore(sqliteDbFile)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	}
+	return nil, fmt.Errorf("unknown STORE_BACKEND %q, use json or sqlite", getStoreBackend())
+}
+
+// getSigningAlg picks the key type new signing keys are generated with,
+// read from JWT_SIGNING_ALG: EdDSA (Ed25519, the default) or RS256.
+func getSigningAlg() string {
+	alg := os.Getenv("JWT_SIGNING_ALG")
+	if len(alg) < 1 {
+		alg = algEdDSA
+	}
+	return alg
+}
+
+// getKeyRotationInterval is how long a signing key stays active, read from
+// JWT_KEY_ROTATION (e.g. "168h").
+func getKeyRotationInterval() time.Duration {
+	interval, err := time.ParseDuration(os.Getenv("JWT_KEY_ROTATION"))
+	if err != nil || interval <= 0 {
+		interval = 7 * 24 * time.Hour
+	}
+	return interval
+}
+
+// getVerifyKeyCount is how many retired keys are kept to verify tokens
+// issued before a rotation, read from JWT_VERIFY_KEYS.
+func getVerifyKeyCount() int {
+	count, err := strconv.Atoi(os.Getenv("JWT_VERIFY_KEYS"))
+	if err != nil || count < 0 {
+		count = 3
+	}
+	return count
+}
+
+// getJWTLeeway is how much clock skew is tolerated on exp, iat and nbf,
+// read from JWT_LEEWAY (e.g. "30s").
+func getJWTLeeway() time.Duration {
+	leeway, err := time.ParseDuration(os.Getenv("JWT_LEEWAY"))
+	if err != nil || leeway < 0 {
+		leeway = 30 * time.Second
+	}
+	return leeway
+}
+
+// getPasswordHasher picks how new password hashes are made, read from
+// PASSWORD_HASHER: bcrypt (the default) or argon2id.
+func getPasswordHasher() string {
+	alg := os.Getenv("PASSWORD_HASHER")
+	if len(alg) < 1 {
+		alg = hasherBcrypt
+	}
+	return alg
+}
+
+// getBcryptCost is the cost new bcrypt hashes are made with, read from
+// BCRYPT_COST. Stored hashes below it are redone on the next login.
+func getBcryptCost() int {
+	cost, err := strconv.Atoi(os.Getenv("BCRYPT_COST"))
+	if err != nil || cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		cost = bcrypt.DefaultCost
+	}
+	return cost
+}
+
+// getPasswordMinLength is the shortest password accepted, in characters,
+// read from PASSWORD_MIN_LENGTH.
+func getPasswordMinLength() int {
+	length, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_LENGTH"))
+	if err != nil || length < 1 {
+		length = 12
 	}
+	return length
+}
+
+// getBreachedPasswordsFile is the breached-password list new passwords are
+// checked against, read from BREACHED_PASSWORDS_FILE. It may name a single
+// file of full hashes or a directory of range files. The check is off when
+// it is unset.
+func getBreachedPasswordsFile() string {
+	return os.Getenv("BREACHED_PASSWORDS_FILE")
+}
+
+const (
+	maxAccessTokenTTL  = 24 * time.Hour
+	maxRefreshTokenTTL = 90 * 24 * time.Hour
+)
+
+// getAccessTokenTTL is how long an access token from POST /api/login lasts,
+// read from ACCESS_TOKEN_TTL (e.g. "24h"). Clients can ask for a shorter
+// expiry with expires_in_seconds but never a longer one.
+func getAccessTokenTTL() time.Duration {
+	ttl, err := time.ParseDuration(os.Getenv("ACCESS_TOKEN_TTL"))
+	if err != nil || ttl <= 0 {
+		ttl = 24 * time.Hour
+	}
+	return capDuration("ACCESS_TOKEN_TTL", ttl, maxAccessTokenTTL)
+}
+
+// getRefreshedAccessTokenTTL is how long an access token from POST
+// /api/refresh lasts, read from REFRESHED_ACCESS_TOKEN_TTL (e.g. "1h").
+func getRefreshedAccessTokenTTL() time.Duration {
+	ttl, err := time.ParseDuration(os.Getenv("REFRESHED_ACCESS_TOKEN_TTL"))
+	if err != nil || ttl <= 0 {
+		ttl = time.Hour
+	}
+	return capDuration("REFRESHED_ACCESS_TOKEN_TTL", ttl, maxAccessTokenTTL)
+}
+
+// getRefreshTokenTTL is how long a login session's refresh token lasts,
+// read from REFRESH_TOKEN_TTL (e.g. "1440h"). Rotating the token does not
+// extend it.
+func getRefreshTokenTTL() time.Duration {
+	ttl, err := time.ParseDuration(os.Getenv("REFRESH_TOKEN_TTL"))
+	if err != nil || ttl <= 0 {
+		ttl = 60 * 24 * time.Hour
+	}
+	return capDuration("REFRESH_TOKEN_TTL", ttl, maxRefreshTokenTTL)
+}
+
+func capDuration(name string, d, max time.Duration) time.Duration {
+	if d > max {
+		fmt.Printf("%s of %s is over the %s maximum, using %s\n", name, d, max, max)
+		return max
+	}
+	return d
+}
+
+// getSnapshotInterval is how often the JSON store folds its write-ahead log
+// into the snapshot files, read from SNAPSHOT_INTERVAL (e.g. "10m").
+func getSnapshotInterval() time.Duration {
+	interval, err := time.ParseDuration(os.Getenv("SNAPSHOT_INTERVAL"))
+	if err != nil || interval <= 0 {
+		interval = 5 * time.Minute
+	}
+	return interval
+}
+
+func bootStrapChirpDb() {
+	bootStrapJSONDb("chirp", dbFile, ChirpData{Chirps: make(map[int]Chirp)}, func(file string) error {
+		_, err := readChirps(file)
+		return err
+	})
+}
+
+func bootStrapUserDb() {
+	bootStrapJSONDb("user", userDbFile, UserData{Users: make(map[int]User)}, func(file string) error {
+		_, err := readUsers(file)
+		return err
+	})
+}
+
+func bootStrapRefreshTokenDb() {
+	bootStrapJSONDb("token", refreshTokenDbFile, RefreshTokens{Tokens: make(map[string]RefreshToken), Hashed: true}, func(file string) error {
+		_, err := readTokens(file)
+		return err
+	})
 }
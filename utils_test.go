@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A write that fails part way, or a rename that cannot happen, leaves the
+// old contents in place and no temp files behind.
+func TestWriteFileAtomicFailureKeepsOldFile(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "data.json")
+	if err := writeFileAtomic(file, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	failed := errors.New("disk full")
+	err := writeFileAtomicFunc(file, 0600, func(w io.Writer) error {
+		if _, err := w.Write([]byte("half of the new")); err != nil {
+			return err
+		}
+		return failed
+	})
+	if !errors.Is(err, failed) {
+		t.Fatalf("got %v, want the write's error", err)
+	}
+	if data, err := os.ReadFile(file); err != nil || string(data) != "old" {
+		t.Errorf("file after a failed write: got %q, %v, want the old contents", data, err)
+	}
+
+	// Renaming over a directory fails after the temp file is complete.
+	target := filepath.Join(dir, "occupied")
+	if err := os.Mkdir(target, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(target, "keep"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(target, []byte("new"), 0600); err == nil {
+		t.Error("renaming over a directory succeeded")
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Name() != "data.json" && entry.Name() != "occupied" {
+			t.Errorf("left %s behind", entry.Name())
+		}
+	}
+}
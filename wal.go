@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	opPutChirp           = "chirp.put"
+	opDeleteChirp        = "chirp.delete"
+	opPutUser            = "user.put"
+	opPutToken           = "token.put"
+	opDeleteToken        = "token.delete"
+	opDeleteUserTokens   = "token.delete_user"
+	opDeleteClientTokens = "token.delete_client"
+	opPruneTokens        = "token.prune"
+	opPutPAT             = "pat.put"
+	opDeletePAT          = "pat.delete"
+	opDeleteUserPATs     = "pat.delete_user"
+	opPutClient          = "client.put"
+	opDeleteClient       = "client.delete"
+	opRevokeAccess       = "revocation.put"
+	opPruneRevocations   = "revocation.prune"
+	opPutReset           = "reset.put"
+	opTakeReset          = "reset.take"
+	opPruneResets        = "reset.prune"
+	opRestore            = "restore"
+)
+
+// walEntry is one mutation. Puts carry the full record so replaying an
+// entry twice, e.g. over a snapshot that already contains it, is harmless.
+// A restore carries the whole dataset so that it lands in a single append.
+type walEntry struct {
+	Op       string               `json:"op"`
+	Id       int                  `json:"id,omitempty"`
+	Key      string               `json:"key,omitempty"`
+	Chirp    *Chirp               `json:"chirp,omitempty"`
+	User     *User                `json:"user,omitempty"`
+	Token    *RefreshToken        `json:"token,omitempty"`
+	PAT      *PersonalAccessToken `json:"pat,omitempty"`
+	Client   *OAuthClient         `json:"client,omitempty"`
+	Reset    *PasswordReset       `json:"reset,omitempty"`
+	Time     *time.Time           `json:"time,omitempty"`
+	Snapshot *storeSnapshot       `json:"snapshot,omitempty"`
+}
+
+// writeAheadLog is an append-only file of walEntry records, one per line,
+// each prefixed with a CRC32 of the JSON that follows it.
+type writeAheadLog struct {
+	mu      sync.Mutex
+	file    *os.File
+	entries int
+}
+
+func openWAL(path string) (*writeAheadLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return &writeAheadLog{file: file}, nil
+}
+
+func (l *writeAheadLog) append(entry walEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line := fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE(data), data)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.file.WriteString(line); err != nil {
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	l.entries++
+	return nil
+}
+
+// replay calls apply for every entry in the log in order. A torn final line
+// from a crash mid-append is dropped; a bad line anywhere else means the log
+// is corrupt and replay fails.
+func (l *writeAheadLog) replay(apply func(walEntry)) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, err := l.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	entries, valid, err := replayWALEntries(l.file, apply)
+	if err != nil {
+		return err
+	}
+	l.entries += entries
+	size, err := l.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if size > valid {
+		return l.file.Truncate(valid)
+	}
+	return nil
+}
+
+// replayWALEntries calls apply for every entry read from r and returns how
+// many there were and how many bytes they took up. A torn final line is
+// skipped, leaving it to the caller to truncate it.
+func replayWALEntries(r io.Reader, apply func(walEntry)) (int, int64, error) {
+	reader := bufio.NewReader(r)
+	offset := int64(0)
+	lineNo := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				fmt.Printf("Dropping torn write at the end of the write-ahead log (%d bytes)\n", len(line))
+			}
+			return lineNo, offset, nil
+		}
+		if err != nil {
+			return lineNo, offset, err
+		}
+		entry, err := decodeWALLine(line)
+		if err != nil {
+			return lineNo, offset, fmt.Errorf("write-ahead log line %d: %w", lineNo+1, err)
+		}
+		apply(entry)
+		offset += int64(len(line))
+		lineNo++
+	}
+}
+
+func decodeWALLine(line []byte) (walEntry, error) {
+	entry := walEntry{}
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	sum, data, ok := bytes.Cut(line, []byte(" "))
+	if !ok {
+		return entry, errors.New("missing checksum")
+	}
+	if string(sum) != fmt.Sprintf("%08x", crc32.ChecksumIEEE(data)) {
+		return entry, errors.New("checksum mismatch")
+	}
+	err := json.Unmarshal(data, &entry)
+	return entry, err
+}
+
+// reset empties the log once its entries are safely in a snapshot.
+func (l *writeAheadLog) reset() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.file.Truncate(0); err != nil {
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	l.entries = 0
+	return nil
+}
+
+func (l *writeAheadLog) len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.entries
+}
+
+func (l *writeAheadLog) Close() error {
+	return l.file.Close()
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// openTestJSONStore opens the JSON store kept in dir, creating it if need
+// be. Tests that want to simulate a crash close only the write-ahead log,
+// since Close compacts it away first.
+func openTestJSONStore(t *testing.T, dir string) (*jsonStore, error) {
+	t.Helper()
+	path := func(name string) string { return filepath.Join(dir, name) }
+	return newJSONStore(path("chirps.json"), path("users.json"), path("tokens.json"), path("pats.json"),
+		path("clients.json"), path("revocations.json"), path("resets.json"), path("wal.log"))
+}
+
+// newTestJSONDir returns a directory holding the empty snapshots a fresh
+// JSON store starts from, as bootstrapping would create them.
+func newTestJSONDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	seeds := map[string]any{
+		"chirps.json": ChirpData{Chirps: make(map[int]Chirp)},
+		"users.json":  UserData{Users: make(map[int]User)},
+		"tokens.json": RefreshTokens{Tokens: make(map[string]RefreshToken), Hashed: true},
+	}
+	for name, empty := range seeds {
+		if err := writeJSONFile(filepath.Join(dir, name), empty); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// writeTestWAL creates a store in a fresh directory, adds a user for each
+// email and crashes, leaving every change in the write-ahead log.
+func writeTestWAL(t *testing.T, emails ...string) string {
+	t.Helper()
+	dir := newTestJSONDir(t)
+	store, err := openTestJSONStore(t, dir)
+	if err != nil {
+		t.Fatalf("opening store: %s", err)
+	}
+	for _, email := range emails {
+		if _, err := store.CreateUser(User{Email: email, PasswordHash: []byte("hash")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.wal.Close()
+	return dir
+}
+
+// reopenTestJSONStore opens the store in dir and reports which of emails
+// belong to a user.
+func reopenTestJSONStore(t *testing.T, dir string, emails ...string) (*jsonStore, []bool) {
+	t.Helper()
+	store, err := openTestJSONStore(t, dir)
+	if err != nil {
+		t.Fatalf("reopening store: %s", err)
+	}
+	t.Cleanup(func() { store.wal.Close() })
+	found := make([]bool, len(emails))
+	for i, email := range emails {
+		_, err := store.GetUserByEmail(email)
+		found[i] = err == nil
+	}
+	return store, found
+}
+
+func TestWALReplayAfterCrash(t *testing.T) {
+	dir := writeTestWAL(t, "first@example.com", "second@example.com")
+	store, found := reopenTestJSONStore(t, dir, "first@example.com", "second@example.com")
+	if !found[0] || !found[1] {
+		t.Errorf("users found after replay: %v, want both", found)
+	}
+	if store.wal.len() != 2 {
+		t.Errorf("replayed %d entries, want 2", store.wal.len())
+	}
+}
+
+// A record cut short by a crash mid-append is dropped and truncated away,
+// and the records before it survive.
+func TestWALDropsTornFinalRecord(t *testing.T) {
+	dir := writeTestWAL(t, "first@example.com", "second@example.com")
+	walFile := filepath.Join(dir, "wal.log")
+	data, err := os.ReadFile(walFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intact := len(data)
+	lines := strings.SplitAfter(string(data), "\n")
+	last := lines[len(lines)-2]
+	if err := os.WriteFile(walFile, data[:intact-len(last)/2], 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	store, found := reopenTestJSONStore(t, dir, "first@example.com", "second@example.com")
+	if !found[0] || found[1] {
+		t.Errorf("users found after replay: %v, want only the first", found)
+	}
+	info, err := os.Stat(walFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(intact - len(last)); info.Size() != want {
+		t.Errorf("log is %d bytes after replay, want the torn record truncated to %d", info.Size(), want)
+	}
+
+	// New records land after the intact ones and replay cleanly.
+	if _, err := store.CreateUser(User{Email: "third@example.com", PasswordHash: []byte("hash")}); err != nil {
+		t.Fatal(err)
+	}
+	store.wal.Close()
+	_, found = reopenTestJSONStore(t, dir, "first@example.com", "third@example.com")
+	if !found[0] || !found[1] {
+		t.Errorf("users found after second replay: %v, want both", found)
+	}
+}
+
+// A complete record whose checksum does not match is corruption, not a
+// torn write, so the store refuses to open rather than skip it.
+func TestWALRejectsChecksumMismatch(t *testing.T) {
+	dir := writeTestWAL(t, "first@example.com", "second@example.com")
+	walFile := filepath.Join(dir, "wal.log")
+	data, err := os.ReadFile(walFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := strings.Replace(string(data), "first@example.com", "fIrst@example.com", 1)
+	if err := os.WriteFile(walFile, []byte(corrupt), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := openTestJSONStore(t, dir)
+	if err == nil {
+		store.wal.Close()
+		t.Fatal("opened a store whose log fails its checksum")
+	}
+	if !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("got %q, want a checksum mismatch", err)
+	}
+}
+
+// Records from before a compaction come back from the snapshots, and those
+// after it from the log.
+func TestWALReplayAfterCompaction(t *testing.T) {
+	dir := newTestJSONDir(t)
+	store, err := openTestJSONStore(t, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.CreateUser(User{Email: "before@example.com", PasswordHash: []byte("hash")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.compact(); err != nil {
+		t.Fatalf("compacting: %s", err)
+	}
+	if store.wal.len() != 0 {
+		t.Fatalf("log holds %d entries after compaction, want 0", store.wal.len())
+	}
+	if _, err := store.CreateUser(User{Email: "after@example.com", PasswordHash: []byte("hash")}); err != nil {
+		t.Fatal(err)
+	}
+	store.wal.Close()
+
+	store, found := reopenTestJSONStore(t, dir, "before@example.com", "after@example.com")
+	if !found[0] || !found[1] {
+		t.Errorf("users found after replay: %v, want both", found)
+	}
+	if store.wal.len() != 1 {
+		t.Errorf("replayed %d entries, want only the one after compaction", store.wal.len())
+	}
+}
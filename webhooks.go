@@ -15,7 +15,7 @@ type PolkaEvent struct {
 	} `json:"data"`
 }
 
-func userUpgrade(w http.ResponseWriter, r *http.Request) {
+func (cfg *apiConfig) userUpgrade(w http.ResponseWriter, r *http.Request) {
 	header := r.Header.Get("authorization")
 	if header == "" {
 		w.WriteHeader(401)
@@ -43,25 +43,19 @@ func userUpgrade(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	users := readUsers(userDbFile)
-	targetUser := User{}
-	userFound := false
-
-	for _, val := range users.Users {
-		if val.Id == params.Data.UserID {
-			targetUser = val
-			targetUser.IsChirpyRed = true
-			userFound = true
-		}
-	}
-
-	if !userFound {
+	_, err = cfg.store.UpdateUserFunc(params.Data.UserID, func(user *User) error {
+		user.IsChirpyRed = true
+		return nil
+	})
+	if err == errNotFound {
 		w.WriteHeader(404)
 		return
 	}
-
-	users.Users[targetUser.Id] = targetUser
-	saveUsers(userDbFile, users)
+	if err != nil {
+		log.Printf("Error saving upgraded user: %s", err)
+		w.WriteHeader(500)
+		return
+	}
 	w.WriteHeader(204)
 	return
 }